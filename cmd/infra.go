@@ -1,11 +1,15 @@
 package cmd
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
+	"text/tabwriter"
 
 	"github.com/micro/platform/infra"
+	"github.com/mitchellh/go-homedir"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
@@ -21,16 +25,74 @@ a complete platform can be created across multiple cloud providers`,
 func init() {
 	cobra.OnInitialize(viperConfig)
 
-	// TODO at some point: Resurrect the Infra command?
-	// rootCmd.AddCommand(infraCmd)
+	// plan, apply and destroy, and the flags controlling how they run, are
+	// only reachable with the infra command registered
+	rootCmd.AddCommand(infraCmd)
 
-	infraCmd.PersistentFlags().StringP(
-		"config-file",
-		"c",
+	infraCmd.PersistentFlags().Int(
+		"concurrency",
+		infra.DefaultConcurrency,
+		"Maximum number of tasks to run in parallel, 0 for no limit ($MICRO_CONCURRENCY)",
+	)
+	viper.BindPFlag("concurrency", infraCmd.PersistentFlags().Lookup("concurrency"))
+	infraCmd.PersistentFlags().String(
+		"plan-dir",
+		"",
+		"Directory plan saves plan artifacts to, and apply applies them from ($MICRO_PLAN_DIR)",
+	)
+	viper.BindPFlag("plan-dir", infraCmd.PersistentFlags().Lookup("plan-dir"))
+	infraCmd.PersistentFlags().String(
+		"plan-key",
 		"",
-		"Path to infrastructure definition file ($MICRO_CONFIG_FILE)",
+		"Passphrase encrypting saved plans of modules with secret variables ($MICRO_PLAN_KEY)",
+	)
+	viper.BindPFlag("plan-key", infraCmd.PersistentFlags().Lookup("plan-key"))
+	infraCmd.PersistentFlags().Duration(
+		"interrupt-timeout",
+		infra.DefaultInterruptTimeout,
+		"How long terraform has to exit gracefully when cancelled ($MICRO_INTERRUPT_TIMEOUT)",
+	)
+	viper.BindPFlag("interrupt-timeout", infraCmd.PersistentFlags().Lookup("interrupt-timeout"))
+	infraCmd.PersistentFlags().Duration(
+		"timeout",
+		0,
+		"Default limit on each phase of a module, unless set in the config. 0 for no limit ($MICRO_TIMEOUT)",
+	)
+	viper.BindPFlag("timeout", infraCmd.PersistentFlags().Lookup("timeout"))
+	infraCmd.PersistentFlags().Bool(
+		"require-checksum",
+		false,
+		"Reject modules downloaded over http(s) without a sha256 checksum ($MICRO_REQUIRE_CHECKSUM)",
+	)
+	viper.BindPFlag("require-checksum", infraCmd.PersistentFlags().Lookup("require-checksum"))
+	infraCmd.PersistentFlags().String(
+		"git-cache",
+		infra.DefaultGitCacheDir,
+		"Directory git module sources are cloned to, shared between runs ($MICRO_GIT_CACHE)",
 	)
-	viper.BindPFlag("config-file", infraCmd.PersistentFlags().Lookup("config-file"))
+	viper.BindPFlag("git-cache", infraCmd.PersistentFlags().Lookup("git-cache"))
+	infraCmd.PersistentFlags().Duration(
+		"stale-lock-age",
+		infra.DefaultStaleLockAge,
+		"How old a state lock must be to be reported as left behind by a crashed run ($MICRO_STALE_LOCK_AGE)",
+	)
+	viper.BindPFlag("stale-lock-age", infraCmd.PersistentFlags().Lookup("stale-lock-age"))
+	infraCmd.PersistentFlags().Bool(
+		"force-unlock",
+		false,
+		"Remove stale state locks. Check nothing else is running first ($MICRO_FORCE_UNLOCK)",
+	)
+	viper.BindPFlag("force-unlock", infraCmd.PersistentFlags().Lookup("force-unlock"))
+	dir, err := homedir.Dir()
+	if err != nil {
+		dir = ""
+	}
+	infraCmd.PersistentFlags().String(
+		"journal",
+		filepath.Join(dir, ".micro", "platform", "journal.json"),
+		"File recording the outcome of each task, used by apply --resume ($MICRO_JOURNAL)",
+	)
+	viper.BindPFlag("journal", infraCmd.PersistentFlags().Lookup("journal"))
 }
 
 // viperConfig is run before every infra command, parsing config using viper
@@ -45,15 +107,28 @@ func viperConfig() {
 	viper.SetDefault("azure-state-resource-group", "micro-terraform-states")
 	viper.SetDefault("azure-storage-account", "microplatform")
 	viper.SetDefault("azure-storage-container", "tfstate")
+	// Local, GCS, Consul and Postgres defaults
+	dir, err := homedir.Dir()
+	if err != nil {
+		dir = ""
+	}
+	viper.SetDefault("local-state-dir", filepath.Join(dir, ".micro", "platform", "state"))
+	viper.SetDefault("gcs-prefix", "micro-platform")
+	viper.SetDefault("consul-path", "micro-platform")
+	viper.SetDefault("pg-schema-prefix", "micro_platform_")
 
 	// Handle env variables, e.g. --config-file flag can be set with MICRO_CONFIG_FILE
 	viper.SetEnvPrefix("micro")
 	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
 	viper.AutomaticEnv()
 
-	// Read in config file
+	// Read in config file. Without a name or search path set, viper only
+	// finds the file named by --config-file or $MICRO_CONFIG_FILE
+	if f := viper.GetString("config-file"); len(f) != 0 {
+		viper.SetConfigFile(f)
+	}
 	if err := viper.ReadInConfig(); err == nil {
-		fmt.Println("Using config file:", viper.ConfigFileUsed())
+		fmt.Fprintln(os.Stderr, "Using config file:", viper.ConfigFileUsed())
 	}
 }
 
@@ -63,38 +138,116 @@ var planCmd = &cobra.Command{
 	Short: "Validate the configuration",
 	Long: `Show what actions will be carried out to the platform
 
-Instantiates various terraform modules, then runs terraform init, terraform validate`,
+Instantiates various terraform modules, then runs terraform init, terraform validate
+and terraform plan. The resources each module would create, update and delete are
+printed as a table, or as JSON with --output json. Modules using the outputs of
+modules that haven't been applied yet, e.g. the gslb of a new platform, can't be
+planned and are listed as deferred. A module that fails to plan only stops the
+modules depending on it, every other module is still planned.
+
+Plan doesn't change any cloud resources, but each cluster's kubeconfig module is
+applied so the modules in the cluster can be planned against it, writing the
+kubeconfig and its state, and destroyed again once planning is done`,
 	Run: func(cmd *cobra.Command, args []string) {
+		output := viper.GetString("plan-output")
+		if output != "table" && output != "json" {
+			fmt.Fprintf(os.Stderr, "Unknown output format %s\n", output)
+			os.Exit(1)
+		}
+		opts := executeOptions()
+		if output == "json" {
+			// terraform's output is printed to stdout, keep it clean for the JSON report
+			opts = append(opts, infra.Observe(&infra.ConsoleObserver{Stdout: os.Stderr, Stderr: os.Stderr}))
+		}
+		ctx, cancel := signalContext()
+		defer cancel()
+		report := &infra.PlanReport{}
 		for _, p := range validate() {
 			s, err := p.Steps()
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "%s\n", err.Error())
 				os.Exit(1)
 			}
-			if err := infra.ExecutePlan(s); err != nil {
+			r, err := infra.ExecutePlan(ctx, s, opts...)
+			if r != nil {
+				report.Modules = append(report.Modules, r.Modules...)
+			}
+			if err != nil {
+				// Show what was planned before the failure
+				printPlan(report, output)
 				fmt.Fprintf(os.Stderr, "%s\n", err.Error())
 				os.Exit(1)
 			}
 		}
-		fmt.Printf("Plan Succeeded - run infra apply\n")
+		printPlan(report, output)
+		if output == "table" {
+			fmt.Printf("Plan Succeeded - run infra apply\n")
+		}
 	},
 }
 
+// printPlan prints the plan report in the output format
+func printPlan(report *infra.PlanReport, output string) {
+	if output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+	printPlanTable(report)
+}
+
+// printPlanTable prints a summary of the plan as a table
+func printPlanTable(report *infra.PlanReport) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "MODULE\tREVISION\tCREATE\tUPDATE\tDELETE")
+	for _, m := range report.Modules {
+		rev := "-"
+		if len(m.Revision) >= 12 {
+			rev = m.Revision[:12]
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\n", m.Name, rev, m.Create, m.Update, m.Delete)
+	}
+	w.Flush()
+	for _, id := range report.Deferred {
+		fmt.Printf("%s can't be planned until the modules it uses are applied\n", id)
+	}
+}
+
 // applyCmd represents the apply command
 var applyCmd = &cobra.Command{
 	Use:   "apply",
 	Short: "Apply the configuration",
 	Long: `Applies the configuration - this creates or modifies cloud resources
 
-If you cancel this command, data loss may occur`,
+With --plan-dir, the plans saved by infra plan --plan-dir are applied as they were
+reviewed. Apply refuses to run if a module's source or variables have changed since;
+secrets are compared by reference, so a secret rotated since planning isn't noticed.
+Saved plans aren't retried, as terraform refuses to apply a plan twice; plan again
+after a failure.
+
+Every module's outcome is recorded in the journal. If an apply fails, fix the problem
+and run apply --resume to skip the modules that were already applied. Alternatively,
+with --rollback-on-failure a failed apply destroys the modules it created.
+
+If you cancel this command, running terraform processes are interrupted so they can
+release their state locks and no new modules are started. Cancelling it a second
+time exits immediately, which may leave state locked`,
 	Run: func(cmd *cobra.Command, args []string) {
+		ctx, cancel := signalContext()
+		defer cancel()
+		opts := append(executeOptions(), journalOptions(viper.GetBool("resume"))...)
+		opts = append(opts, infra.Rollback(viper.GetBool("rollback-on-failure")))
 		for _, p := range validate() {
 			s, err := p.Steps()
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "%s\n", err.Error())
 				os.Exit(1)
 			}
-			if err := infra.ExecuteApply(s); err != nil {
+			if err := infra.ExecuteApply(ctx, s, opts...); err != nil {
 				fmt.Fprintf(os.Stderr, "%s\n", err.Error())
 				os.Exit(1)
 			}
@@ -109,15 +262,28 @@ var destroyCmd = &cobra.Command{
 	Short: "Destroy the configuration",
 	Long: `Destroys the configuration - this destroys or modifies cloud resources
 
-If you cancel this command, data loss may occur`,
+Modules are destroyed in reverse dependency order, so nothing is destroyed while
+other modules still depend on it. Each cluster's kubeconfig is written first so the
+modules in it can be destroyed, and removed at the end. Every module that's destroyed
+is removed from the journal, so a later apply --resume applies it again. A module
+that fails to destroy only stops the modules it depends on from being destroyed. If
+destroy fails, fix the problem and run it again; modules that were already destroyed
+have no state and are skipped, and the outputs they had are treated as unknown.
+
+If you cancel this command, running terraform processes are interrupted so they can
+release their state locks and no new modules are started. Cancelling it a second
+time exits immediately, which may leave state locked`,
 	Run: func(cmd *cobra.Command, args []string) {
+		ctx, cancel := signalContext()
+		defer cancel()
+		opts := append(executeOptions(), journalOptions(false)...)
 		for _, p := range validate() {
 			s, err := p.Steps()
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "%s\n", err.Error())
 				os.Exit(1)
 			}
-			if err := infra.ExecuteDestroy(s); err != nil {
+			if err := infra.ExecuteDestroy(ctx, s, opts...); err != nil {
 				fmt.Fprintf(os.Stderr, "%s\n", err.Error())
 				os.Exit(1)
 			}
@@ -126,7 +292,46 @@ If you cancel this command, data loss may occur`,
 	},
 }
 
+// executeOptions returns the executor options set by flags and config
+func executeOptions() []infra.Option {
+	return []infra.Option{
+		infra.Concurrency(viper.GetInt("concurrency")),
+		infra.PlanDir(viper.GetString("plan-dir")),
+		infra.PlanKey(viper.GetString("plan-key")),
+		infra.InterruptTimeout(viper.GetDuration("interrupt-timeout")),
+		infra.Timeout(viper.GetDuration("timeout")),
+		infra.RequireChecksum(viper.GetBool("require-checksum")),
+		infra.GitCacheDir(viper.GetString("git-cache")),
+		infra.StaleLockAge(viper.GetDuration("stale-lock-age")),
+		infra.ForceUnlock(viper.GetBool("force-unlock")),
+	}
+}
+
+// journalOptions returns the options to record task outcomes in the journal
+func journalOptions(resume bool) []infra.Option {
+	j, err := infra.OpenJournal(viper.GetString("journal"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(1)
+	}
+	return []infra.Option{
+		infra.WithJournal(j),
+		infra.Resume(resume),
+	}
+}
+
 func validate() []infra.Platform {
+	if f := viper.ConfigFileUsed(); len(f) != 0 {
+		if err := infra.ValidateConfigFile(f); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid config file:\n%s\n", err.Error())
+			os.Exit(1)
+		}
+		// Config files from before the schema was versioned are version 1
+		if !viper.IsSet("version") {
+			fmt.Fprintf(os.Stderr, "version isn't set in %s, assuming %d. Set version: %d, files without it are deprecated\n", f, infra.ConfigVersion, infra.ConfigVersion)
+			viper.Set("version", infra.ConfigVersion)
+		}
+	}
 	if viper.Get("platforms") == nil || len(viper.Get("platforms").([]interface{})) == 0 {
 		fmt.Fprintf(os.Stderr, "No platforms defined in config file %s\n", viper.Get("config-file"))
 		os.Exit(1)
@@ -140,8 +345,31 @@ func validate() []infra.Platform {
 	return platforms
 }
 
+// schemaCmd prints the config file's JSON Schema
+var schemaCmd = &cobra.Command{
+	Use:   "schema",
+	Short: "Print the config file's JSON Schema",
+	Long: `Prints the JSON Schema of the config file, for editors to complete and
+check config files. plan, apply and destroy check the config file against it`,
+	Run: func(cmd *cobra.Command, args []string) {
+		b, err := infra.ConfigSchemaJSON()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			os.Exit(1)
+		}
+		os.Stdout.Write(b)
+	},
+}
+
 func init() {
+	planCmd.Flags().StringP("output", "o", "table", "Plan output format (table, json)")
+	viper.BindPFlag("plan-output", planCmd.Flags().Lookup("output"))
 	infraCmd.AddCommand(planCmd)
+	applyCmd.Flags().Bool("resume", false, "Skip modules already applied with the same configuration by a previous apply")
+	viper.BindPFlag("resume", applyCmd.Flags().Lookup("resume"))
+	applyCmd.Flags().Bool("rollback-on-failure", false, "If apply fails, destroy the modules it created, leaving modules that already existed")
+	viper.BindPFlag("rollback-on-failure", applyCmd.Flags().Lookup("rollback-on-failure"))
 	infraCmd.AddCommand(applyCmd)
 	infraCmd.AddCommand(destroyCmd)
+	infraCmd.AddCommand(schemaCmd)
 }
@@ -23,12 +23,14 @@ var (
 		Short: "Create a Kubernetes cluster",
 		Long:  "Create a Kubernetes cluster",
 		Run: func(cmd *cobra.Command, args []string) {
+			ctx, cancel := signalContext()
+			defer cancel()
 			k, err := makeKube()
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "%+v\n", err)
 				os.Exit(1)
 			}
-			err = infra.ExecuteApply(k)
+			err = infra.ExecuteApply(ctx, k)
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "%+v\n", err)
 				os.Exit(1)
@@ -41,12 +43,14 @@ var (
 		Short: "Destroy a Kubernetes cluster",
 		Long:  "Destroy a Kubernetes cluster",
 		Run: func(cmd *cobra.Command, args []string) {
+			ctx, cancel := signalContext()
+			defer cancel()
 			k, err := makeKube()
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "%+v\n", err)
 				os.Exit(1)
 			}
-			err = infra.ExecuteDestroy(k)
+			err = infra.ExecuteDestroy(ctx, k)
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "%+v\n", err)
 				os.Exit(1)
@@ -59,12 +63,14 @@ var (
 		Short: "Get Kube config for a created cluster",
 		Long:  "Get Kube config for a created cluster",
 		Run: func(cmd *cobra.Command, args []string) {
+			ctx, cancel := signalContext()
+			defer cancel()
 			c, err := makeKubeConfig(viper.GetString("kube-config-path"))
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "%+v\n", err)
 				os.Exit(1)
 			}
-			err = infra.ExecuteApply(c)
+			err = infra.ExecuteApply(ctx, c)
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "%+v\n", err)
 				os.Exit(1)
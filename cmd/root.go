@@ -32,6 +32,13 @@ func Execute() {
 func init() {
 	rootCmd.PersistentFlags().StringP("cloud-provider", "p", "azure", "Cloud provider (azure, do, local)")
 	viper.BindPFlag("cloud-provider", rootCmd.PersistentFlags().Lookup("cloud-provider"))
+	rootCmd.PersistentFlags().StringP(
+		"config-file",
+		"c",
+		"",
+		"Path to infrastructure definition file ($MICRO_CONFIG_FILE)",
+	)
+	viper.BindPFlag("config-file", rootCmd.PersistentFlags().Lookup("config-file"))
 	dir, err := homedir.Dir()
 	if err != nil {
 		dir = ""
@@ -0,0 +1,39 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/micro/platform/infra"
+)
+
+// signalContext returns a context that is cancelled on the first SIGINT or
+// SIGTERM, so running tasks can finish gracefully. A second signal kills the
+// running terraform processes and exits immediately.
+func signalContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case s := <-sigs:
+			fmt.Fprintf(os.Stderr, "Received %s, waiting for running tasks to exit. Send it again to exit immediately, this may leave state locked\n", s)
+			cancel()
+		case <-ctx.Done():
+			return
+		}
+		s := <-sigs
+		fmt.Fprintf(os.Stderr, "Received %s again, killing terraform and exiting\n", s)
+		// terraform runs in its own process group, so it didn't get the signal
+		// and would otherwise carry on without us
+		infra.KillProcesses()
+		os.Exit(1)
+	}()
+	return ctx, func() {
+		signal.Stop(sigs)
+		cancel()
+	}
+}
@@ -0,0 +1,215 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/micro/platform/infra"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// stateCmd represents the state command
+var stateCmd = &cobra.Command{
+	Use:   "state",
+	Short: "Inspect and migrate the platform's terraform state",
+	Long: `Inspect the terraform state of every module, as stored in the configured
+state store (state-store config, $MICRO_STATE_STORE), or migrate it to another store`,
+}
+
+// stateListCmd represents the state list command
+var stateListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the states in the state store",
+	Long: `Lists every state in the state store, grouped by the platform, region, provider
+and module it belongs to. States that don't belong to a platform in the config file
+are listed last`,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, cancel := signalContext()
+		defer cancel()
+		store, err := infra.ConfiguredStateStore()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			os.Exit(1)
+		}
+		states, err := store.States(ctx)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			os.Exit(1)
+		}
+		type row struct {
+			infra.StateKey
+			infra.StateObject
+		}
+		var known, unknown []row
+		names := platformNames()
+		for _, s := range states {
+			k, ok := infra.ParseStateKey(s.Key, names)
+			if ok {
+				known = append(known, row{k, s})
+			} else {
+				unknown = append(unknown, row{k, s})
+			}
+		}
+		sort.Slice(known, func(i, j int) bool {
+			a, b := known[i], known[j]
+			if a.Platform != b.Platform {
+				return a.Platform < b.Platform
+			}
+			if a.Region != b.Region {
+				return a.Region < b.Region
+			}
+			if a.Provider != b.Provider {
+				return a.Provider < b.Provider
+			}
+			return a.Module < b.Module
+		})
+		sort.Slice(unknown, func(i, j int) bool { return unknown[i].StateKey.Key < unknown[j].StateKey.Key })
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "PLATFORM\tREGION\tPROVIDER\tMODULE\tKEY\tMODIFIED")
+		for _, r := range append(known, unknown...) {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+				orDash(r.Platform), orDash(r.Region), orDash(r.Provider), orDash(r.Module),
+				r.StateKey.Key, r.Modified.Local().Format(time.RFC3339))
+		}
+		w.Flush()
+	},
+}
+
+// stateShowCmd represents the state show command
+var stateShowCmd = &cobra.Command{
+	Use:   "show <id>",
+	Short: "Show the resources in a state",
+	Long: `Shows the resources in a module's state, and when the state was last modified.
+The id is the module's ID, as listed by state list`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, cancel := signalContext()
+		defer cancel()
+		store, err := infra.ConfiguredStateStore()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			os.Exit(1)
+		}
+		obj, data, err := store.ReadState(ctx, args[0])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			os.Exit(1)
+		}
+		state, err := infra.ParseState(data)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			os.Exit(1)
+		}
+		fmt.Printf("State:     %s\n", obj.Key)
+		fmt.Printf("Modified:  %s\n", obj.Modified.Local().Format(time.RFC3339))
+		fmt.Printf("Terraform: %s\n", state.TerraformVersion)
+		fmt.Printf("Serial:    %d\n", state.Serial)
+		fmt.Printf("Lineage:   %s\n\n", state.Lineage)
+		if len(state.Resources) == 0 {
+			fmt.Println("No resources")
+			return
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "RESOURCE\tINSTANCES")
+		for _, r := range state.Resources {
+			fmt.Fprintf(w, "%s\t%d\n", r.Address(), len(r.Instances))
+		}
+		w.Flush()
+	},
+}
+
+// stateMigrateCmd represents the state migrate command
+var stateMigrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Move the platform's state to another state store",
+	Long: `Copies the state of every module of the platforms in the config file from one
+state store to another, e.g. --from azure --to aws. Stores are configured the same
+way as state-store.
+
+Each state is locked in both stores while it's copied, and the copy is read back
+to check its serial and lineage. A state that already exists in the destination is
+only replaced by a newer state with the same lineage. With --delete-source, each
+state is deleted from the source once it has been copied.
+
+Once the migration has succeeded, set state-store to the new store`,
+	Run: func(cmd *cobra.Command, args []string) {
+		fromName, toName := viper.GetString("migrate-from"), viper.GetString("migrate-to")
+		if len(fromName) == 0 || len(toName) == 0 {
+			fmt.Fprintln(os.Stderr, "Both --from and --to must be set")
+			os.Exit(1)
+		}
+		from, err := infra.NewStateBackend(fromName)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			os.Exit(1)
+		}
+		to, err := infra.NewStateBackend(toName)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			os.Exit(1)
+		}
+		var keys []string
+		for _, p := range validate() {
+			s, err := p.Steps()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+				os.Exit(1)
+			}
+			keys = append(keys, infra.StateKeys(s)...)
+		}
+
+		ctx, cancel := signalContext()
+		defer cancel()
+		results, err := infra.MigrateState(ctx, from, to, keys, viper.GetBool("delete-source"))
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "KEY\tSTATUS\tSERIAL\tLINEAGE\tSOURCE DELETED")
+		for _, r := range results {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%t\n", r.Key, r.Status, r.Serial, orDash(r.Lineage), r.Deleted)
+		}
+		w.Flush()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			os.Exit(1)
+		}
+		fmt.Printf("Migrated %d states from %s to %s\n", len(results), fromName, toName)
+	},
+}
+
+// platformNames returns the names of the platforms in the config file, if any
+func platformNames() []string {
+	var platforms []infra.Platform
+	if err := viper.UnmarshalKey("platforms", &platforms); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(1)
+	}
+	names := make([]string, len(platforms))
+	for i, p := range platforms {
+		names[i] = p.Name
+	}
+	return names
+}
+
+func orDash(s string) string {
+	if len(s) == 0 {
+		return "-"
+	}
+	return s
+}
+
+func init() {
+	rootCmd.AddCommand(stateCmd)
+	stateCmd.AddCommand(stateListCmd)
+	stateCmd.AddCommand(stateShowCmd)
+	stateMigrateCmd.Flags().String("from", "", "State store to migrate from (aws, azure, local)")
+	viper.BindPFlag("migrate-from", stateMigrateCmd.Flags().Lookup("from"))
+	stateMigrateCmd.Flags().String("to", "", "State store to migrate to (aws, azure, local)")
+	viper.BindPFlag("migrate-to", stateMigrateCmd.Flags().Lookup("to"))
+	stateMigrateCmd.Flags().Bool("delete-source", false, "Delete each state from the source once it has been copied")
+	viper.BindPFlag("delete-source", stateMigrateCmd.Flags().Lookup("delete-source"))
+	stateCmd.AddCommand(stateMigrateCmd)
+}
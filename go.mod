@@ -1,6 +1,6 @@
 module github.com/micro/platform
 
-go 1.13
+go 1.16
 
 require (
 	github.com/aws/aws-sdk-go v1.23.0
@@ -15,4 +15,5 @@ require (
 	golang.org/x/sys v0.0.0-20200124204421-9fbb57f87de9 // indirect
 	gopkg.in/check.v1 v1.0.0-20190902080502-41f04d3bba15 // indirect
 	gopkg.in/yaml.v2 v2.2.8 // indirect
+	gopkg.in/yaml.v3 v3.0.1
 )
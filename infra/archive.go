@@ -0,0 +1,291 @@
+package infra
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Archive formats
+const (
+	archiveTarGz = "tar.gz"
+	archiveZip   = "zip"
+)
+
+// archiveSource is an http or https module source, e.g.
+// https://example.com/modules.tar.gz//network?sha256=...
+type archiveSource struct {
+	// URL the archive is downloaded from
+	URL *url.URL
+	// Subdir of the archive that holds the module, empty for the whole archive
+	Subdir string
+	// Checksum is the expected hex encoded SHA-256 of the archive, if given
+	Checksum string
+	// Format of the archive, tar.gz or zip
+	Format string
+}
+
+// parseArchiveSource splits the subdirectory and the sha256 and archive query
+// parameters out of a source URL. Any other query parameters are kept, as
+// they may be needed to download the archive, e.g. for a signed URL.
+func parseArchiveSource(u *url.URL) (*archiveSource, error) {
+	src := &archiveSource{}
+	download, subdir := splitSubdir(u)
+	src.Subdir = subdir
+	q := download.Query()
+	src.Checksum = strings.ToLower(q.Get("sha256"))
+	src.Format = q.Get("archive")
+	q.Del("sha256")
+	q.Del("archive")
+	download.RawQuery = q.Encode()
+	src.URL = download
+
+	if len(src.Checksum) != 0 {
+		if b, err := hex.DecodeString(src.Checksum); err != nil || len(b) != sha256.Size {
+			return nil, errors.New("sha256 checksum in " + u.String() + " isn't a hex encoded SHA-256")
+		}
+	}
+	if len(src.Format) == 0 {
+		switch p := strings.ToLower(download.Path); {
+		case strings.HasSuffix(p, ".tar.gz"), strings.HasSuffix(p, ".tgz"):
+			src.Format = archiveTarGz
+		case strings.HasSuffix(p, ".zip"):
+			src.Format = archiveZip
+		}
+	}
+	switch src.Format {
+	case archiveTarGz, archiveZip:
+	case "":
+		return nil, errors.New("Can't tell the archive format of " + u.String() + ", set archive=tar.gz or archive=zip")
+	default:
+		return nil, errors.New("Archive format " + src.Format + " not supported")
+	}
+	return src, nil
+}
+
+// splitSubdir splits the //subdir selecting part of a repository or archive
+// from the path of a source URL
+func splitSubdir(u *url.URL) (*url.URL, string) {
+	src := *u
+	i := strings.Index(src.Path, "//")
+	if i == -1 {
+		return &src, ""
+	}
+	subdir := strings.Trim(src.Path[i+2:], "/")
+	src.Path = src.Path[:i]
+	src.RawPath = ""
+	return &src, subdir
+}
+
+// fetchArchive downloads the module archive from u, verifies its checksum and
+// extracts it in to the module path
+func (t *TerraformModule) fetchArchive(ctx context.Context, u *url.URL) error {
+	src, err := parseArchiveSource(u)
+	if err != nil {
+		return err
+	}
+	if len(src.Checksum) == 0 {
+		if t.RequireChecksum {
+			return errors.New("Module " + t.Name + " source has no sha256 checksum, add ?sha256=<checksum> to the URL")
+		}
+		logf(ctx, t, "No sha256 checksum in source, the archive won't be verified")
+	}
+
+	f, err := ioutil.TempFile("", "micro-platform-archive-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	logf(ctx, t, "Downloading %s://%s%s", src.URL.Scheme, src.URL.Host, src.URL.Path)
+	sum, err := download(ctx, src.URL, f)
+	if err != nil {
+		return errors.Wrap(err, "Couldn't download module")
+	}
+	if len(src.Checksum) != 0 && sum != src.Checksum {
+		return errors.Errorf("Module %s checksum mismatch: expected %s, got %s", t.Name, src.Checksum, sum)
+	}
+
+	var extracted int
+	switch src.Format {
+	case archiveTarGz:
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		extracted, err = extractTarGz(f, src.Subdir, t.Path)
+	case archiveZip:
+		var fi os.FileInfo
+		if fi, err = f.Stat(); err != nil {
+			return err
+		}
+		extracted, err = extractZip(f, fi.Size(), src.Subdir, t.Path)
+	}
+	if err != nil {
+		return errors.Wrap(err, "Couldn't extract module")
+	}
+	if extracted == 0 {
+		if len(src.Subdir) != 0 {
+			return errors.New("Module " + t.Name + " archive has no files in " + src.Subdir)
+		}
+		return errors.New("Module " + t.Name + " archive is empty")
+	}
+	return nil
+}
+
+// download writes the body of u to w, returning its hex encoded SHA-256
+func download(ctx context.Context, u *url.URL, w io.Writer) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("GET %s://%s%s: %s", u.Scheme, u.Host, u.Path, rsp.Status)
+	}
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(w, h), rsp.Body); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// extractTarGz extracts the files under subdir in the archive to dir,
+// returning the number of files extracted
+func extractTarGz(r io.Reader, subdir, dir string) (int, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return 0, err
+	}
+	defer gz.Close()
+	return extractTar(gz, subdir, dir)
+}
+
+// extractTar extracts the files under subdir in an uncompressed tar archive
+// to dir, returning the number of files extracted
+func extractTar(r io.Reader, subdir, dir string) (int, error) {
+	tr := tar.NewReader(r)
+	var n int
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		dest, ok, err := archivePath(hdr.Name, subdir, dir)
+		if err != nil {
+			return n, err
+		}
+		if !ok {
+			continue
+		}
+		fi := hdr.FileInfo()
+		switch {
+		case fi.IsDir():
+			if err := os.MkdirAll(dest, 0o755); err != nil {
+				return n, err
+			}
+		case fi.Mode().IsRegular():
+			if err := writeFile(dest, tr, fi.Mode()); err != nil {
+				return n, err
+			}
+			n++
+		}
+	}
+}
+
+// extractZip extracts the files under subdir in the archive to dir,
+// returning the number of files extracted
+func extractZip(r io.ReaderAt, size int64, subdir, dir string) (int, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	for _, f := range zr.File {
+		dest, ok, err := archivePath(f.Name, subdir, dir)
+		if err != nil {
+			return n, err
+		}
+		if !ok {
+			continue
+		}
+		if f.FileInfo().IsDir() {
+			if err := os.MkdirAll(dest, 0o755); err != nil {
+				return n, err
+			}
+			continue
+		}
+		if !f.Mode().IsRegular() {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return n, err
+		}
+		err = writeFile(dest, rc, f.Mode())
+		rc.Close()
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// archivePath returns where a file in an archive is extracted to, and false
+// if it isn't under subdir. Files that would escape dir are an error.
+func archivePath(name, subdir, dir string) (string, bool, error) {
+	name = strings.Replace(name, "\\", "/", -1)
+	for _, e := range strings.Split(name, "/") {
+		if e == ".." {
+			return "", false, errors.Errorf("archive contains an invalid path %q", name)
+		}
+	}
+	rel := strings.Trim(path.Clean("/"+name), "/")
+	if len(subdir) != 0 {
+		if rel == subdir {
+			return dir, true, nil
+		}
+		if !strings.HasPrefix(rel, subdir+"/") {
+			return "", false, nil
+		}
+		rel = strings.TrimPrefix(rel, subdir+"/")
+	}
+	return filepath.Join(dir, filepath.FromSlash(rel)), true, nil
+}
+
+// writeFile writes r to the file at p, creating any parent directories
+func writeFile(p string, r io.Reader, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(p, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode.Perm()|0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,148 @@
+package infra
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var testArchiveFiles = map[string]string{
+	"modules/network/main.tf":      "# network",
+	"modules/network/vars/vars.tf": "# vars",
+	"modules/control/main.tf":      "# control",
+	"README.md":                    "# modules",
+}
+
+func testTarGz(t *testing.T) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for name, body := range testArchiveFiles {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(body)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func testZip(t *testing.T) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, body := range testArchiveFiles {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestFetchArchive(t *testing.T) {
+	tgz, zipped := testTarGz(t), testZip(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/modules.tar.gz":
+			w.Write(tgz)
+		case "/modules.zip", "/download":
+			w.Write(zipped)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name     string
+		source   string
+		require  bool
+		expected []string
+		err      string
+	}{
+		{name: "tar.gz", source: "/modules.tar.gz", expected: []string{"modules/network/main.tf", "modules/control/main.tf", "README.md"}},
+		{name: "zip", source: "/modules.zip", expected: []string{"modules/network/main.tf", "README.md"}},
+		{name: "subdir", source: "/modules.tar.gz//modules/network", expected: []string{"main.tf", "vars/vars.tf"}},
+		{name: "zip subdir", source: "/modules.zip//modules/control/", expected: []string{"main.tf"}},
+		{name: "checksum", source: "/modules.tar.gz//modules/network?sha256=" + sha256Hex(tgz), require: true, expected: []string{"main.tf"}},
+		{name: "archive param", source: "/download?archive=zip&sha256=" + sha256Hex(zipped), expected: []string{"README.md"}},
+		{name: "checksum mismatch", source: "/modules.zip?sha256=" + sha256Hex(tgz), err: "checksum mismatch"},
+		{name: "checksum required", source: "/modules.zip", require: true, err: "no sha256 checksum"},
+		{name: "bad checksum", source: "/modules.zip?sha256=abc", err: "isn't a hex encoded SHA-256"},
+		{name: "missing subdir", source: "/modules.zip//modules/kv", err: "no files in modules/kv"},
+		{name: "not found", source: "/missing.zip", err: "404"},
+		{name: "unknown format", source: "/download", err: "Can't tell the archive format"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "micro-platform-archive-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			u, err := url.Parse(srv.URL + tt.source)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m := &TerraformModule{Name: "test", Path: dir, RequireChecksum: tt.require}
+			err = m.fetchArchive(withObserver(context.Background(), &recordingObserver{}), u)
+			if len(tt.err) != 0 {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("Expected error containing %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, f := range tt.expected {
+				if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(f))); err != nil {
+					t.Errorf("Expected %s to be extracted: %v", f, err)
+				}
+			}
+		})
+	}
+}
+
+func TestArchivePath(t *testing.T) {
+	if _, _, err := archivePath("../../etc/passwd", "", "/tmp/module"); err == nil {
+		t.Error("Expected an error for a path outside the module")
+	}
+	if _, ok, _ := archivePath("modules/networking/main.tf", "modules/network", "/tmp/module"); ok {
+		t.Error("Expected a sibling directory with a common prefix to be skipped")
+	}
+	p, ok, err := archivePath("./modules/network/main.tf", "modules/network", "/tmp/module")
+	if err != nil || !ok || p != filepath.Join("/tmp/module", "main.tf") {
+		t.Errorf("Unexpected path %s %v %v", p, ok, err)
+	}
+}
@@ -0,0 +1,241 @@
+package infra
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// planArtifactVersion is the version of the plan artifact format
+const planArtifactVersion = 1
+
+// planArtifact describes a saved terraform plan for a module
+type planArtifact struct {
+	// Version of the artifact format
+	Version int `json:"version"`
+	// ID of the module that was planned
+	ID string `json:"id"`
+	// Fingerprint of the module source and variables when it was planned
+	Fingerprint string `json:"fingerprint"`
+	// Created is when the plan was made
+	Created time.Time `json:"created"`
+	// Encrypted is set when the plan holds secret variables, and is
+	// encrypted with the plan key
+	Encrypted bool `json:"encrypted,omitempty"`
+}
+
+// generatedFiles are written in to the module path by TerraformModule,
+// rather than coming from the module source
+var generatedFiles = map[string]bool{
+	"backend-config-micro-platform.tf":            true,
+	"remote-state-data-sources-micro-platform.tf": true,
+	tfPlanFile:            true,
+	tfVarsFile:            true,
+	".terraform.lock.hcl": true,
+}
+
+// fingerprint hashes the module source, variables and remote states. Paths
+// and environment variables differ between runs, so they aren't included.
+// Secrets are hashed as their references, not their values, so a secret that
+// is rotated after planning isn't detected; the saved plan still applies the old value.
+func (t *TerraformModule) fingerprint() (string, error) {
+	h := sha256.New()
+	var files []string
+	if err := filepath.Walk(t.Path, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() && fi.Name() == ".terraform" {
+			return filepath.SkipDir
+		}
+		if fi.Mode().IsRegular() && !generatedFiles[fi.Name()] && !strings.Contains(fi.Name(), "tfstate") {
+			files = append(files, path)
+		}
+		return nil
+	}); err != nil {
+		return "", err
+	}
+	sort.Strings(files)
+	for _, path := range files {
+		rel, err := filepath.Rel(t.Path, path)
+		if err != nil {
+			return "", err
+		}
+		io.WriteString(h, rel+"\n")
+		f, err := os.Open(path)
+		if err != nil {
+			return "", err
+		}
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+	// encoding/json sorts map keys, so this is stable
+	if err := json.NewEncoder(h).Encode(struct {
+		Variables    map[string]interface{}
+		RemoteStates map[string]string
+	}{t.Variables, t.RemoteStates}); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (t *TerraformModule) artifactPath(ext string) string {
+	return filepath.Join(t.PlanDir, t.ID+ext)
+}
+
+// savePlan copies the last plan in to PlanDir alongside a description of it.
+// terraform writes every variable in to the plan, so the plans of modules
+// with secret variables are encrypted with PlanKey.
+func (t *TerraformModule) savePlan() error {
+	encrypt := t.hasSecrets()
+	if encrypt && len(t.PlanKey) == 0 {
+		return errors.Errorf("Module %s has secret variables, set a plan key to encrypt its saved plan", t.Name)
+	}
+	if err := os.MkdirAll(t.PlanDir, 0o700); err != nil {
+		return err
+	}
+	fp, err := t.fingerprint()
+	if err != nil {
+		return errors.Wrap(err, "Couldn't fingerprint module")
+	}
+	plan, err := ioutil.ReadFile(filepath.Join(t.Path, tfPlanFile))
+	if err != nil {
+		return errors.Wrap(err, "Couldn't save plan")
+	}
+	if encrypt {
+		if plan, err = sealPlan(t.PlanKey, plan); err != nil {
+			return errors.Wrap(err, "Couldn't encrypt plan")
+		}
+	}
+	if err := ioutil.WriteFile(t.artifactPath(".tfplan"), plan, 0o600); err != nil {
+		return errors.Wrap(err, "Couldn't save plan")
+	}
+	b, err := json.MarshalIndent(planArtifact{
+		Version:     planArtifactVersion,
+		ID:          t.ID,
+		Fingerprint: fp,
+		Created:     time.Now(),
+		Encrypted:   encrypt,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(t.artifactPath(".json"), b, 0o600)
+}
+
+// loadPlan copies a saved plan from PlanDir in to the module path, as long as
+// the module hasn't changed since it was planned
+func (t *TerraformModule) loadPlan() error {
+	b, err := ioutil.ReadFile(t.artifactPath(".json"))
+	if err != nil {
+		return errors.Wrapf(err, "No saved plan for %s", t.Name)
+	}
+	var a planArtifact
+	if err := json.Unmarshal(b, &a); err != nil {
+		return errors.Wrapf(err, "Invalid saved plan for %s", t.Name)
+	}
+	if a.Version != planArtifactVersion {
+		return errors.Errorf("Saved plan for %s has version %d, expected %d. Run infra plan again", t.Name, a.Version, planArtifactVersion)
+	}
+	if a.ID != t.ID {
+		return errors.Errorf("Saved plan for %s is for module %s", t.Name, a.ID)
+	}
+	fp, err := t.fingerprint()
+	if err != nil {
+		return errors.Wrap(err, "Couldn't fingerprint module")
+	}
+	if fp != a.Fingerprint {
+		return errors.Errorf("The source or variables of %s changed since it was planned at %s. Run infra plan again", t.Name, a.Created.Format(time.RFC3339))
+	}
+	if !a.Encrypted {
+		return copyFile(t.artifactPath(".tfplan"), filepath.Join(t.Path, tfPlanFile), 0o600)
+	}
+	if len(t.PlanKey) == 0 {
+		return errors.Errorf("Saved plan for %s is encrypted, set the plan key it was saved with", t.Name)
+	}
+	plan, err := ioutil.ReadFile(t.artifactPath(".tfplan"))
+	if err != nil {
+		return err
+	}
+	if plan, err = openPlan(t.PlanKey, plan); err != nil {
+		return errors.Wrapf(err, "Couldn't decrypt the saved plan for %s, check the plan key", t.Name)
+	}
+	return ioutil.WriteFile(filepath.Join(t.Path, tfPlanFile), plan, 0o600)
+}
+
+// hasSecrets returns true if any of the module's variables reference a secret
+func (t *TerraformModule) hasSecrets() bool {
+	for _, v := range t.Variables {
+		if hasSecretRefs(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// planCipher returns AES-256-GCM keyed with the sha256 of the plan key
+func planCipher(key string) (cipher.AEAD, error) {
+	k := sha256.Sum256([]byte(key))
+	block, err := aes.NewCipher(k[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealPlan encrypts a plan, prefixing it with a random nonce
+func sealPlan(key string, plan []byte) ([]byte, error) {
+	gcm, err := planCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plan, nil), nil
+}
+
+// openPlan decrypts a plan encrypted by sealPlan
+func openPlan(key string, sealed []byte) ([]byte, error) {
+	gcm, err := planCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("the plan is truncated")
+	}
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+}
+
+func copyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,106 @@
+package infra
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPlanArtifact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "micro-platform-artifact")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	m := &TerraformModule{
+		ID:        "test-module",
+		Name:      "test",
+		Path:      filepath.Join(dir, "module"),
+		PlanDir:   filepath.Join(dir, "plans"),
+		Variables: map[string]interface{}{"replicas": 1},
+	}
+	if err := os.MkdirAll(m.Path, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{
+		"main.tf":                          `variable "replicas" {}`,
+		tfPlanFile:                         "plan",
+		"backend-config-micro-platform.tf": "generated",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(m.Path, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.savePlan(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Generated files don't change the fingerprint
+	if err := ioutil.WriteFile(filepath.Join(m.Path, "backend-config-micro-platform.tf"), []byte("changed"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.loadPlan(); err != nil {
+		t.Errorf("Expected the saved plan to load, got %v", err)
+	}
+
+	m.Variables["replicas"] = 3
+	if err := m.loadPlan(); err == nil || !strings.Contains(err.Error(), "changed since it was planned") {
+		t.Errorf("Expected changed variables to be refused, got %v", err)
+	}
+	m.Variables["replicas"] = 1
+	if err := ioutil.WriteFile(filepath.Join(m.Path, "main.tf"), []byte(`variable "replicas" { default = 1 }`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.loadPlan(); err == nil || !strings.Contains(err.Error(), "changed since it was planned") {
+		t.Errorf("Expected changed source to be refused, got %v", err)
+	}
+}
+
+func TestPlanArtifactSecrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "micro-platform-artifact")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	m := &TerraformModule{
+		ID:        "test-module",
+		Name:      "test",
+		Path:      filepath.Join(dir, "module"),
+		PlanDir:   filepath.Join(dir, "plans"),
+		Variables: map[string]interface{}{"api_token": "${env:MICRO_PLATFORM_TEST_SECRET}"},
+	}
+	if err := os.MkdirAll(m.Path, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(m.Path, tfPlanFile), []byte("s3cr3t-t0k3n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.savePlan(); err == nil || !strings.Contains(err.Error(), "set a plan key") {
+		t.Fatalf("Expected a plan with secrets to need a key, got %v", err)
+	}
+	m.PlanKey = "passphrase"
+	if err := m.savePlan(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(m.artifactPath(".tfplan"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "s3cr3t") {
+		t.Error("Expected the saved plan to be encrypted")
+	}
+
+	m.PlanKey = "wrong"
+	if err := m.loadPlan(); err == nil || !strings.Contains(err.Error(), "check the plan key") {
+		t.Errorf("Expected the wrong key to be refused, got %v", err)
+	}
+	m.PlanKey = "passphrase"
+	if err := m.loadPlan(); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(m.Path, tfPlanFile)); string(b) != "s3cr3t-t0k3n" {
+		t.Errorf("Expected the plan to be decrypted, got %q", b)
+	}
+}
@@ -0,0 +1,276 @@
+package infra
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// azureStorageVersion is the version of the blob service REST API used
+const azureStorageVersion = "2019-12-12"
+
+// azureBlobClient is a minimal client for the Azure blob service, enough to
+// check the state container works. It authenticates with a storage account
+// key or a SAS token, the same credentials terraform's azurerm backend uses.
+type azureBlobClient struct {
+	// Endpoint of the blob service, e.g. https://account.blob.core.windows.net
+	// or http://127.0.0.1:10000/devstoreaccount1 for Azurite
+	Endpoint string
+	Account  string
+	// Key is the storage account key, base64 encoded
+	Key string
+	// SASToken is used instead of Key if set
+	SASToken string
+	Client   *http.Client
+}
+
+// newAzureBlobClient returns a client for the backend's storage account, with
+// credentials from ARM_ACCESS_KEY or ARM_SAS_TOKEN
+func newAzureBlobClient(b *AzureRMBackend) *azureBlobClient {
+	endpoint := b.Endpoint
+	if len(endpoint) == 0 {
+		endpoint = fmt.Sprintf("https://%s.blob.core.windows.net", b.StorageAccount)
+	}
+	return &azureBlobClient{
+		Endpoint: strings.TrimRight(endpoint, "/"),
+		Account:  b.StorageAccount,
+		Key:      os.Getenv("ARM_ACCESS_KEY"),
+		SASToken: strings.TrimPrefix(os.Getenv("ARM_SAS_TOKEN"), "?"),
+		Client:   http.DefaultClient,
+	}
+}
+
+// hasCredentials returns true if the client can authenticate
+func (c *azureBlobClient) hasCredentials() bool {
+	return len(c.Key) != 0 || len(c.SASToken) != 0
+}
+
+// Put uploads a block blob. lease is the ID of the lease held on the blob, if any
+func (c *azureBlobClient) Put(ctx context.Context, container, blob, lease string, body []byte) error {
+	headers := leaseHeader(lease)
+	headers["x-ms-blob-type"] = "BlockBlob"
+	_, err := c.do(ctx, http.MethodPut, container, blob, nil, headers, body, http.StatusCreated)
+	return err
+}
+
+// Get downloads a blob, returning its contents and when it was last modified
+func (c *azureBlobClient) Get(ctx context.Context, container, blob string) ([]byte, time.Time, error) {
+	rsp, err := c.do(ctx, http.MethodGet, container, blob, nil, nil, nil, http.StatusOK)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer rsp.Body.Close()
+	body, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	modified, _ := http.ParseTime(rsp.Header.Get("Last-Modified"))
+	return body, modified, nil
+}
+
+// azureBlobList is a page of the list blobs response
+type azureBlobList struct {
+	Blobs []struct {
+		Name       string `xml:"Name"`
+		Properties struct {
+			LastModified  string `xml:"Last-Modified"`
+			ContentLength int64  `xml:"Content-Length"`
+		} `xml:"Properties"`
+	} `xml:"Blobs>Blob"`
+	NextMarker string `xml:"NextMarker"`
+}
+
+// List lists the blobs in a container
+func (c *azureBlobClient) List(ctx context.Context, container string) ([]StateObject, error) {
+	var objects []StateObject
+	query := url.Values{"restype": {"container"}, "comp": {"list"}}
+	for {
+		rsp, err := c.do(ctx, http.MethodGet, container, "", query, nil, nil, http.StatusOK)
+		if err != nil {
+			return nil, err
+		}
+		var page azureBlobList
+		err = xml.NewDecoder(rsp.Body).Decode(&page)
+		rsp.Body.Close()
+		if err != nil {
+			return nil, errors.Wrap(err, "Couldn't parse the blob list")
+		}
+		for _, b := range page.Blobs {
+			modified, _ := http.ParseTime(b.Properties.LastModified)
+			objects = append(objects, StateObject{Key: b.Name, Modified: modified, Size: b.Properties.ContentLength})
+		}
+		if len(page.NextMarker) == 0 {
+			return objects, nil
+		}
+		query.Set("marker", page.NextMarker)
+	}
+}
+
+// Delete deletes a blob. lease is the ID of the lease held on the blob, if any
+func (c *azureBlobClient) Delete(ctx context.Context, container, blob, lease string) error {
+	_, err := c.do(ctx, http.MethodDelete, container, blob, nil, leaseHeader(lease), nil, http.StatusAccepted)
+	return err
+}
+
+func leaseHeader(lease string) map[string]string {
+	if len(lease) == 0 {
+		return map[string]string{}
+	}
+	return map[string]string{"x-ms-lease-id": lease}
+}
+
+// AcquireLease takes a lease on a blob, the way the azurerm backend locks state,
+// and returns its ID. A negative duration takes a lease that never expires.
+func (c *azureBlobClient) AcquireLease(ctx context.Context, container, blob string, d time.Duration) (string, error) {
+	duration := strconv.Itoa(int(d.Seconds()))
+	if d < 0 {
+		duration = "-1"
+	}
+	rsp, err := c.do(ctx, http.MethodPut, container, blob, url.Values{"comp": {"lease"}}, map[string]string{
+		"x-ms-lease-action":   "acquire",
+		"x-ms-lease-duration": duration,
+	}, nil, http.StatusCreated)
+	if err != nil {
+		return "", err
+	}
+	rsp.Body.Close()
+	return rsp.Header.Get("x-ms-lease-id"), nil
+}
+
+// ReleaseLease releases a lease taken by AcquireLease
+func (c *azureBlobClient) ReleaseLease(ctx context.Context, container, blob, id string) error {
+	_, err := c.do(ctx, http.MethodPut, container, blob, url.Values{"comp": {"lease"}}, map[string]string{
+		"x-ms-lease-action": "release",
+		"x-ms-lease-id":     id,
+	}, nil, http.StatusOK)
+	return err
+}
+
+// azureError is an error response from the blob service
+type azureError struct {
+	Status int
+	Code   string
+}
+
+func (e *azureError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.Status, http.StatusText(e.Status), e.Code)
+}
+
+// do sends a request to the blob service, returning an *azureError if the
+// response status isn't expected. The caller closes the body of the response.
+func (c *azureBlobClient) do(ctx context.Context, method, container, blob string, query url.Values, headers map[string]string, body []byte, expected int) (*http.Response, error) {
+	path := c.Endpoint + "/" + container
+	if len(blob) != 0 {
+		path += "/" + blob
+	}
+	u, err := url.Parse(path)
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = query.Encode()
+	if len(c.Key) == 0 && len(c.SASToken) != 0 {
+		if len(u.RawQuery) != 0 {
+			u.RawQuery += "&"
+		}
+		u.RawQuery += c.SASToken
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("x-ms-version", azureStorageVersion)
+	if len(c.Key) != 0 {
+		if err := c.sign(req, query); err != nil {
+			return nil, err
+		}
+	}
+	rsp, err := c.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if rsp.StatusCode != expected {
+		io.Copy(ioutil.Discard, rsp.Body)
+		rsp.Body.Close()
+		return nil, &azureError{Status: rsp.StatusCode, Code: rsp.Header.Get("x-ms-error-code")}
+	}
+	return rsp, nil
+}
+
+// sign adds a Shared Key authorization header to the request, see
+// https://docs.microsoft.com/en-us/rest/api/storageservices/authorize-with-shared-key
+func (c *azureBlobClient) sign(req *http.Request, query url.Values) error {
+	key, err := base64.StdEncoding.DecodeString(c.Key)
+	if err != nil {
+		return errors.Wrap(err, "Invalid storage account key")
+	}
+	mac := hmac.New(sha256.New, key)
+	io.WriteString(mac, azureStringToSign(c.Account, req, query))
+	req.Header.Set("Authorization", "SharedKey "+c.Account+":"+base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+	return nil
+}
+
+// azureStringToSign returns the string a Shared Key signature is made from
+func azureStringToSign(account string, req *http.Request, query url.Values) string {
+	length := ""
+	if req.ContentLength > 0 {
+		length = strconv.FormatInt(req.ContentLength, 10)
+	}
+	var msHeaders []string
+	for k := range req.Header {
+		if k := strings.ToLower(k); strings.HasPrefix(k, "x-ms-") {
+			msHeaders = append(msHeaders, k)
+		}
+	}
+	sort.Strings(msHeaders)
+	var canonical strings.Builder
+	for _, k := range msHeaders {
+		canonical.WriteString(k + ":" + strings.TrimSpace(req.Header.Get(k)) + "\n")
+	}
+	// The resource includes the account even when the endpoint's path does, e.g. Azurite
+	canonical.WriteString("/" + account + req.URL.EscapedPath())
+	var params []string
+	for k := range query {
+		params = append(params, k)
+	}
+	sort.Strings(params)
+	for _, k := range params {
+		v := append([]string(nil), query[k]...)
+		sort.Strings(v)
+		canonical.WriteString("\n" + strings.ToLower(k) + ":" + strings.Join(v, ","))
+	}
+	return strings.Join([]string{
+		req.Method,
+		req.Header.Get("Content-Encoding"),
+		req.Header.Get("Content-Language"),
+		length,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		"", // Date, x-ms-date is used instead
+		req.Header.Get("If-Modified-Since"),
+		req.Header.Get("If-Match"),
+		req.Header.Get("If-None-Match"),
+		req.Header.Get("If-Unmodified-Since"),
+		req.Header.Get("Range"),
+		canonical.String(),
+	}, "\n")
+}
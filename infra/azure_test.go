@@ -0,0 +1,227 @@
+package infra
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// azuriteAccount and azuriteKey are the well known Azurite development credentials
+const (
+	azuriteAccount = "devstoreaccount1"
+	azuriteKey     = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+)
+
+// fakeModified is when every blob in the fake blob service was last modified
+var fakeModified = time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+
+// fakeBlobService implements the parts of the blob service the state check
+// uses, checking every request is signed with azuriteKey
+type fakeBlobService struct {
+	sync.Mutex
+	blobs  map[string][]byte
+	leases map[string]string
+	// breakLeases makes every lease request succeed, as if locking didn't work
+	breakLeases bool
+	// onConflict is called when a lease is requested on a leased blob
+	onConflict func()
+}
+
+func (f *fakeBlobService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	key, _ := base64.StdEncoding.DecodeString(azuriteKey)
+	mac := hmac.New(sha256.New, key)
+	io.WriteString(mac, azureStringToSign(azuriteAccount, r, r.URL.Query()))
+	if r.Header.Get("Authorization") != "SharedKey "+azuriteAccount+":"+base64.StdEncoding.EncodeToString(mac.Sum(nil)) {
+		w.Header().Set("x-ms-error-code", "AuthenticationFailed")
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	blob := r.URL.Path
+	switch {
+	case r.URL.Query().Get("comp") == "list":
+		var names []string
+		for name := range f.blobs {
+			if strings.HasPrefix(name, blob+"/") {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		io.WriteString(w, "<EnumerationResults><Blobs>")
+		for _, name := range names {
+			fmt.Fprintf(w, "<Blob><Name>%s</Name><Properties><Last-Modified>%s</Last-Modified><Content-Length>%d</Content-Length></Properties></Blob>",
+				strings.TrimPrefix(name, blob+"/"), fakeModified.Format(http.TimeFormat), len(f.blobs[name]))
+		}
+		io.WriteString(w, "</Blobs><NextMarker/></EnumerationResults>")
+	case r.URL.Query().Get("comp") == "lease":
+		if _, ok := f.blobs[blob]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		switch r.Header.Get("x-ms-lease-action") {
+		case "acquire":
+			if _, ok := f.leases[blob]; ok && !f.breakLeases {
+				if f.onConflict != nil {
+					f.onConflict()
+				}
+				w.Header().Set("x-ms-error-code", "LeaseAlreadyPresent")
+				w.WriteHeader(http.StatusConflict)
+				return
+			}
+			f.leases[blob] = "lease-id"
+			w.Header().Set("x-ms-lease-id", "lease-id")
+			w.WriteHeader(http.StatusCreated)
+		case "release":
+			if f.leases[blob] != r.Header.Get("x-ms-lease-id") {
+				w.WriteHeader(http.StatusConflict)
+				return
+			}
+			delete(f.leases, blob)
+		}
+	case r.Method == http.MethodPut:
+		if lease, ok := f.leases[blob]; ok && lease != r.Header.Get("x-ms-lease-id") {
+			w.Header().Set("x-ms-error-code", "LeaseIdMissing")
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		f.blobs[blob] = b
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodGet:
+		b, ok := f.blobs[blob]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Last-Modified", fakeModified.Format(http.TimeFormat))
+		w.Write(b)
+	case r.Method == http.MethodDelete:
+		if lease, ok := f.leases[blob]; ok && lease != r.Header.Get("x-ms-lease-id") {
+			w.Header().Set("x-ms-error-code", "LeaseIdMissing")
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		delete(f.blobs, blob)
+		delete(f.leases, blob)
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+func TestValidateAzure(t *testing.T) {
+	fake := &fakeBlobService{blobs: make(map[string][]byte), leases: make(map[string]string)}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	backend := &AzureRMBackend{StorageAccount: azuriteAccount, Container: "tfstate", Endpoint: srv.URL + "/" + azuriteAccount}
+	ctx := withObserver(context.Background(), &recordingObserver{})
+	r := &RemoteState{ID: "micro-check-remote-state", Name: "check", Backend: backend}
+
+	os.Setenv("ARM_ACCESS_KEY", azuriteKey)
+	defer os.Unsetenv("ARM_ACCESS_KEY")
+	if err := r.Validate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.blobs) != 0 || len(fake.leases) != 0 {
+		t.Errorf("Expected the check to clean up, got blobs %v leases %v", fake.blobs, fake.leases)
+	}
+
+	fake.breakLeases = true
+	if err := r.Validate(ctx); err == nil || !strings.Contains(err.Error(), "state locking won't work") {
+		t.Errorf("Expected a locking error, got %v", err)
+	}
+	if len(fake.blobs) != 0 {
+		t.Errorf("Expected the blob to be deleted after a failed check, got %v", fake.blobs)
+	}
+	fake.breakLeases = false
+	fake.blobs, fake.leases = make(map[string][]byte), make(map[string]string)
+
+	os.Setenv("ARM_ACCESS_KEY", base64.StdEncoding.EncodeToString([]byte("wrong key")))
+	if err := r.Validate(ctx); err == nil || !strings.Contains(err.Error(), "AuthenticationFailed") {
+		t.Errorf("Expected an authentication error, got %v", err)
+	}
+
+	// Cancelled while the lease is held, the lease is released so the blob
+	// can still be deleted
+	os.Setenv("ARM_ACCESS_KEY", azuriteKey)
+	cctx, cancel := context.WithCancel(ctx)
+	fake.onConflict = cancel
+	if err := r.Validate(cctx); err == nil {
+		t.Error("Expected an error once cancelled")
+	}
+	fake.onConflict = nil
+	if len(fake.blobs) != 0 || len(fake.leases) != 0 {
+		t.Errorf("Expected the check to clean up when cancelled, got blobs %v leases %v", fake.blobs, fake.leases)
+	}
+
+	// Without a key or SAS token terraform uses Azure AD, which isn't checked
+	os.Unsetenv("ARM_ACCESS_KEY")
+	fake.blobs = make(map[string][]byte)
+	if err := r.Validate(ctx); err != nil {
+		t.Errorf("Expected the check to be skipped without a key, got %v", err)
+	}
+	if len(fake.blobs) != 0 {
+		t.Errorf("Expected nothing to be written without a key, got %v", fake.blobs)
+	}
+}
+
+func TestAzureStates(t *testing.T) {
+	fake := &fakeBlobService{blobs: map[string][]byte{
+		"/" + azuriteAccount + "/tfstate/micro-global-kv":        []byte(`{"version": 4}`),
+		"/" + azuriteAccount + "/tfstate/micro-lon1-do-network":  []byte(`{"version": 4, "serial": 3}`),
+		"/" + azuriteAccount + "/other/micro-lon1-do-kubeconfig": []byte(`{}`),
+	}, leases: make(map[string]string)}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	os.Setenv("ARM_ACCESS_KEY", azuriteKey)
+	defer os.Unsetenv("ARM_ACCESS_KEY")
+	store := &AzureRMBackend{StorageAccount: azuriteAccount, Container: "tfstate", Endpoint: srv.URL + "/" + azuriteAccount}
+
+	states, err := store.States(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(states) != 2 || states[0].Key != "micro-global-kv" || states[1].Key != "micro-lon1-do-network" {
+		t.Fatalf("Expected the 2 states in the container, got %+v", states)
+	}
+	if !states[1].Modified.Equal(fakeModified) || states[1].Size != 27 {
+		t.Errorf("Expected the modified time and size of the blob, got %+v", states[1])
+	}
+	obj, data, err := store.ReadState(context.Background(), "micro-lon1-do-network")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"version": 4, "serial": 3}` || !obj.Modified.Equal(fakeModified) {
+		t.Errorf("Unexpected state %s modified %s", data, obj.Modified)
+	}
+}
+
+// TestValidateAzurite runs the check against a real Azurite, e.g.
+// AZURITE_BLOB_ENDPOINT=http://127.0.0.1:10000/devstoreaccount1 with a tfstate container
+func TestValidateAzurite(t *testing.T) {
+	endpoint := os.Getenv("AZURITE_BLOB_ENDPOINT")
+	if len(endpoint) == 0 {
+		t.Skip("AZURITE_BLOB_ENDPOINT not set")
+	}
+	os.Setenv("ARM_ACCESS_KEY", azuriteKey)
+	defer os.Unsetenv("ARM_ACCESS_KEY")
+	r := &RemoteState{
+		ID:      "micro-check-remote-state",
+		Name:    "check",
+		Backend: &AzureRMBackend{StorageAccount: azuriteAccount, Container: "tfstate", Endpoint: endpoint},
+	}
+	if err := r.Validate(withObserver(context.Background(), &recordingObserver{})); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,359 @@
+package infra
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// StateBackend stores the terraform state of each module
+type StateBackend interface {
+	// Backend renders the terraform backend block storing the state for key
+	Backend(key string) (string, error)
+	// RemoteState renders a terraform_remote_state data source called name,
+	// which reads the state stored for key
+	RemoteState(name, key string) (string, error)
+}
+
+// S3Backend stores state in an AWS S3 bucket, locked with a DynamoDB table
+type S3Backend struct {
+	Bucket    string
+	LockTable string
+	Region    string
+}
+
+// Backend renders an s3 backend block
+func (b *S3Backend) Backend(key string) (string, error) {
+	return renderBackend("s3", b.config(key))
+}
+
+// RemoteState renders an s3 remote state data source
+func (b *S3Backend) RemoteState(name, key string) (string, error) {
+	return renderRemoteState(name, "s3", b.config(key))
+}
+
+func (b *S3Backend) config(key string) map[string]string {
+	return map[string]string{
+		"bucket":         b.Bucket,
+		"dynamodb_table": b.LockTable,
+		"key":            key,
+		"region":         b.Region,
+	}
+}
+
+// AzureRMBackend stores state in an Azure storage container
+type AzureRMBackend struct {
+	ResourceGroup  string
+	StorageAccount string
+	Container      string
+	// Endpoint of the blob service, used to check the container works.
+	// Defaults to https://<account>.blob.core.windows.net
+	Endpoint string
+}
+
+// Backend renders an azurerm backend block
+func (b *AzureRMBackend) Backend(key string) (string, error) {
+	return renderBackend("azurerm", b.config(key))
+}
+
+// RemoteState renders an azurerm remote state data source
+func (b *AzureRMBackend) RemoteState(name, key string) (string, error) {
+	return renderRemoteState(name, "azurerm", b.config(key))
+}
+
+func (b *AzureRMBackend) config(key string) map[string]string {
+	return map[string]string{
+		"resource_group_name":  b.ResourceGroup,
+		"storage_account_name": b.StorageAccount,
+		"container_name":       b.Container,
+		"key":                  key,
+	}
+}
+
+// LocalBackend stores state as files in a local directory, for development
+// and testing without a cloud account
+type LocalBackend struct {
+	Dir string
+}
+
+// Backend renders a local backend block
+func (b *LocalBackend) Backend(key string) (string, error) {
+	return renderBackend("local", map[string]string{"path": b.Path(key)})
+}
+
+// RemoteState renders a local remote state data source
+func (b *LocalBackend) RemoteState(name, key string) (string, error) {
+	return renderRemoteState(name, "local", map[string]string{"path": b.Path(key)})
+}
+
+// Path returns the file the state for key is stored in
+func (b *LocalBackend) Path(key string) string {
+	return filepath.Join(b.Dir, key+".tfstate")
+}
+
+// GCSBackend stores state in a Google Cloud Storage bucket
+type GCSBackend struct {
+	Bucket string
+	// Prefix is prepended to the key of every module's state
+	Prefix string
+}
+
+// Backend renders a gcs backend block
+func (b *GCSBackend) Backend(key string) (string, error) {
+	return renderBackend("gcs", b.config(key))
+}
+
+// RemoteState renders a gcs remote state data source
+func (b *GCSBackend) RemoteState(name, key string) (string, error) {
+	return renderRemoteState(name, "gcs", b.config(key))
+}
+
+func (b *GCSBackend) config(key string) map[string]string {
+	return map[string]string{
+		"bucket": b.Bucket,
+		"prefix": strings.TrimPrefix(b.Prefix+"/"+key, "/"),
+	}
+}
+
+// HTTPBackend stores state with a REST service. The state for each module is
+// at Address/<key>, and is locked at the same URL. Credentials are read from
+// TF_HTTP_USERNAME and TF_HTTP_PASSWORD so they aren't written to disk.
+type HTTPBackend struct {
+	Address string
+}
+
+// Backend renders an http backend block
+func (b *HTTPBackend) Backend(key string) (string, error) {
+	return renderBackend("http", b.config(key))
+}
+
+// RemoteState renders an http remote state data source. Reading state
+// doesn't lock it, so only the address is needed.
+func (b *HTTPBackend) RemoteState(name, key string) (string, error) {
+	return renderRemoteState(name, "http", map[string]string{"address": b.url(key)})
+}
+
+func (b *HTTPBackend) url(key string) string {
+	return strings.TrimRight(b.Address, "/") + "/" + key
+}
+
+func (b *HTTPBackend) config(key string) map[string]string {
+	return map[string]string{
+		"address":        b.url(key),
+		"lock_address":   b.url(key),
+		"unlock_address": b.url(key),
+	}
+}
+
+// ConsulBackend stores state in Consul's KV store. The ACL token is read from
+// CONSUL_HTTP_TOKEN so it isn't written to disk.
+type ConsulBackend struct {
+	// Address of the Consul agent, defaults to CONSUL_HTTP_ADDR
+	Address string
+	// Scheme is http or https
+	Scheme string
+	// Path is prepended to the key of every module's state
+	Path string
+}
+
+// Backend renders a consul backend block
+func (b *ConsulBackend) Backend(key string) (string, error) {
+	return renderBackend("consul", b.config(key))
+}
+
+// RemoteState renders a consul remote state data source
+func (b *ConsulBackend) RemoteState(name, key string) (string, error) {
+	return renderRemoteState(name, "consul", b.config(key))
+}
+
+func (b *ConsulBackend) config(key string) map[string]string {
+	c := map[string]string{"path": strings.TrimPrefix(b.Path+"/"+key, "/")}
+	if len(b.Address) != 0 {
+		c["address"] = b.Address
+	}
+	if len(b.Scheme) != 0 {
+		c["scheme"] = b.Scheme
+	}
+	return c
+}
+
+// PgBackend stores state in a Postgres database, one schema per module
+type PgBackend struct {
+	// ConnStr is the connection string, defaults to PG_CONN_STR
+	ConnStr string
+	// SchemaPrefix is prepended to the key to name each module's schema
+	SchemaPrefix string
+}
+
+// Backend renders a pg backend block
+func (b *PgBackend) Backend(key string) (string, error) {
+	return renderBackend("pg", b.config(key))
+}
+
+// RemoteState renders a pg remote state data source
+func (b *PgBackend) RemoteState(name, key string) (string, error) {
+	return renderRemoteState(name, "pg", b.config(key))
+}
+
+// Schema returns the name of the schema the state for key is stored in.
+// Postgres identifiers can't contain dashes unless quoted, so they're replaced.
+func (b *PgBackend) Schema(key string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+		return '_'
+	}, strings.ToLower(b.SchemaPrefix+key))
+}
+
+func (b *PgBackend) config(key string) map[string]string {
+	c := map[string]string{"schema_name": b.Schema(key)}
+	if len(b.ConnStr) != 0 {
+		c["conn_str"] = b.ConnStr
+	}
+	return c
+}
+
+// NewStateBackend returns the state backend called name, configured from viper
+func NewStateBackend(name string) (StateBackend, error) {
+	switch name {
+	case "aws", "s3":
+		return &S3Backend{
+			Bucket:    viper.GetString("aws-s3-bucket"),
+			LockTable: viper.GetString("aws-dynamodb-table"),
+			Region:    awsRegion(),
+		}, nil
+	case "azure", "azurerm":
+		return &AzureRMBackend{
+			ResourceGroup:  viper.GetString("azure-state-resource-group"),
+			StorageAccount: viper.GetString("azure-storage-account"),
+			Container:      viper.GetString("azure-storage-container"),
+			Endpoint:       viper.GetString("azure-storage-endpoint"),
+		}, nil
+	case "local":
+		dir, err := filepath.Abs(viper.GetString("local-state-dir"))
+		if err != nil {
+			return nil, err
+		}
+		return &LocalBackend{Dir: dir}, nil
+	case "gcs":
+		return &GCSBackend{
+			Bucket: viper.GetString("gcs-bucket"),
+			Prefix: viper.GetString("gcs-prefix"),
+		}, nil
+	case "http":
+		if len(viper.GetString("http-state-address")) == 0 {
+			return nil, errors.New("http-state-address must be set to use the http state store")
+		}
+		return &HTTPBackend{Address: viper.GetString("http-state-address")}, nil
+	case "consul":
+		return &ConsulBackend{
+			Address: viper.GetString("consul-address"),
+			Scheme:  viper.GetString("consul-scheme"),
+			Path:    viper.GetString("consul-path"),
+		}, nil
+	case "pg":
+		return &PgBackend{
+			ConnStr:      viper.GetString("pg-conn-str"),
+			SchemaPrefix: viper.GetString("pg-schema-prefix"),
+		}, nil
+	default:
+		return nil, errors.New(name + " is not a supported remote state store")
+	}
+}
+
+// configuredStateBackend returns the backend chosen by the state-store config,
+// falling back to the cloud provider
+func configuredStateBackend() (StateBackend, error) {
+	stateStore := viper.GetString("state-store")
+	if len(stateStore) == 0 {
+		stateStore = viper.GetString("cloud-provider")
+	}
+	return NewStateBackend(stateStore)
+}
+
+// awsRegion returns the region of the state bucket
+func awsRegion() string {
+	if r := os.Getenv("AWS_REGION"); len(r) != 0 {
+		return r
+	}
+	return "eu-west-2"
+}
+
+// backendSetting is a line of backend configuration
+type backendSetting struct {
+	Key   string
+	Value string
+}
+
+var (
+	tfBackendTemplate = template.Must(template.New("backend").Parse(`terraform {
+  backend "{{.Type}}" {
+{{- range .Settings}}
+    {{.Key}} = {{.Value}}
+{{- end}}
+  }
+}
+`))
+	tfRemoteStateTemplate = template.Must(template.New("remote").Parse(`data "terraform_remote_state" "{{.Name}}" {
+  backend = "{{.Type}}"
+
+  config = {
+{{- range .Settings}}
+    {{.Key}} = {{.Value}}
+{{- end}}
+  }
+}
+
+`))
+)
+
+func renderBackend(typ string, config map[string]string) (string, error) {
+	return render(tfBackendTemplate, "", typ, config)
+}
+
+func renderRemoteState(name, typ string, config map[string]string) (string, error) {
+	return render(tfRemoteStateTemplate, name, typ, config)
+}
+
+// render executes a backend template with the settings sorted, aligned and
+// quoted the way terraform fmt would
+func render(tmpl *template.Template, name, typ string, config map[string]string) (string, error) {
+	keys := make([]string, 0, len(config))
+	width := 0
+	for k := range config {
+		keys = append(keys, k)
+		if len(k) > width {
+			width = len(k)
+		}
+	}
+	sort.Strings(keys)
+	settings := make([]backendSetting, len(keys))
+	for i, k := range keys {
+		settings[i] = backendSetting{Key: fmt.Sprintf("%-*s", width, k), Value: hclString(config[k])}
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, struct {
+		Name     string
+		Type     string
+		Settings []backendSetting
+	}{name, typ, settings}); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// hclString quotes s as an HCL string literal, escaping interpolation sequences
+func hclString(s string) string {
+	s = strconv.Quote(s)
+	s = strings.Replace(s, "${", "$${", -1)
+	return strings.Replace(s, "%{", "%%{", -1)
+}
@@ -0,0 +1,136 @@
+package infra
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestS3Backend(t *testing.T) {
+	b := &S3Backend{Bucket: "state", LockTable: "lock", Region: "eu-west-2"}
+	config, err := b.Backend("micro-lon1-do-k8s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `terraform {
+  backend "s3" {
+    bucket         = "state"
+    dynamodb_table = "lock"
+    key            = "micro-lon1-do-k8s"
+    region         = "eu-west-2"
+  }
+}
+`
+	if config != expected {
+		t.Errorf("Expected\n%s\ngot\n%s", expected, config)
+	}
+
+	data, err := b.RemoteState("k8s", "micro-lon1-do-k8s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = `data "terraform_remote_state" "k8s" {
+  backend = "s3"
+
+  config = {
+    bucket         = "state"
+    dynamodb_table = "lock"
+    key            = "micro-lon1-do-k8s"
+    region         = "eu-west-2"
+  }
+}
+
+`
+	if data != expected {
+		t.Errorf("Expected\n%s\ngot\n%s", expected, data)
+	}
+}
+
+func TestStateBackends(t *testing.T) {
+	tests := []struct {
+		backend  StateBackend
+		typ      string
+		settings []string
+	}{
+		{&AzureRMBackend{ResourceGroup: "rg", StorageAccount: "acct", Container: "tfstate"}, "azurerm", []string{`container_name       = "tfstate"`, `key                  = "micro-kv"`}},
+		{&LocalBackend{Dir: "/var/state"}, "local", []string{`path = "/var/state/micro-kv.tfstate"`}},
+		{&GCSBackend{Bucket: "state", Prefix: "micro-platform"}, "gcs", []string{`prefix = "micro-platform/micro-kv"`}},
+		{&HTTPBackend{Address: "https://state.example.com/"}, "http", []string{`address        = "https://state.example.com/micro-kv"`, `lock_address   = "https://state.example.com/micro-kv"`}},
+		{&ConsulBackend{Path: "micro-platform"}, "consul", []string{`path = "micro-platform/micro-kv"`}},
+		{&PgBackend{SchemaPrefix: "micro_platform_"}, "pg", []string{`schema_name = "micro_platform_micro_kv"`}},
+	}
+	for _, tt := range tests {
+		config, err := tt.backend.Backend("micro-kv")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(config, `backend "`+tt.typ+`" {`) {
+			t.Errorf("Expected a %s backend, got\n%s", tt.typ, config)
+		}
+		data, err := tt.backend.RemoteState("kv", "micro-kv")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(data, `backend = "`+tt.typ+`"`) {
+			t.Errorf("Expected a %s remote state, got\n%s", tt.typ, data)
+		}
+		for _, s := range tt.settings {
+			if !strings.Contains(config, s) {
+				t.Errorf("Expected %s backend to contain %s, got\n%s", tt.typ, s, config)
+			}
+		}
+	}
+}
+
+func TestHCLString(t *testing.T) {
+	if s := hclString(`a "${b}" %{c}`); s != `"a \"$${b}\" %%{c}"` {
+		t.Errorf("Unexpected quoting %s", s)
+	}
+}
+
+func TestLocalBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "micro-platform-state-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	backend := &LocalBackend{Dir: filepath.Join(dir, "state")}
+
+	r := &RemoteState{ID: "check", Name: "check", Backend: backend}
+	if err := r.Validate(withObserver(context.Background(), &recordingObserver{})); err != nil {
+		t.Fatal(err)
+	}
+
+	m := &TerraformModule{
+		ID:           "micro-lon1-do-network",
+		Path:         filepath.Join(dir, "module"),
+		Backend:      backend,
+		RemoteStates: map[string]string{"namespaces": "micro-lon1-do-namespaces", "kv": "micro-global-kv"},
+	}
+	if err := os.MkdirAll(m.Path, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.generateBackendConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.generateRemoteStateDataSources(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(m.Path, "backend-config-micro-platform.tf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), backend.Path("micro-lon1-do-network")) {
+		t.Errorf("Expected the backend to use the state directory, got\n%s", b)
+	}
+	b, err = ioutil.ReadFile(filepath.Join(m.Path, "remote-state-data-sources-micro-platform.tf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kv, ns := strings.Index(string(b), `"kv"`), strings.Index(string(b), `"namespaces"`); kv == -1 || ns == -1 || kv > ns {
+		t.Errorf("Expected sorted kv and namespaces remote states, got\n%s", b)
+	}
+}
@@ -0,0 +1,477 @@
+package infra
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigVersion is the version of the config file schema this binary reads
+const ConfigVersion = 1
+
+// Providers are the cloud providers a region can be deployed to
+var Providers = []string{"aws", "azure", "do"}
+
+// StateStores are the names of the state backends NewStateBackend accepts
+var StateStores = []string{"aws", "azure", "azurerm", "consul", "gcs", "http", "local", "pg", "s3"}
+
+// Schema describes a value in the config file. It's a subset of JSON Schema,
+// so it can be published for editors to complete and check config files.
+type Schema struct {
+	SchemaURI   string             `json:"$schema,omitempty"`
+	ID          string             `json:"$id,omitempty"`
+	Title       string             `json:"title,omitempty"`
+	Description string             `json:"description,omitempty"`
+	Type        string             `json:"type,omitempty"`
+	Enum        []interface{}      `json:"enum,omitempty"`
+	Pattern     string             `json:"pattern,omitempty"`
+	Minimum     *int               `json:"minimum,omitempty"`
+	Items       *Schema            `json:"items,omitempty"`
+	UniqueItems bool               `json:"uniqueItems,omitempty"`
+	Properties  map[string]*Schema `json:"properties,omitempty"`
+	Required    []string           `json:"required,omitempty"`
+	// AdditionalProperties is false for objects with only the listed
+	// properties, or the schema of every value of a map
+	AdditionalProperties interface{} `json:"additionalProperties,omitempty"`
+
+	// mismatch explains a value that doesn't match Pattern
+	mismatch string
+}
+
+// durationPattern matches the durations time.ParseDuration accepts
+const durationPattern = `^(0|([0-9]+(\.[0-9]+)?(ns|us|µs|ms|s|m|h))+)$`
+
+func stringSchema(description string, enum ...string) *Schema {
+	s := &Schema{Type: "string", Description: description}
+	for _, e := range enum {
+		s.Enum = append(s.Enum, e)
+	}
+	return s
+}
+
+func durationSchema(description string) *Schema {
+	return &Schema{Type: "string", Description: description, Pattern: durationPattern, mismatch: "isn't a duration, e.g. 30s, 5m or 1h30m"}
+}
+
+func intSchema(description string, min int) *Schema {
+	return &Schema{Type: "integer", Description: description, Minimum: &min}
+}
+
+func boolSchema(description string) *Schema {
+	return &Schema{Type: "boolean", Description: description}
+}
+
+func objectSchema(description string, properties map[string]*Schema, required ...string) *Schema {
+	return &Schema{Type: "object", Description: description, Properties: properties, Required: required, AdditionalProperties: false}
+}
+
+// variablesSchema is a map of terraform variables, which can have any type
+func variablesSchema(description string) *Schema {
+	return &Schema{Type: "object", Description: description, AdditionalProperties: &Schema{}}
+}
+
+func listSchema(description string, items *Schema) *Schema {
+	return &Schema{Type: "array", Description: description, Items: items, UniqueItems: true}
+}
+
+// embeddedModules returns the names of the bundled modules in dir, e.g. kv
+func embeddedModules(dir string) []string {
+	entries, _ := fs.ReadDir(modules, dir)
+	var names []string
+	for _, e := range entries {
+		if e.IsDir() {
+			names = append(names, e.Name())
+		}
+	}
+	return names
+}
+
+// ConfigSchema returns the schema of the config file
+func ConfigSchema() *Schema {
+	services := func(kind string) *Schema {
+		return listSchema("The "+kind+" services to deploy, every one if empty", stringSchema("", serviceNames(kind)...))
+	}
+	region := objectSchema("A cloud provider's region the platform is deployed to", map[string]*Schema{
+		"provider":  stringSchema("The cloud provider", Providers...),
+		"region":    stringSchema("The provider's region, e.g. lon1"),
+		"control":   services(ServiceControl),
+		"resource":  services(ServiceResource),
+		"network":   services(ServiceNetwork),
+		"variables": variablesSchema("Module variables, overriding the platform's in the region"),
+	}, "provider", "region")
+
+	secrets := make(map[string]*Schema)
+	for name, ref := range DefaultSecrets {
+		secrets[name] = &Schema{
+			Type:        "string",
+			Description: "Where " + name + " is read from, defaults to " + ref,
+			Pattern:     `^(\$\{)?(env|file|sops|vault):[^}]+\}?$`,
+			mismatch:    "isn't a secret reference, expected env:, file:, sops: or vault:",
+		}
+	}
+	kinds := make(map[string]*Schema)
+	for _, kind := range moduleKinds {
+		kinds[kind] = durationSchema("Limit on each phase of the " + kind + " modules")
+	}
+
+	platform := objectSchema("A complete platform", map[string]*Schema{
+		"name":   stringSchema("The platform's name, prefixing every module and state"),
+		"domain": stringSchema("The domain the platform is served on"),
+		"gslb":   stringSchema("The global load balancer in front of every region, none if empty", embeddedModules("gslb")...),
+		"kv":     stringSchema("The global key value store", embeddedModules("kv")...),
+		"retry": objectSchema("Retries terraform commands that fail with transient errors", map[string]*Schema{
+			"attempts":    intSchema("The maximum number of times a command is run, including the first", 0),
+			"backoff":     durationSchema("The delay before the first retry, doubled for every attempt after"),
+			"max-backoff": durationSchema("Caps the delay between attempts"),
+			"retryable":   &Schema{Type: "array", Description: "Regular expressions matching the errors to retry", Items: stringSchema("")},
+		}),
+		"timeout":   durationSchema("Limit on each phase of every module, 0 for no limit"),
+		"timeouts":  objectSchema("Limits overriding timeout for a kind of module", kinds),
+		"secrets":   objectSchema("Where the secrets the modules need are read from", secrets),
+		"variables": variablesSchema("Module variables, set in every module that declares them, e.g. replicas: 3"),
+		"regions":   &Schema{Type: "array", Description: "The regions the platform is deployed to", Items: region},
+	}, "name", "kv", "regions")
+
+	properties := map[string]*Schema{
+		"version":   {Type: "integer", Description: "The version of the config schema, 1 if not set, which is deprecated", Enum: []interface{}{ConfigVersion}},
+		"platforms": &Schema{Type: "array", Description: "The platforms to manage", Items: platform},
+	}
+	for k, v := range configSettings {
+		properties[k] = v
+	}
+	return &Schema{
+		SchemaURI:            "http://json-schema.org/draft-07/schema#",
+		ID:                   "https://raw.githubusercontent.com/micro/platform/main/docs/config.schema.json",
+		Title:                "micro platform config",
+		Type:                 "object",
+		Properties:           properties,
+		Required:             []string{"platforms"},
+		AdditionalProperties: false,
+	}
+}
+
+// ConfigSchemaJSON returns the schema of the config file as JSON Schema
+func ConfigSchemaJSON() ([]byte, error) {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(ConfigSchema()); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// configSettings are the command line settings that can also be set in the config file
+var configSettings = map[string]*Schema{
+	"cloud-provider":             stringSchema("The cloud provider, the default state store"),
+	"state-store":                stringSchema("Where terraform state is stored", StateStores...),
+	"aws-region":                 stringSchema("The AWS region EKS clusters are managed from"),
+	"aws-s3-bucket":              stringSchema("The S3 bucket state is stored in"),
+	"aws-dynamodb-table":         stringSchema("The DynamoDB table S3 state is locked with"),
+	"azure-state-resource-group": stringSchema("The resource group of the Azure state storage account"),
+	"azure-storage-account":      stringSchema("The Azure storage account state is stored in"),
+	"azure-storage-container":    stringSchema("The Azure storage container state is stored in"),
+	"azure-storage-endpoint":     stringSchema("The Azure blob endpoint, if not the public cloud's"),
+	"local-state-dir":            stringSchema("The directory local state is stored in"),
+	"gcs-bucket":                 stringSchema("The GCS bucket state is stored in"),
+	"gcs-prefix":                 stringSchema("The prefix of state objects in the GCS bucket"),
+	"http-state-address":         stringSchema("The address of the http state store"),
+	"consul-address":             stringSchema("The address of the Consul state store"),
+	"consul-scheme":              stringSchema("The scheme of the Consul address", "http", "https"),
+	"consul-path":                stringSchema("The path of state in Consul's KV store"),
+	"pg-conn-str":                stringSchema("The connection string of the Postgres state store"),
+	"pg-schema-prefix":           stringSchema("The prefix of the Postgres schema of each state"),
+	"concurrency":                intSchema("Maximum number of tasks to run in parallel, 0 for no limit", 0),
+	"plan-dir":                   stringSchema("Directory plan saves plan artifacts to, and apply applies them from"),
+	"interrupt-timeout":          durationSchema("How long terraform has to exit gracefully when cancelled"),
+	"timeout":                    durationSchema("Default limit on each phase of a module, unless set by the platform"),
+	"require-checksum":           boolSchema("Reject modules downloaded over http(s) without a sha256 checksum"),
+	"git-cache":                  stringSchema("Directory git module sources are cloned to, shared between runs"),
+	"stale-lock-age":             durationSchema("How old a state lock must be to be reported as left behind by a crashed run"),
+	"force-unlock":               boolSchema("Remove stale state locks"),
+	"journal":                    stringSchema("File recording the outcome of each task, used by apply --resume"),
+	"plan-key":                   stringSchema("Passphrase encrypting saved plans of modules with secrets, better set with MICRO_PLAN_KEY"),
+	"plan-output":                stringSchema("Format plan prints the changes in", "table", "json"),
+	"resume":                     boolSchema("Skip modules already applied with the same configuration by a previous apply"),
+	"rollback-on-failure":        boolSchema("Destroy the modules a failed apply created"),
+	"config-file":                stringSchema("The config file"),
+	"kube-config-path":           stringSchema("The kubeconfig kubernetes commands use"),
+	"cluster-name":               stringSchema("The cluster kubernetes commands manage"),
+	"cluster-region":             stringSchema("The region of the cluster kubernetes commands manage"),
+	"migrate-from":               stringSchema("The state store state migrate copies from", StateStores...),
+	"migrate-to":                 stringSchema("The state store state migrate copies to", StateStores...),
+	"delete-source":              boolSchema("Delete each state from the source store once state migrate has copied it"),
+}
+
+// ConfigError is a problem with a value in the config file
+type ConfigError struct {
+	File   string
+	Line   int
+	Column int
+	// Path is the value's path, e.g. platforms[0].regions[1].provider
+	Path    string
+	Message string
+}
+
+func (e *ConfigError) Error() string {
+	var pos string
+	if len(e.File) != 0 {
+		pos = e.File + ":"
+	}
+	pos += fmt.Sprintf("%d:%d: ", e.Line, e.Column)
+	if len(e.Path) != 0 {
+		pos += e.Path + ": "
+	}
+	return pos + e.Message
+}
+
+// ConfigErrors are every problem found in a config file
+type ConfigErrors []*ConfigError
+
+func (e ConfigErrors) Error() string {
+	lines := make([]string, len(e))
+	for i, err := range e {
+		lines[i] = err.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// ValidateConfigFile checks a YAML or JSON config file against the schema.
+// Config files in other formats aren't checked.
+func ValidateConfigFile(path string) error {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml", ".json":
+	default:
+		return nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.Wrap(err, "Couldn't read the config file")
+	}
+	return ValidateConfig(path, b)
+}
+
+// ValidateConfig checks a YAML or JSON config file against the schema,
+// returning ConfigErrors with the position of each problem
+func ValidateConfig(file string, b []byte) error {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return errors.Wrapf(err, "Couldn't parse %s", file)
+	}
+	if len(doc.Content) == 0 {
+		return ConfigErrors{{File: file, Line: 1, Column: 1, Message: "the config file is empty"}}
+	}
+	v := &configValidator{file: file}
+	v.validate(ConfigSchema(), doc.Content[0], "")
+	if len(v.errs) != 0 {
+		return v.errs
+	}
+	return nil
+}
+
+type configValidator struct {
+	file string
+	errs ConfigErrors
+}
+
+func (v *configValidator) errorf(n *yaml.Node, path, format string, args ...interface{}) {
+	v.errs = append(v.errs, &ConfigError{
+		File:    v.file,
+		Line:    n.Line,
+		Column:  n.Column,
+		Path:    path,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// yamlTypes are the YAML tags each type of value can have
+var yamlTypes = map[string]string{
+	"string":  "!!str",
+	"integer": "!!int",
+	"boolean": "!!bool",
+}
+
+func (v *configValidator) validate(s *Schema, n *yaml.Node, path string) {
+	if n.Kind == yaml.AliasNode {
+		n = n.Alias
+	}
+	// null is the same as the value being omitted
+	if n.Kind == yaml.ScalarNode && n.Tag == "!!null" {
+		return
+	}
+	switch s.Type {
+	case "":
+		// any value
+	case "object":
+		if n.Kind != yaml.MappingNode {
+			v.errorf(n, path, "expected an object, got %s", describeNode(n))
+			return
+		}
+		seen := make(map[string]bool)
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key, value := n.Content[i], n.Content[i+1]
+			keyPath := key.Value
+			if len(path) != 0 {
+				keyPath = path + "." + key.Value
+			}
+			if seen[key.Value] {
+				v.errorf(key, keyPath, "set twice")
+				continue
+			}
+			seen[key.Value] = true
+			if p, ok := s.Properties[key.Value]; ok {
+				v.validate(p, value, keyPath)
+			} else if items, ok := s.AdditionalProperties.(*Schema); ok {
+				v.validate(items, value, keyPath)
+			} else {
+				v.errorf(key, path, "unknown field %q%s", key.Value, suggest(key.Value, s.Properties))
+			}
+		}
+		for _, r := range s.Required {
+			if !seen[r] {
+				v.errorf(n, path, "missing required field %q", r)
+			}
+		}
+	case "array":
+		if n.Kind != yaml.SequenceNode {
+			v.errorf(n, path, "expected a list, got %s", describeNode(n))
+			return
+		}
+		seen := make(map[string]bool)
+		for i, item := range n.Content {
+			itemPath := fmt.Sprintf("%s[%d]", path, i)
+			if s.UniqueItems && item.Kind == yaml.ScalarNode {
+				if seen[item.Value] {
+					v.errorf(item, itemPath, "%q is listed twice", item.Value)
+					continue
+				}
+				seen[item.Value] = true
+			}
+			v.validate(s.Items, item, itemPath)
+		}
+	default:
+		if n.Kind != yaml.ScalarNode || n.Tag != yamlTypes[s.Type] {
+			v.errorf(n, path, "expected a %s, got %s", s.Type, describeNode(n))
+			return
+		}
+		if len(s.Enum) != 0 && !inEnum(n.Value, s.Enum) {
+			v.errorf(n, path, "unknown value %q, expected one of %s", n.Value, joinEnum(s.Enum))
+		}
+		// The value isn't repeated, in case it's a secret
+		if len(s.Pattern) != 0 && !regexp.MustCompile(s.Pattern).MatchString(n.Value) {
+			v.errorf(n, path, "%s", s.mismatch)
+		}
+		if s.Minimum != nil {
+			var i int
+			if _, err := fmt.Sscan(n.Value, &i); err == nil && i < *s.Minimum {
+				v.errorf(n, path, "must be at least %d, got %d", *s.Minimum, i)
+			}
+		}
+	}
+}
+
+func describeNode(n *yaml.Node) string {
+	switch n.Kind {
+	case yaml.MappingNode:
+		return "an object"
+	case yaml.SequenceNode:
+		return "a list"
+	}
+	switch n.Tag {
+	case "!!int":
+		return "the integer " + n.Value
+	case "!!bool":
+		return "the boolean " + n.Value
+	case "!!float":
+		return "the number " + n.Value
+	}
+	return fmt.Sprintf("%q", n.Value)
+}
+
+func inEnum(value string, enum []interface{}) bool {
+	for _, e := range enum {
+		if fmt.Sprint(e) == value {
+			return true
+		}
+	}
+	return false
+}
+
+func joinEnum(enum []interface{}) string {
+	var b bytes.Buffer
+	for i, e := range enum {
+		if i != 0 {
+			b.WriteString(", ")
+		}
+		fmt.Fprint(&b, e)
+	}
+	return b.String()
+}
+
+// suggest returns a hint naming the property closest to an unknown field, if
+// it's likely a typo
+func suggest(field string, properties map[string]*Schema) string {
+	names := make([]string, 0, len(properties))
+	for name := range properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	best, bestDistance := "", len(field)/3+1
+	for _, name := range names {
+		if d := editDistance(field, name); d <= bestDistance {
+			if d < bestDistance || len(best) == 0 {
+				best, bestDistance = name, d
+			}
+		}
+	}
+	if len(best) == 0 {
+		return ""
+	}
+	return fmt.Sprintf(", did you mean %q?", best)
+}
+
+// editDistance is the Damerau-Levenshtein distance between a and b, counting
+// a swap of adjacent characters as one edit
+func editDistance(a, b string) int {
+	d := make([][]int, len(a)+1)
+	for i := range d {
+		d[i] = make([]int, len(b)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			d[i][j] = minInt(d[i-1][j]+1, d[i][j-1]+1, d[i-1][j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				d[i][j] = minInt(d[i][j], d[i-2][j-2]+1)
+			}
+		}
+	}
+	return d[len(a)][len(b)]
+}
+
+func minInt(values ...int) int {
+	m := values[0]
+	for _, v := range values[1:] {
+		if v < m {
+			m = v
+		}
+	}
+	return m
+}
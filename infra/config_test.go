@@ -0,0 +1,168 @@
+package infra
+
+import (
+	"bytes"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestConfigExamples(t *testing.T) {
+	for _, f := range []string{"../config-example.yaml", "../config-test.yaml"} {
+		if err := ValidateConfigFile(f); err != nil {
+			t.Errorf("%s: %v", f, err)
+		}
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	tests := []struct {
+		config string
+		errs   []string
+	}{
+		{
+			config: `
+platforms:
+- name: micro
+  kv: cloudflare
+  regoins:
+  - provider: do
+    region: lon1
+version: 1
+`,
+			errs: []string{
+				`config.yaml:5:3: platforms[0]: unknown field "regoins", did you mean "regions"?`,
+				`config.yaml:3:3: platforms[0]: missing required field "regions"`,
+			},
+		},
+		{
+			config: `
+version: 2
+state-store: dynamodb
+platforms:
+- name: micro
+  kv: consul
+  gslb: route53
+  timeout: 30
+  timeouts:
+    netwrok: 45m
+  regions:
+  - provider: gcp
+    region: europe-west2
+    control: [bot, bot]
+    network: [regsitry]
+  - region: lon1
+`,
+			errs: []string{
+				`config.yaml:2:10: version: unknown value "2", expected one of 1`,
+				`config.yaml:3:14: state-store: unknown value "dynamodb", expected one of aws, azure, azurerm, consul, gcs, http, local, pg, s3`,
+				`config.yaml:6:7: platforms[0].kv: unknown value "consul", expected one of cloudflare`,
+				`config.yaml:7:9: platforms[0].gslb: unknown value "route53", expected one of cloudflare`,
+				`config.yaml:8:12: platforms[0].timeout: expected a string, got the integer 30`,
+				`config.yaml:10:5: platforms[0].timeouts: unknown field "netwrok", did you mean "network"?`,
+				`config.yaml:12:15: platforms[0].regions[0].provider: unknown value "gcp", expected one of aws, azure, do`,
+				`config.yaml:14:20: platforms[0].regions[0].control[1]: "bot" is listed twice`,
+				`config.yaml:15:15: platforms[0].regions[0].network[0]: unknown value "regsitry", expected one of api, broker`,
+				`config.yaml:16:5: platforms[0].regions[1]: missing required field "provider"`,
+			},
+		},
+		{
+			config: `
+platforms:
+- name: micro
+  kv: cloudflare
+  retry:
+    attempts: -1
+    backoff: soon
+  secrets:
+    cloudflare_api_token: hunter2
+  regions: {provider: do}
+version: 1
+`,
+			errs: []string{
+				`config.yaml:6:15: platforms[0].retry.attempts: must be at least 0, got -1`,
+				`config.yaml:7:14: platforms[0].retry.backoff: isn't a duration, e.g. 30s, 5m or 1h30m`,
+				`config.yaml:9:27: platforms[0].secrets.cloudflare_api_token: isn't a secret reference`,
+				`config.yaml:10:12: platforms[0].regions: expected a list, got an object`,
+			},
+		},
+		{
+			config: `version: 1`,
+			errs:   []string{`config.yaml:1:1: missing required field "platforms"`},
+		},
+		{
+			// Files without a version are deprecated, but still read as version 1
+			config: `platforms: []`,
+		},
+		{
+			// Every setting viper reads can be set in the config file
+			config: `
+version: 1
+kube-config-path: ~/.kube/config
+cluster-name: micro
+plan-output: json
+rollback-on-failure: true
+platforms: []
+`,
+		},
+	}
+	for _, test := range tests {
+		err := ValidateConfig("config.yaml", []byte(test.config))
+		if len(test.errs) == 0 {
+			if err != nil {
+				t.Errorf("Expected no errors, got %v", err)
+			}
+			continue
+		}
+		errs, ok := err.(ConfigErrors)
+		if !ok {
+			t.Errorf("Expected config errors, got %v", err)
+			continue
+		}
+		if len(errs) != len(test.errs) {
+			t.Errorf("Expected %d errors, got %d:\n%v", len(test.errs), len(errs), errs)
+			continue
+		}
+		for i, want := range test.errs {
+			if got := errs[i].Error(); !strings.HasPrefix(got, want) {
+				t.Errorf("Expected an error starting %s, got %s", want, got)
+			}
+		}
+	}
+}
+
+// TestConfigSchemaFields checks every field of a platform is in the schema
+func TestConfigSchemaFields(t *testing.T) {
+	platform := ConfigSchema().Properties["platforms"].Items
+	check := func(typ reflect.Type, s *Schema) {
+		for i := 0; i < typ.NumField(); i++ {
+			f := typ.Field(i)
+			name := f.Tag.Get("mapstructure")
+			if len(name) == 0 {
+				name = strings.ToLower(f.Name)
+			}
+			if _, ok := s.Properties[name]; !ok {
+				t.Errorf("%s.%s isn't in the config schema", typ.Name(), f.Name)
+			}
+		}
+	}
+	check(reflect.TypeOf(Platform{}), platform)
+	check(reflect.TypeOf(Region{}), platform.Properties["regions"].Items)
+	check(reflect.TypeOf(RetryPolicy{}), platform.Properties["retry"])
+}
+
+// TestConfigSchemaFile checks the published schema is up to date
+func TestConfigSchemaFile(t *testing.T) {
+	b, err := ioutil.ReadFile("../docs/config.schema.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := ConfigSchemaJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, want) {
+		t.Error("docs/config.schema.json is out of date, run make schema")
+	}
+}
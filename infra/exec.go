@@ -0,0 +1,37 @@
+package infra
+
+import (
+	"os/exec"
+	"sync"
+)
+
+// processes are the running terraform commands, so they can be killed if we
+// have to exit without waiting for them
+var processes = struct {
+	sync.Mutex
+	cmds map[*exec.Cmd]bool
+}{cmds: make(map[*exec.Cmd]bool)}
+
+func trackProcess(cmd *exec.Cmd) {
+	processes.Lock()
+	defer processes.Unlock()
+	processes.cmds[cmd] = true
+}
+
+func untrackProcess(cmd *exec.Cmd) {
+	processes.Lock()
+	defer processes.Unlock()
+	delete(processes.cmds, cmd)
+}
+
+// KillProcesses kills every running terraform process along with the
+// processes it started, e.g. provider plugins. It's for exiting immediately,
+// e.g. on a second interrupt, so nothing keeps changing infrastructure after
+// we've gone. Their state may be left locked.
+func KillProcesses() {
+	processes.Lock()
+	defer processes.Unlock()
+	for cmd := range processes.cmds {
+		killProcessGroup(cmd)
+	}
+}
@@ -0,0 +1,60 @@
+//go:build !windows
+// +build !windows
+
+package infra
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// running returns true if the process is running, rather than exited or a zombie
+func running(pid int) bool {
+	b, err := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return false
+	}
+	fields := strings.Fields(string(b)[strings.LastIndex(string(b), ")")+1:])
+	return len(fields) > 0 && fields[0] != "Z"
+}
+
+func TestKillProcesses(t *testing.T) {
+	// The shell stands in for terraform and sleep for a provider plugin
+	cmd := exec.Command("sh", "-c", "sleep 60 & echo $!; wait")
+	setProcessGroup(cmd)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	trackProcess(cmd)
+	defer untrackProcess(cmd)
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugin, err := strconv.Atoi(strings.TrimSpace(line))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !running(plugin) {
+		t.Skip("Can't see processes in /proc")
+	}
+
+	KillProcesses()
+	cmd.Wait()
+	deadline := time.Now().Add(5 * time.Second)
+	for running(plugin) {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the processes terraform started to be killed too")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
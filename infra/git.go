@@ -0,0 +1,210 @@
+package infra
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultGitCacheDir is where git sources are cloned to, shared by every module
+const DefaultGitCacheDir = "/tmp/micro-platform-git-cache"
+
+// gitSource is a git module source, e.g.
+// git+https://github.com/micro/platform.git//infra/network?ref=v1.0.0
+type gitSource struct {
+	// Remote is the URL the repository is cloned from
+	Remote string
+	// Display is Remote without any credentials, for logging
+	Display string
+	// Ref is the tag, branch or commit SHA to check out
+	Ref string
+	// Subdir of the repository that holds the module, empty for the whole repository
+	Subdir string
+}
+
+// parseGitSource splits the subdirectory and ref out of a git source URL
+func parseGitSource(u *url.URL) (*gitSource, error) {
+	remote, subdir := splitSubdir(u)
+	q := remote.Query()
+	ref := q.Get("ref")
+	q.Del("ref")
+	remote.RawQuery = q.Encode()
+	remote.Scheme = strings.TrimPrefix(remote.Scheme, "git+")
+	if len(remote.Host) == 0 && remote.Scheme != "file" {
+		return nil, errors.New("git source " + u.String() + " has no host")
+	}
+	if len(ref) == 0 {
+		ref = "HEAD"
+	}
+	src := &gitSource{Remote: remote.String(), Ref: ref, Subdir: subdir}
+	remote.User = nil
+	src.Display = remote.String()
+	return src, nil
+}
+
+// gitCacheLocks stops modules in the same run cloning or fetching a repository at the same time
+var gitCacheLocks = struct {
+	sync.Mutex
+	repos map[string]*sync.Mutex
+}{repos: make(map[string]*sync.Mutex)}
+
+func lockGitCache(repo string) func() {
+	gitCacheLocks.Lock()
+	mu, ok := gitCacheLocks.repos[repo]
+	if !ok {
+		mu = &sync.Mutex{}
+		gitCacheLocks.repos[repo] = mu
+	}
+	gitCacheLocks.Unlock()
+	mu.Lock()
+	return mu.Unlock
+}
+
+// fetchGit checks out the module from a git repository in to the module path,
+// recording the commit it was checked out at
+func (t *TerraformModule) fetchGit(ctx context.Context, u *url.URL) error {
+	src, err := parseGitSource(u)
+	if err != nil {
+		return err
+	}
+	cache := t.GitCacheDir
+	if len(cache) == 0 {
+		cache = DefaultGitCacheDir
+	}
+	key := sha256.Sum256([]byte(src.Remote))
+	repo := filepath.Join(cache, hex.EncodeToString(key[:8]))
+
+	unlock := lockGitCache(repo)
+	sha, err := t.updateGitCache(ctx, src, repo)
+	if err != nil {
+		unlock()
+		return err
+	}
+	logf(ctx, t, "Checking out %s at %s", src.Ref, sha)
+	err = t.gitArchive(ctx, repo, sha, src.Subdir)
+	unlock()
+	if err != nil {
+		return err
+	}
+	t.revision = sha
+	return nil
+}
+
+// updateGitCache clones or fetches the repository in to the cache, returning
+// the commit SHA that ref resolves to
+func (t *TerraformModule) updateGitCache(ctx context.Context, src *gitSource, repo string) (string, error) {
+	if _, err := os.Stat(repo); os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(repo), 0o700); err != nil {
+			return "", err
+		}
+		logf(ctx, t, "Cloning %s", src.Display)
+		if _, err := t.git(ctx, "", "clone", "--mirror", "--quiet", src.Remote, repo); err != nil {
+			return "", errors.Wrap(err, "git clone failed")
+		}
+	} else if err != nil {
+		return "", err
+	} else if !isCommitSHA(src.Ref) || !t.hasCommit(ctx, repo, src.Ref) {
+		// Branches and tags can move, but a commit we already have can't
+		logf(ctx, t, "Fetching %s", src.Display)
+		if _, err := t.git(ctx, repo, "fetch", "--prune", "--quiet", "origin"); err != nil {
+			return "", errors.Wrap(err, "git fetch failed")
+		}
+	}
+	out, err := t.git(ctx, repo, "rev-parse", "--verify", "--quiet", src.Ref+"^{commit}")
+	if err != nil {
+		return "", errors.Errorf("Module %s ref %s not found in %s", t.Name, src.Ref, src.Display)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// gitArchive extracts subdir of the repository at commit sha in to the module path
+func (t *TerraformModule) gitArchive(ctx context.Context, repo, sha, subdir string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	args := []string{"archive", "--format=tar", sha}
+	if len(subdir) != 0 {
+		args = append(args, "--", subdir)
+	}
+	cmd := t.gitCommand(ctx, repo, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return errors.Wrap(err, "StdoutPipe failed")
+	}
+	if err := cmd.Start(); err != nil {
+		return errors.Wrap(err, "Couldn't execute git")
+	}
+	n, extractErr := extractTar(stdout, subdir, t.Path)
+	if extractErr != nil {
+		// Stop git rather than wait for it to fill the pipe
+		cancel()
+	}
+	if err := cmd.Wait(); err != nil && extractErr == nil {
+		return errors.Wrapf(err, "git archive failed: %s", strings.TrimSpace(stderr.String()))
+	}
+	if extractErr != nil {
+		return errors.Wrap(extractErr, "Couldn't extract module")
+	}
+	if n == 0 {
+		return errors.New("Module " + t.Name + " has no files in " + subdir)
+	}
+	return nil
+}
+
+// hasCommit returns true if the cached repository already has the commit
+func (t *TerraformModule) hasCommit(ctx context.Context, repo, sha string) bool {
+	_, err := t.git(ctx, repo, "cat-file", "-e", sha+"^{commit}")
+	return err == nil
+}
+
+// git runs git in dir and returns its stdout
+func (t *TerraformModule) git(ctx context.Context, dir string, args ...string) ([]byte, error) {
+	cmd := t.gitCommand(ctx, dir, args...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); len(msg) != 0 {
+			return nil, errors.Wrap(err, msg)
+		}
+		return nil, err
+	}
+	return stdout.Bytes(), nil
+}
+
+func (t *TerraformModule) gitCommand(ctx context.Context, dir string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	cmd.Env = os.Environ()
+	// Credentials for private repositories, e.g. GIT_SSH_COMMAND, come from the module environment
+	for k, v := range t.Env {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", k, v))
+	}
+	// Fail rather than wait for a password that will never be typed
+	cmd.Env = append(cmd.Env, "GIT_TERMINAL_PROMPT=0")
+	return cmd
+}
+
+// isCommitSHA returns true if ref looks like a full or abbreviated commit SHA
+func isCommitSHA(ref string) bool {
+	if len(ref) < 7 || len(ref) > 40 {
+		return false
+	}
+	for _, c := range ref {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+	return true
+}
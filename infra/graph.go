@@ -0,0 +1,256 @@
+package infra
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Graph is a set of tasks ordered by their dependencies
+type Graph struct {
+	// nodes in the order the tasks were added
+	nodes []*node
+	byID  map[string]*node
+}
+
+type node struct {
+	id         string
+	task       Task
+	deps       []*node
+	dependents []*node
+}
+
+// NewGraph builds a dependency graph from all the tasks in steps.
+// A TerraformModule depends on the tasks named in its RemoteStates and DependsOn,
+// and on the tasks whose outputs its variables reference.
+// RemoteStates and DependsOn IDs that aren't in steps refer to state created by
+// an earlier run and are ignored, but outputs must come from a task in steps.
+func NewGraph(steps []Step) (*Graph, error) {
+	g := &Graph{byID: make(map[string]*node)}
+	for _, s := range steps {
+		for _, t := range s {
+			id := taskID(t)
+			if _, ok := g.byID[id]; ok {
+				return nil, errors.Errorf("Duplicate task ID %s", id)
+			}
+			n := &node{id: id, task: t}
+			g.nodes = append(g.nodes, n)
+			g.byID[id] = n
+		}
+	}
+	for _, n := range g.nodes {
+		for _, id := range taskDependencies(n.task) {
+			dep, ok := g.byID[id]
+			if !ok || dep == n {
+				continue
+			}
+			n.addDep(dep)
+		}
+		t, ok := n.task.(*TerraformModule)
+		if !ok {
+			continue
+		}
+		for _, name := range outputRefs(t.Variables) {
+			dep := g.refNode(n.id, name)
+			if dep == nil {
+				return nil, errors.Errorf("%s references unknown task %s", n.id, name)
+			}
+			if dep != n {
+				n.addDep(dep)
+			}
+		}
+	}
+	if err := g.checkCycles(); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// addDep adds a dependency, once
+func (n *node) addDep(dep *node) {
+	for _, d := range n.deps {
+		if d == dep {
+			return
+		}
+	}
+	n.deps = append(n.deps, dep)
+	dep.dependents = append(dep.dependents, n)
+}
+
+// dependencies returns the IDs of the tasks a task depends on
+func (g *Graph) dependencies(task Task) []string {
+	n, ok := g.byID[taskID(task)]
+	if !ok {
+		return nil
+	}
+	ids := make([]string, len(n.deps))
+	for i, d := range n.deps {
+		ids[i] = d.id
+	}
+	return ids
+}
+
+// Tasks returns every task in the graph
+func (g *Graph) Tasks() []Task {
+	tasks := make([]Task, len(g.nodes))
+	for i, n := range g.nodes {
+		tasks[i] = n.task
+	}
+	return tasks
+}
+
+// checkCycles returns an error describing the first dependency cycle found
+func (g *Graph) checkCycles() error {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[*node]int)
+	var path []string
+	var visit func(n *node) error
+	visit = func(n *node) error {
+		switch state[n] {
+		case visited:
+			return nil
+		case visiting:
+			for i, id := range path {
+				if id == n.id {
+					return errors.Errorf("Dependency cycle: %s", strings.Join(append(path[i:], n.id), " -> "))
+				}
+			}
+		}
+		state[n] = visiting
+		path = append(path, n.id)
+		for _, d := range n.deps {
+			if err := visit(d); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		state[n] = visited
+		return nil
+	}
+	for _, n := range g.nodes {
+		if err := visit(n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walk calls fn on each task as soon as all of its dependencies have returned,
+// running at most o.Concurrency tasks at a time. In reverse, a task is only
+// visited once every task depending on it has returned. Once a task fails or
+// the context is cancelled no new tasks are started; running tasks are waited
+// for and all errors collected.
+func (g *Graph) walk(ctx context.Context, o Options, reverse bool, fn func(Task) error) error {
+	return g.run(ctx, o, reverse, false, fn)
+}
+
+// walkAll is walk, but a failed task only stops the tasks that depend on it,
+// or in reverse the tasks it depends on. Independent tasks carry on, so
+// every problem is found in one go.
+func (g *Graph) walkAll(ctx context.Context, o Options, reverse bool, fn func(Task) error) error {
+	return g.run(ctx, o, reverse, true, fn)
+}
+
+func (g *Graph) run(ctx context.Context, o Options, reverse, keepGoing bool, fn func(Task) error) error {
+	type result struct {
+		n   *node
+		err error
+	}
+	remaining := make(map[*node]int)
+	var ready []*node
+	for _, n := range g.nodes {
+		remaining[n] = len(n.deps)
+		if reverse {
+			remaining[n] = len(n.dependents)
+		}
+		if remaining[n] == 0 {
+			ready = append(ready, n)
+		}
+	}
+
+	done := make(chan result)
+	running := 0
+	started := make(map[*node]bool)
+	var errs Errors
+	for {
+		for (keepGoing || len(errs) == 0) && ctx.Err() == nil && len(ready) > 0 && (o.Concurrency < 1 || running < o.Concurrency) {
+			n := ready[0]
+			ready = ready[1:]
+			running++
+			started[n] = true
+			go func(n *node) {
+				done <- result{n: n, err: fn(n.task)}
+			}(n)
+		}
+		if running == 0 {
+			break
+		}
+		r := <-done
+		running--
+		if r.err != nil {
+			errs = append(errs, errors.Wrap(r.err, taskName(r.n.task)))
+			continue
+		}
+		next := r.n.dependents
+		if reverse {
+			next = r.n.deps
+		}
+		for _, n := range next {
+			remaining[n]--
+			if remaining[n] == 0 {
+				ready = append(ready, n)
+			}
+		}
+	}
+	if len(errs) > 0 {
+		if keepGoing && ctx.Err() == nil {
+			for _, n := range g.nodes {
+				if !started[n] {
+					logf(ctx, n.task, "Skipped, as a task it needs failed")
+				}
+			}
+		}
+		return errs
+	}
+	if len(started) < len(g.nodes) && ctx.Err() != nil {
+		return errors.Wrap(ctx.Err(), "Interrupted, no further tasks were started")
+	}
+	return nil
+}
+
+// taskID returns the persistent ID of a task
+func taskID(task Task) string {
+	switch t := task.(type) {
+	case *TerraformModule:
+		return t.ID
+	case *RemoteState:
+		return t.ID
+	case *Noop:
+		return t.ID
+	default:
+		return fmt.Sprintf("%T-%p", task, task)
+	}
+}
+
+// taskDependencies returns the IDs of the tasks a task names in its
+// RemoteStates and DependsOn, sorted. Output references are resolved against
+// the graph, see Graph.refNode.
+func taskDependencies(task Task) []string {
+	var deps []string
+	switch t := task.(type) {
+	case *TerraformModule:
+		for _, id := range t.RemoteStates {
+			deps = append(deps, id)
+		}
+		deps = append(deps, t.DependsOn...)
+	}
+	sort.Strings(deps)
+	return deps
+}
@@ -0,0 +1,121 @@
+package infra
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestGraphCycle(t *testing.T) {
+	steps := []Step{{
+		&TerraformModule{ID: "a", Name: "a", RemoteStates: map[string]string{"b": "b"}},
+		&TerraformModule{ID: "b", Name: "b", DependsOn: []string{"c"}},
+		&TerraformModule{ID: "c", Name: "c", DependsOn: []string{"a"}},
+	}}
+	_, err := NewGraph(steps)
+	if err == nil {
+		t.Fatal("Expected a dependency cycle error")
+	}
+	if !strings.Contains(err.Error(), "a -> b -> c -> a") {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestGraphWalkOrder(t *testing.T) {
+	steps := []Step{{
+		&TerraformModule{ID: "network", Name: "network", RemoteStates: map[string]string{"ns": "namespaces"}},
+		&TerraformModule{ID: "namespaces", Name: "namespaces", DependsOn: []string{"k8s", "elsewhere"}},
+		&TerraformModule{ID: "k8s", Name: "k8s"},
+	}}
+	g, err := NewGraph(steps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, reverse := range []bool{false, true} {
+		var (
+			mu    sync.Mutex
+			order []string
+		)
+		if err := g.walk(context.Background(), newOptions(Concurrency(0)), reverse, func(task Task) error {
+			mu.Lock()
+			order = append(order, taskID(task))
+			mu.Unlock()
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		expected := "k8s namespaces network"
+		if reverse {
+			expected = "network namespaces k8s"
+		}
+		if got := strings.Join(order, " "); got != expected {
+			t.Errorf("Expected order %q, got %q", expected, got)
+		}
+	}
+}
+
+func TestGraphWalkAllSkipsOnlyFailedBranch(t *testing.T) {
+	// a <- b <- c, and f <- e <- d on their own
+	steps := []Step{{
+		&TerraformModule{ID: "a", Name: "a"},
+		&TerraformModule{ID: "b", Name: "b", DependsOn: []string{"a"}},
+		&TerraformModule{ID: "c", Name: "c", DependsOn: []string{"b"}},
+		&TerraformModule{ID: "d", Name: "d", DependsOn: []string{"e"}},
+		&TerraformModule{ID: "e", Name: "e", DependsOn: []string{"f"}},
+		&TerraformModule{ID: "f", Name: "f"},
+	}}
+	g, err := NewGraph(steps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, reverse := range []bool{false, true} {
+		var (
+			mu  sync.Mutex
+			ran = map[string]bool{}
+		)
+		err := g.walkAll(context.Background(), newOptions(Concurrency(1)), reverse, func(task Task) error {
+			mu.Lock()
+			ran[taskID(task)] = true
+			mu.Unlock()
+			if taskID(task) == "b" {
+				return errors.New("failed")
+			}
+			return nil
+		})
+		errs, ok := err.(Errors)
+		if !ok || len(errs) != 1 || !strings.Contains(errs[0].Error(), "failed") {
+			t.Fatalf("Expected b's error, got %v", err)
+		}
+		skipped, other := "c", "a"
+		if reverse {
+			skipped, other = "a", "c"
+		}
+		for _, id := range []string{other, "d", "e", "f"} {
+			if !ran[id] {
+				t.Errorf("Expected %s to run, reverse %v", id, reverse)
+			}
+		}
+		if ran[skipped] {
+			t.Errorf("Expected %s to be skipped, reverse %v", skipped, reverse)
+		}
+	}
+}
+
+func TestPlatformGraph(t *testing.T) {
+	p := &Platform{Name: "micro", Domain: "micro.mu", Kv: "cloudflare"}
+	p.Regions = append(p.Regions, Region{Provider: "do", Region: "lon1"})
+	steps, err := p.Steps()
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := NewGraph(steps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := g.byID["micro-lon1-do-namespaces"]
+	if len(n.deps) != 1 || n.deps[0].id != "micro-lon1-do-kubeconfig" {
+		t.Errorf("Expected namespaces to depend on the kubeconfig, got %v", n.deps)
+	}
+}
@@ -0,0 +1,100 @@
+package infra
+
+import (
+	"fmt"
+	"io/fs"
+
+	"github.com/pkg/errors"
+)
+
+// gslbIngress is the resource service whose load balancer the GSLB sends each
+// region's traffic to
+const gslbIngress = "ingress-haproxy"
+
+// cloudflareRegions maps cloud provider regions to the nearest Cloudflare
+// region, so the GSLB can steer traffic to the closest one. Regions that
+// aren't listed are only in the default pools.
+var cloudflareRegions = map[string]string{
+	// DigitalOcean
+	"ams3": "WEU",
+	"blr1": "SAS",
+	"fra1": "WEU",
+	"lon1": "WEU",
+	"nyc1": "ENAM",
+	"nyc3": "ENAM",
+	"sfo2": "WNAM",
+	"sfo3": "WNAM",
+	"sgp1": "SEAS",
+	"tor1": "ENAM",
+	// AWS
+	"ap-northeast-1": "NEAS",
+	"ap-south-1":     "SAS",
+	"ap-southeast-1": "SEAS",
+	"ap-southeast-2": "OC",
+	"eu-central-1":   "WEU",
+	"eu-west-1":      "WEU",
+	"eu-west-2":      "WEU",
+	"sa-east-1":      "SSAM",
+	"us-east-1":      "ENAM",
+	"us-east-2":      "ENAM",
+	"us-west-1":      "WNAM",
+	"us-west-2":      "WNAM",
+	// Azure
+	"australiaeast": "OC",
+	"eastus":        "ENAM",
+	"eastus2":       "ENAM",
+	"japaneast":     "NEAS",
+	"northeurope":   "WEU",
+	"southeastasia": "SEAS",
+	"uksouth":       "WEU",
+	"ukwest":        "WEU",
+	"westeurope":    "WEU",
+	"westus":        "WNAM",
+	"westus2":       "WNAM",
+}
+
+// gslbStep returns the step that load balances the platform's services across
+// every region, once they're all up. Each region's ingress address is read
+// from the outputs of its resource module, and a service is only balanced to
+// the regions whose network services include it.
+func (p *Platform) gslbStep(runID int32, network map[string]interface{}) (Step, error) {
+	if fi, err := fs.Stat(modules, "gslb/"+p.Gslb); err != nil || !fi.IsDir() {
+		return nil, errors.Errorf("Unknown gslb %s", p.Gslb)
+	}
+	regions := make(map[string]interface{})
+	geo := make(map[string]interface{})
+	var dependsOn []string
+	for _, r := range p.Regions {
+		prefix := p.Name + "-" + r.Region + "-" + r.Provider
+		slug := r.Region + "-" + r.Provider
+		regions[slug] = "${task." + prefix + "-resource.ingress_address}"
+		if p.Gslb == "cloudflare" {
+			if cf, ok := cloudflareRegions[r.Region]; ok {
+				geo[slug] = cf
+			}
+		}
+		dependsOn = append(dependsOn, prefix+"-network")
+	}
+	vars := map[string]interface{}{
+		"global_domain_name": p.Domain,
+		"regions":            regions,
+		"region_services":    network,
+	}
+	if p.Gslb == "cloudflare" {
+		vars["cloudflare_regions"] = geo
+	}
+	if err := p.setSecrets("embed://gslb/"+p.Gslb, vars); err != nil {
+		return nil, err
+	}
+	return Step{
+		&TerraformModule{
+			ID:        p.Name + "-global-gslb",
+			Name:      p.Name + "-global-gslb",
+			Source:    "embed://gslb/" + p.Gslb,
+			Path:      fmt.Sprintf("/tmp/%s-%d", p.Name+"-gslb", runID),
+			Variables: vars,
+			// Every region must be serving before traffic is sent to it
+			DependsOn: dependsOn,
+		},
+	}, nil
+}
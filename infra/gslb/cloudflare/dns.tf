@@ -1,5 +1,7 @@
 provider "cloudflare" {
-  version = "~> 2.3"
+  version    = "~> 2.3"
+  api_token  = var.cloudflare_api_token
+  account_id = var.cloudflare_account_id
 }
 
 data "cloudflare_zones" "micro" {
@@ -9,62 +11,46 @@ data "cloudflare_zones" "micro" {
   }
 }
 
-resource "cloudflare_record" "regional_api_a" {
-  count   = length(var.micro_ingress_address.ip4) > 0 ? 1 : 0
-  zone_id = data.cloudflare_zones.micro.zones[0].id
-  name    = "api-${var.region}.${var.regional_subdomain}"
-  value   = var.micro_ingress_address.ip4
-  type    = "A"
-  ttl     = 1
-  proxied = false
-}
-
-resource "cloudflare_record" "regional_api_aaaa" {
-  count   = length(var.micro_ingress_address.ip6) > 0 ? 1 : 0
-  zone_id = data.cloudflare_zones.micro.zones[0].id
-  name    = "api-${var.region}.${var.regional_subdomain}"
-  value   = var.micro_ingress_address.ip6
-  type    = "AAAA"
-  ttl     = 1
-  proxied = false
-}
-
-resource "cloudflare_record" "regional_api_cname" {
-  count   = length(var.micro_ingress_address.hostname) > 0 ? 1 : 0
-  zone_id = data.cloudflare_zones.micro.zones[0].id
-  name    = "api-${var.region}.${var.regional_subdomain}"
-  value   = var.micro_ingress_address.hostname
-  type    = "CNAME"
-  ttl     = 1
-  proxied = false
+locals {
+  // The services that are load balanced and deployed in at least one region
+  services = [
+    for s in var.services : s if contains(flatten(values(var.region_services)), s)
+  ]
+  // Every load balanced service in each region that deploys it, e.g. api-lon1-do
+  origins = {
+    for pair in setproduct(local.services, keys(var.regions)) : "${pair[0]}-${pair[1]}" => {
+      service = pair[0]
+      region  = pair[1]
+    } if contains(lookup(var.region_services, pair[1], []), pair[0])
+  }
 }
 
-resource "cloudflare_record" "regional_web_a" {
-  count   = length(var.micro_ingress_address.ip4) > 0 ? 1 : 0
-  zone_id = data.cloudflare_zones.micro.zones[0].id
-  name    = "web-${var.region}.${var.regional_subdomain}"
-  value   = var.micro_ingress_address.ip4
-  type    = "A"
-  ttl     = 1
-  proxied = false
+resource "cloudflare_record" "regional_a" {
+  for_each = { for k, o in local.origins : k => o if length(var.regions[o.region].ip4) > 0 }
+  zone_id  = data.cloudflare_zones.micro.zones[0].id
+  name     = "${each.key}.${var.regional_subdomain}"
+  value    = var.regions[each.value.region].ip4
+  type     = "A"
+  ttl      = 1
+  proxied  = false
 }
 
-resource "cloudflare_record" "regional_web_aaaa" {
-  count   = length(var.micro_ingress_address.ip6) > 0 ? 1 : 0
-  zone_id = data.cloudflare_zones.micro.zones[0].id
-  name    = "web-${var.region}.${var.regional_subdomain}"
-  value   = var.micro_ingress_address.ip6
-  type    = "AAAA"
-  ttl     = 1
-  proxied = false
+resource "cloudflare_record" "regional_aaaa" {
+  for_each = { for k, o in local.origins : k => o if length(var.regions[o.region].ip6) > 0 }
+  zone_id  = data.cloudflare_zones.micro.zones[0].id
+  name     = "${each.key}.${var.regional_subdomain}"
+  value    = var.regions[each.value.region].ip6
+  type     = "AAAA"
+  ttl      = 1
+  proxied  = false
 }
 
-resource "cloudflare_record" "regional_web_cname" {
-  count   = length(var.micro_ingress_address.hostname) > 0 ? 1 : 0
-  zone_id = data.cloudflare_zones.micro.zones[0].id
-  name    = "web-${var.region}.${var.regional_subdomain}"
-  value   = var.micro_ingress_address.hostname
-  type    = "CNAME"
-  ttl     = 1
-  proxied = false
+resource "cloudflare_record" "regional_cname" {
+  for_each = { for k, o in local.origins : k => o if length(var.regions[o.region].hostname) > 0 }
+  zone_id  = data.cloudflare_zones.micro.zones[0].id
+  name     = "${each.key}.${var.regional_subdomain}"
+  value    = var.regions[each.value.region].hostname
+  type     = "CNAME"
+  ttl      = 1
+  proxied  = false
 }
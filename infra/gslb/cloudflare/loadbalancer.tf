@@ -1 +1,66 @@
-// TODO
+// Each service is health checked in every region through its regional record,
+// with the service's global hostname so the ingress routes the check to it
+resource "cloudflare_load_balancer_monitor" "service" {
+  for_each       = toset(local.services)
+  description    = "${each.key}.${var.global_domain_name}"
+  type           = "https"
+  method         = "GET"
+  path           = var.health_check_path
+  expected_codes = var.health_check_expected_codes
+  interval       = 60
+  retries        = 2
+  timeout        = 5
+
+  header {
+    header = "Host"
+    values = ["${each.key}.${var.global_domain_name}"]
+  }
+}
+
+resource "cloudflare_load_balancer_pool" "region" {
+  for_each = local.origins
+  name     = "${replace(var.global_domain_name, ".", "-")}-${each.key}"
+  monitor  = cloudflare_load_balancer_monitor.service[each.value.service].id
+
+  origins {
+    name    = each.value.region
+    address = "${each.key}.${var.regional_subdomain}.${var.global_domain_name}"
+    enabled = true
+  }
+}
+
+locals {
+  // The pools of each service, in every region that deploys it
+  service_pools = {
+    for s in local.services : s => [
+      for k, o in local.origins : cloudflare_load_balancer_pool.region[k].id if o.service == s
+    ]
+  }
+  // The pools of each service grouped by the cloudflare region they're in, for
+  // geo-steering. Cloudflare regions without a region deploying the service are left out.
+  region_pools = {
+    for s in local.services : s => {
+      for r, cf in var.cloudflare_regions : cf => cloudflare_load_balancer_pool.region["${s}-${r}"].id...
+      if contains(keys(local.origins), "${s}-${r}")
+    }
+  }
+}
+
+resource "cloudflare_load_balancer" "service" {
+  for_each         = toset(local.services)
+  zone_id          = data.cloudflare_zones.micro.zones[0].id
+  name             = "${each.key}.${var.global_domain_name}"
+  description      = "micro ${each.key} across every region"
+  default_pool_ids = local.service_pools[each.key]
+  fallback_pool_id = local.service_pools[each.key][0]
+  steering_policy  = "geo"
+  proxied          = false
+
+  dynamic "region_pools" {
+    for_each = local.region_pools[each.key]
+    content {
+      region   = region_pools.key
+      pool_ids = region_pools.value
+    }
+  }
+}
@@ -1,26 +1,44 @@
-variable "micro_ingress_address" {
+variable "regions" {
   description = <<-EOD
-  An object describing the Kubernetes ingress service address.
-  For Example: 
+  The address of each region's ingress, keyed by region slug.
+  For Example:
     {
-      "ip4" = "10.20.30.40"
-      "ip6" = "2001:db8::1"
-      "hostname" = "aws-ingress.amazonaws.com"
+      "lon1-do" = {
+        "ip4" = "10.20.30.40"
+        "ip6" = ""
+        "hostname" = ""
+      }
+      "eu-west-2-aws" = {
+        "ip4" = ""
+        "ip6" = ""
+        "hostname" = "aws-ingress.amazonaws.com"
+      }
     }
   At least one attribute must be set, setting multiple creates more records
   EOD
-  type = object({
+  type = map(object({
     ip4      = string,
     ip6      = string,
     hostname = string,
-  })
-  default = {
-    // ip4   = "10.20.30.40",
-    // ip6   = "2001:db8::1",
-    ip4      = ""
-    ip6      = ""
-    hostname = "example.com",
-  }
+  }))
+}
+
+variable "cloudflare_regions" {
+  description = "Nearest cloudflare region of each region slug for geo-steering https://developers.cloudflare.com/load-balancing/understand-basics/traffic-steering/. Regions without one are only in the default pools"
+  type        = map(string)
+  default     = {}
+}
+
+variable "services" {
+  description = "Services to load balance across the regions, as <service>.<global_domain_name>"
+  type        = list(string)
+  default     = ["api", "web"]
+}
+
+variable "region_services" {
+  description = "The network services each region deploys, keyed by region slug. A service is only load balanced to the regions that deploy it"
+  type        = map(list(string))
+  default     = {}
 }
 
 variable "global_domain_name" {
@@ -35,14 +53,24 @@ variable "regional_subdomain" {
   default     = "cloud"
 }
 
-variable "region" {
-  description = "Human-readable region code (usually set to the same as whatever cloud provider you're using)"
+variable "health_check_path" {
+  description = "Path each service is health checked on in every region"
+  type        = string
+  default     = "/"
+}
+
+variable "health_check_expected_codes" {
+  description = "HTTP status codes of a healthy service, e.g. 2xx"
+  type        = string
+  default     = "2xx"
+}
+
+variable "cloudflare_account_id" {
+  description = "Cloudflare Account ID (For connecting to the Cloudflare API)"
   type        = string
-  default     = "lon1"
 }
 
-variable "nearest_cloudflare_region" {
-  description = "Nearest cloudflare region for geo-steering https://developers.cloudflare.com/load-balancing/understand-basics/traffic-steering/"
+variable "cloudflare_api_token" {
+  description = "Cloudflare API token (For connecting to the Cloudflare API)"
   type        = string
-  default     = "WEU"
 }
@@ -0,0 +1,89 @@
+package infra
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPlatformGslb(t *testing.T) {
+	p := &Platform{Name: "micro", Domain: "micro.mu", Gslb: "cloudflare", Kv: "cloudflare", Regions: []Region{
+		{Provider: "do", Region: "lon1", Network: []string{"registry", "web"}},
+		{Provider: "aws", Region: "eu-west-2", Network: []string{"api"}},
+		{Provider: "azure", Region: "somewhere"},
+	}}
+	steps, err := p.Steps()
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := steps[len(steps)-1]
+	if len(last) != 1 {
+		t.Fatalf("Expected the gslb to be the only task in the last step, got %v", last)
+	}
+	gslb := last[0].(*TerraformModule)
+	if gslb.ID != "micro-global-gslb" || gslb.Source != "embed://gslb/cloudflare" {
+		t.Fatalf("Unexpected gslb module %s %s", gslb.ID, gslb.Source)
+	}
+	expected := []string{"micro-lon1-do-network", "micro-eu-west-2-aws-network", "micro-somewhere-azure-network"}
+	if !reflect.DeepEqual(gslb.DependsOn, expected) {
+		t.Errorf("Expected the gslb to wait for every region, got %v", gslb.DependsOn)
+	}
+	geo := map[string]interface{}{"lon1-do": "WEU", "eu-west-2-aws": "WEU"}
+	if !reflect.DeepEqual(gslb.Variables["cloudflare_regions"], geo) {
+		t.Errorf("Expected cloudflare regions %v, got %v", geo, gslb.Variables["cloudflare_regions"])
+	}
+	services := gslb.Variables["region_services"].(map[string]interface{})
+	if !reflect.DeepEqual(services["lon1-do"], []string{"registry", "web"}) || !reflect.DeepEqual(services["eu-west-2-aws"], []string{"api"}) {
+		t.Errorf("Expected each region's network services, got %v", services)
+	}
+	if all := services["somewhere-azure"].([]string); len(all) != len(serviceNames(ServiceNetwork)) {
+		t.Errorf("Expected every network service in a region that doesn't list them, got %v", all)
+	}
+
+	// Each region's ingress address comes from its resource module
+	g, err := NewGraph(steps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addresses := map[string]interface{}{
+		"lon1-do":         map[string]interface{}{"ip4": "10.0.0.1", "ip6": "", "hostname": ""},
+		"eu-west-2-aws":   map[string]interface{}{"ip4": "", "ip6": "", "hostname": "elb.amazonaws.com"},
+		"somewhere-azure": map[string]interface{}{"ip4": "10.0.0.2", "ip6": "", "hostname": ""},
+	}
+	for _, task := range g.Tasks() {
+		m, ok := task.(*TerraformModule)
+		if !ok || moduleKind(m.ID) != "resource" {
+			continue
+		}
+		slug := strings.TrimSuffix(strings.TrimPrefix(m.ID, "micro-"), "-resource")
+		m.outputs = map[string]interface{}{"ingress_address": addresses[slug]}
+	}
+	if err := g.resolveOutputs(gslb); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gslb.Variables["regions"], addresses) {
+		t.Errorf("Expected regions %v, got %v", addresses, gslb.Variables["regions"])
+	}
+}
+
+func TestPlatformGslbErrors(t *testing.T) {
+	p := &Platform{Name: "micro", Gslb: "route53", Kv: "cloudflare", Regions: []Region{{Provider: "do", Region: "lon1"}}}
+	if _, err := p.Steps(); err == nil || !strings.Contains(err.Error(), "Unknown gslb route53") {
+		t.Errorf("Expected an unknown gslb error, got %v", err)
+	}
+	p.Gslb = "cloudflare"
+	p.Regions[0].Resource = []string{"cockroachdb", "etcd", "nats", "netdata"}
+	if _, err := p.Steps(); err == nil || !strings.Contains(err.Error(), "the gslb needs the ingress-haproxy resource") {
+		t.Errorf("Expected a missing ingress error, got %v", err)
+	}
+	p.Gslb = ""
+	steps, err := p.Steps()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range StateKeys(steps) {
+		if id == "micro-global-gslb" {
+			t.Error("Expected no gslb without the gslb field")
+		}
+	}
+}
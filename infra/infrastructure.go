@@ -2,95 +2,350 @@
 package infra
 
 import (
+	"context"
+	"sort"
 	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
 )
 
-// Task describes an individual task
+// Task describes an individual task. When the context is cancelled a task
+// should stop what it is doing as gracefully as it can and return.
 type Task interface {
-	Validate() error
-	Plan() error
-	Apply() error
-	Finalise() error
-	Destroy() error
+	Validate(ctx context.Context) error
+	Plan(ctx context.Context) error
+	Apply(ctx context.Context) error
+	Finalise(ctx context.Context) error
+	Destroy(ctx context.Context) error
 }
 
-// Step is a list of parallisable tasks
+// Step is a list of parallisable tasks. Steps group related tasks together,
+// the executor schedules each task as soon as its dependencies have completed.
 type Step []Task
 
-// ExecutePlan carries out a plan on steps
-func ExecutePlan(steps []Step) error {
-	for _, step := range steps {
-		for _, t := range step {
-			defer t.Finalise()
-			if err := t.Validate(); err != nil {
+// Errors is a list of errors returned by tasks run in parallel
+type Errors []error
+
+func (e Errors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// ExecutePlan carries out a plan on steps and reports the changes that
+// applying them would make. A failed module only stops the modules that
+// depend on it, and the report covers every module that was planned. Modules
+// using outputs of modules that haven't been applied yet can't be planned,
+// they're listed as deferred.
+//
+// Plan isn't entirely read-only: each cluster's kubeconfig module is applied,
+// writing the kubeconfig and its state, so the modules in the cluster can be
+// planned against it, and destroyed again once planning is done.
+func ExecutePlan(ctx context.Context, steps []Step, opts ...Option) (*PlanReport, error) {
+	o := newOptions(opts...)
+	ctx = o.context(ctx)
+	g, err := NewGraph(steps)
+	if err != nil {
+		return nil, err
+	}
+	o.configure(g)
+	for _, t := range g.Tasks() {
+		defer t.Finalise(ctx)
+	}
+	// The modules in a cluster are planned with its kubeconfig, so kubeconfigs
+	// are applied as they're reached, before the modules that depend on them,
+	// and destroyed once everything has been planned
+	var mu sync.Mutex
+	var kubeconfigs []*TerraformModule
+	defer func() {
+		for _, t := range kubeconfigs {
+			t.Variables["kubernetes"] = "none"
+			runPhase(ctx, t, PhaseDestroy, t.Destroy)
+		}
+	}()
+	var deferred []string
+	err = g.walkAll(ctx, o, false, func(t Task) error {
+		if err := g.resolveOutputs(t); err != nil {
+			if !isUnknownOutput(err) {
 				return err
 			}
+			// e.g. the gslb of a new platform needs every region's ingress
+			logf(ctx, t, "Not planned until the modules it uses are applied: %s", err)
+			mu.Lock()
+			deferred = append(deferred, taskID(t))
+			mu.Unlock()
+			return nil
+		}
+		if err := runPhase(ctx, t, PhaseValidate, t.Validate); err != nil {
+			return err
+		}
+		if isKubeconfig(t) {
+			mu.Lock()
+			kubeconfigs = append(kubeconfigs, t.(*TerraformModule))
+			mu.Unlock()
+			if err := runPhase(ctx, t, PhaseApply, t.Apply); err != nil {
+				return errors.Wrap(err, "Couldn't write the kubeconfig, the cluster may not have been applied yet")
+			}
+			return nil
+		}
+		return runPhase(ctx, t, PhasePlan, t.Plan)
+	})
+	sort.Strings(deferred)
+	report := &PlanReport{Deferred: deferred}
+	for _, task := range g.Tasks() {
+		switch t := task.(type) {
+		case *TerraformModule:
+			if p := t.PlanSummary(); p != nil {
+				report.Modules = append(report.Modules, *p)
+			}
 		}
 	}
-	return nil
+	return report, err
 }
 
 // ExecuteApply carries out an apply on steps
-func ExecuteApply(steps []Step) error {
-	for _, step := range steps {
-		for _, t := range step {
-			defer t.Finalise()
-			if err := t.Validate(); err != nil {
-				return err
+func ExecuteApply(ctx context.Context, steps []Step, opts ...Option) error {
+	o := newOptions(opts...)
+	ctx = o.context(ctx)
+	g, err := NewGraph(steps)
+	if err != nil {
+		return err
+	}
+	o.configure(g)
+	for _, t := range g.Tasks() {
+		defer t.Finalise(ctx)
+	}
+	if o.Resume && o.Journal == nil {
+		return errors.New("Can't resume without a journal")
+	}
+	var (
+		mu      sync.Mutex
+		created []Task
+		// Variables are resolved as tasks run, so find the references first
+		referenced = g.referenced()
+	)
+	err = g.walk(ctx, o, false, func(t Task) error {
+		if err := g.resolveOutputs(t); err != nil {
+			return err
+		}
+		if err := runPhase(ctx, t, PhaseValidate, t.Validate); err != nil {
+			return err
+		}
+		id := taskID(t)
+		var hash string
+		if o.Journal != nil {
+			if hash, err = taskHash(t); err != nil {
+				return errors.Wrap(err, "Couldn't hash task configuration")
 			}
-			if err := t.Apply(); err != nil {
-				return err
+			if o.Resume && o.Journal.Completed(id, hash) {
+				logf(ctx, t, "Already applied, skipping")
+				// Later tasks may still need its outputs
+				if m, ok := t.(*TerraformModule); ok && referenced[t] {
+					return m.readOutputs(ctx)
+				}
+				return nil
+			}
+		}
+		if o.Rollback {
+			isNew, err := taskIsNew(ctx, t)
+			if err != nil {
+				return errors.Wrap(err, "Couldn't check for existing state")
+			}
+			if isNew {
+				mu.Lock()
+				created = append(created, t)
+				mu.Unlock()
 			}
 		}
+		if o.Journal == nil {
+			return runPhase(ctx, t, PhaseApply, t.Apply)
+		}
+		if err := o.Journal.Record(id, hash, JournalStarted, nil); err != nil {
+			return errors.Wrap(err, "Couldn't write journal")
+		}
+		if err := runPhase(ctx, t, PhaseApply, t.Apply); err != nil {
+			o.Journal.Record(id, hash, JournalFailed, err)
+			return err
+		}
+		return o.Journal.Record(id, hash, JournalSucceeded, nil)
+	})
+	// Don't roll back if interrupted, the user asked us to stop
+	if err != nil && o.Rollback && ctx.Err() == nil {
+		return rollback(ctx, o, g, created, err)
 	}
-	return nil
+	return err
 }
 
 // ExecuteDestroy destroys steps
-func ExecuteDestroy(steps []Step) error {
+func ExecuteDestroy(ctx context.Context, steps []Step, opts ...Option) error {
+	o := newOptions(opts...)
+	ctx = o.context(ctx)
+	g, err := NewGraph(steps)
+	if err != nil {
+		return err
+	}
+	// Saved plans are for applying, not destroying
+	o.PlanDir = ""
+	o.configure(g)
+	for _, t := range g.Tasks() {
+		defer t.Finalise(ctx)
+	}
+
+	// Read the outputs that other tasks reference before anything is destroyed
+	referenced := g.referenced()
+	if len(referenced) > 0 {
+		if err := g.walk(ctx, o, false, func(task Task) error {
+			t, ok := task.(*TerraformModule)
+			if !ok || !referenced[task] || isKubeconfig(task) {
+				return nil
+			}
+			if err := g.resolveKnownOutputs(t); err != nil {
+				return err
+			}
+			if err := runPhase(ctx, t, PhaseValidate, t.Validate); err != nil {
+				return err
+			}
+			return t.readOutputs(ctx)
+		}); err != nil {
+			return err
+		}
+	}
+
 	// Find any kubeconfig steps; we need them to destroy the resources
-	for _, s := range steps {
-		for _, task := range s {
-			switch t := task.(type) {
-			case *TerraformModule:
-				if strings.Contains(t.Source, "kubeconfig") {
-					defer t.Finalise()
-					if err := t.Validate(); err != nil {
-						return err
-					}
-					if err := t.Apply(); err != nil {
-						return err
-					}
-					t.Variables["kubernetes"] = "none"
-					defer t.Destroy()
-				}
+	var kubeconfigs Step
+	for _, t := range g.Tasks() {
+		if isKubeconfig(t) {
+			kubeconfigs = append(kubeconfigs, t)
+		}
+	}
+	kg, err := NewGraph([]Step{kubeconfigs})
+	if err != nil {
+		return errors.Wrap(err, "kubeconfig graph failed")
+	}
+	if err := kg.walk(ctx, o, false, func(task Task) error {
+		if err := g.resolveOutputs(task); err != nil {
+			return err
+		}
+		if err := runPhase(ctx, task, PhaseValidate, task.Validate); err != nil {
+			return err
+		}
+		return runPhase(ctx, task, PhaseApply, task.Apply)
+	}); err != nil {
+		return err
+	}
+	for _, task := range kubeconfigs {
+		t := task.(*TerraformModule)
+		t.Variables["kubernetes"] = "none"
+		defer runPhase(ctx, t, PhaseDestroy, t.Destroy)
+	}
+
+	// Destroy everything else, dependents first. A failure only stops the
+	// modules it depends on from being destroyed.
+	return g.walkAll(ctx, o, true, func(task Task) error {
+		// Skip any kubeconfig steps
+		if isKubeconfig(task) {
+			return nil
+		}
+		if err := runPhase(ctx, task, PhaseValidate, task.Validate); err != nil {
+			return err
+		}
+		// A module with no state is already destroyed, e.g. by an earlier
+		// destroy that failed partway. The outputs it uses may be gone too.
+		if t, ok := task.(*TerraformModule); ok {
+			exists, err := t.Exists(ctx)
+			if err != nil {
+				return errors.Wrap(err, "Couldn't check for existing state")
+			}
+			if !exists {
+				logf(ctx, t, "No state, nothing to destroy")
+				return o.forget(task)
 			}
 		}
+		// Outputs of modules that are already destroyed are unknown
+		if err := g.resolveKnownOutputs(task); err != nil {
+			return err
+		}
+		if err := runPhase(ctx, task, PhaseDestroy, task.Destroy); err != nil {
+			return err
+		}
+		return o.forget(task)
+	})
+}
+
+// forget removes a destroyed task from the journal, if there is one
+func (o Options) forget(task Task) error {
+	if o.Journal == nil {
+		return nil
 	}
-	for i := len(steps) - 1; i >= 0; i-- {
-		for _, task := range steps[i] {
-			switch t := task.(type) {
-			case *TerraformModule:
-				// Skip any kubeconfig steps
-				if !strings.Contains(t.Source, "kubeconfig") {
-					defer t.Finalise()
-					if err := t.Validate(); err != nil {
-						return err
-					}
-					if err := t.Destroy(); err != nil {
-						return err
-					}
-				}
-			default:
-				defer t.Finalise()
-				if err := t.Validate(); err != nil {
-					return err
-				}
-				if err := t.Destroy(); err != nil {
-					return err
-				}
+	return o.Journal.Forget(taskID(task))
+}
+
+// context returns a context that sends events to the observers, if there are any
+func (o Options) context(ctx context.Context) context.Context {
+	if len(o.Observers) == 0 {
+		return ctx
+	}
+	return withObserver(ctx, Observers(o.Observers))
+}
+
+// configure applies the options that are set on each terraform module and
+// remote state check
+func (o Options) configure(g *Graph) {
+	for _, task := range g.Tasks() {
+		switch t := task.(type) {
+		case *TerraformModule:
+			// Kubeconfigs are written by plan as well as apply, so they're
+			// never applied from a saved plan
+			if len(o.PlanDir) != 0 && !isKubeconfig(t) {
+				t.PlanDir = o.PlanDir
+			}
+			if len(o.PlanKey) != 0 {
+				t.PlanKey = o.PlanKey
+			}
+			if o.InterruptTimeout != 0 {
+				t.InterruptTimeout = o.InterruptTimeout
+			}
+			if t.Timeout == 0 {
+				t.Timeout = o.Timeout
 			}
+			if o.RequireChecksum {
+				t.RequireChecksum = true
+			}
+			if len(o.GitCacheDir) != 0 {
+				t.GitCacheDir = o.GitCacheDir
+			}
+		case *RemoteState:
+			if o.StaleLockAge != 0 {
+				t.StaleLockAge = o.StaleLockAge
+			}
+			t.ForceUnlock = o.ForceUnlock
 		}
 	}
-	return nil
+}
+
+// isKubeconfig returns true for tasks that fetch a kubeconfig for later tasks
+func isKubeconfig(task Task) bool {
+	switch t := task.(type) {
+	case *TerraformModule:
+		return strings.Contains(t.Source, "kubeconfig")
+	default:
+		return false
+	}
+}
+
+// taskName returns the name of a task for logging purposes
+func taskName(task Task) string {
+	switch t := task.(type) {
+	case *TerraformModule:
+		return t.Name
+	case *RemoteState:
+		return t.Name
+	case *Noop:
+		return t.Name
+	default:
+		return "unknown task"
+	}
 }
@@ -0,0 +1,170 @@
+package infra
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingTask records how many tasks are applying at the same time
+type countingTask struct {
+	Noop
+	mu      *sync.Mutex
+	running *int
+	peak    *int
+	err     error
+}
+
+func (c *countingTask) Apply(ctx context.Context) error {
+	c.mu.Lock()
+	*c.running++
+	if *c.running > *c.peak {
+		*c.peak = *c.running
+	}
+	c.mu.Unlock()
+	time.Sleep(10 * time.Millisecond)
+	c.mu.Lock()
+	*c.running--
+	c.mu.Unlock()
+	return c.err
+}
+
+func TestExecuteApplyConcurrency(t *testing.T) {
+	var (
+		mu            sync.Mutex
+		running, peak int
+	)
+	var step Step
+	for i := 0; i < 6; i++ {
+		step = append(step, &countingTask{Noop: Noop{Name: "count"}, mu: &mu, running: &running, peak: &peak})
+	}
+	if err := ExecuteApply(context.Background(), []Step{step}, Concurrency(2)); err != nil {
+		t.Fatal(err)
+	}
+	if peak != 2 {
+		t.Errorf("Expected 2 tasks to run in parallel, got %d", peak)
+	}
+}
+
+func TestExecuteApplyCollectsErrors(t *testing.T) {
+	var (
+		mu            sync.Mutex
+		running, peak int
+	)
+	step := Step{
+		&countingTask{Noop: Noop{Name: "a"}, mu: &mu, running: &running, peak: &peak, err: errors.New("failed")},
+		&countingTask{Noop: Noop{Name: "b"}, mu: &mu, running: &running, peak: &peak},
+		&countingTask{Noop: Noop{Name: "c"}, mu: &mu, running: &running, peak: &peak, err: errors.New("failed")},
+	}
+	err := ExecuteApply(context.Background(), []Step{step, {&Noop{Name: "never"}}})
+	errs, ok := err.(Errors)
+	if !ok {
+		t.Fatalf("Expected Errors, got %v", err)
+	}
+	if len(errs) != 2 {
+		t.Errorf("Expected 2 errors, got %d", len(errs))
+	}
+}
+
+func TestExecuteApplyCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var (
+		mu            sync.Mutex
+		running, peak int
+	)
+	step := Step{&countingTask{Noop: Noop{Name: "a"}, mu: &mu, running: &running, peak: &peak}}
+	if err := ExecuteApply(ctx, []Step{step}); err == nil {
+		t.Error("Expected an error when the context is cancelled")
+	}
+	if peak != 0 {
+		t.Error("Expected no tasks to start once the context is cancelled")
+	}
+}
+
+// fakeTerraform is a terraform that keeps the state of each module, listed by
+// state list, in $FAKE_TERRAFORM_DIR/<module dir>.state, plans no changes and
+// records destroys
+const fakeTerraform = `#!/bin/sh
+name=$(basename "$PWD")
+case "$1" in
+state) cat "$FAKE_TERRAFORM_DIR/$name.state" 2>/dev/null ;;
+output) echo '{}' ;;
+show) echo '{"format_version":"0.1"}' ;;
+destroy) echo "$name $(tr -d ' \n' < micro-platform.auto.tfvars.json)" >> "$FAKE_TERRAFORM_DIR/destroyed" ;;
+esac
+exit 0
+`
+
+func TestExecuteDestroyRerun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "micro-platform-destroy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "terraform"), []byte(fakeTerraform), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	src := filepath.Join(dir, "src")
+	if err := os.MkdirAll(src, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "main.tf"), []byte(`variable "regions" {}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	os.Setenv("FAKE_TERRAFORM_DIR", dir)
+	defer os.Unsetenv("FAKE_TERRAFORM_DIR")
+
+	steps := func() []Step {
+		backend := &LocalBackend{Dir: filepath.Join(dir, "state")}
+		resource := &TerraformModule{ID: "micro-lon1-do-resource", Name: "resource", Source: src, Path: filepath.Join(dir, "resource"), Backend: backend}
+		gslb := &TerraformModule{
+			ID:        "micro-global-gslb",
+			Name:      "gslb",
+			Source:    src,
+			Path:      filepath.Join(dir, "gslb"),
+			Backend:   backend,
+			Variables: map[string]interface{}{"regions": map[string]interface{}{"lon1-do": "${task.micro-lon1-do-resource.ingress_address}"}},
+		}
+		return []Step{{resource}, {gslb}}
+	}
+	ctx := withObserver(context.Background(), &recordingObserver{})
+
+	// The resource module was destroyed by an earlier run, the gslb wasn't
+	if err := ioutil.WriteFile(filepath.Join(dir, "gslb.state"), []byte("cloudflare_load_balancer.service\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ExecuteDestroy(ctx, steps()); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadFile(filepath.Join(dir, "destroyed"))
+	if string(b) != `gslb {"regions":{"lon1-do":null}}`+"\n" {
+		t.Errorf("Expected only the gslb to be destroyed, with its unknown output null, got %q", b)
+	}
+
+	// Nothing is applied, so the gslb can't be planned yet
+	report, err := ExecutePlan(ctx, steps())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Modules) != 1 || len(report.Deferred) != 1 || report.Deferred[0] != "micro-global-gslb" {
+		t.Errorf("Expected the resource to be planned and the gslb deferred, got %+v", report)
+	}
+
+	// Everything was destroyed by an earlier run
+	os.Remove(filepath.Join(dir, "gslb.state"))
+	os.Remove(filepath.Join(dir, "destroyed"))
+	if err := ExecuteDestroy(ctx, steps()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "destroyed")); !os.IsNotExist(err) {
+		t.Error("Expected nothing to be destroyed")
+	}
+}
@@ -0,0 +1,117 @@
+package infra
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Task outcomes recorded in a journal
+const (
+	JournalStarted   = "started"
+	JournalSucceeded = "succeeded"
+	JournalFailed    = "failed"
+)
+
+// Journal records the outcome of every task that is applied, so that a failed
+// apply can be resumed from where it stopped. It is saved to disk after every change.
+type Journal struct {
+	path string
+	mu   sync.Mutex
+
+	Entries map[string]JournalEntry `json:"entries"`
+}
+
+// JournalEntry is the last recorded outcome of a task
+type JournalEntry struct {
+	ID string `json:"id"`
+	// Hash of the task's configuration when it was applied
+	Hash    string    `json:"hash"`
+	Status  string    `json:"status"`
+	Error   string    `json:"error,omitempty"`
+	Updated time.Time `json:"updated"`
+}
+
+// OpenJournal loads the journal at path, or starts a new one if it doesn't exist
+func OpenJournal(path string) (*Journal, error) {
+	j := &Journal{path: path, Entries: make(map[string]JournalEntry)}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return j, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, j); err != nil {
+		return nil, errors.Wrapf(err, "Invalid journal %s", path)
+	}
+	if j.Entries == nil {
+		j.Entries = make(map[string]JournalEntry)
+	}
+	return j, nil
+}
+
+// Completed returns true if the task was applied successfully with the same configuration
+func (j *Journal) Completed(id, hash string) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	e, ok := j.Entries[id]
+	return ok && len(hash) != 0 && e.Hash == hash && e.Status == JournalSucceeded
+}
+
+// Record saves the outcome of a task
+func (j *Journal) Record(id, hash, status string, err error) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	e := JournalEntry{ID: id, Hash: hash, Status: status, Updated: time.Now()}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	j.Entries[id] = e
+	return j.save()
+}
+
+// Forget removes a task from the journal, e.g. once it has been destroyed
+func (j *Journal) Forget(id string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	delete(j.Entries, id)
+	return j.save()
+}
+
+// save writes the journal to a temporary file then renames it, so a crash
+// never leaves a partially written journal behind
+func (j *Journal) save() error {
+	if err := os.MkdirAll(filepath.Dir(j.path), 0o700); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := j.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, j.path)
+}
+
+// taskHash returns a hash of a task's configuration once it has been
+// validated, or an empty string for tasks that should never be skipped
+func taskHash(task Task) (string, error) {
+	switch t := task.(type) {
+	case *TerraformModule:
+		// The kubeconfig is a local file needed by later tasks, it's always fetched.
+		// Dry runs don't apply anything, so there's nothing to skip next time.
+		if isKubeconfig(t) || t.DryRun {
+			return "", nil
+		}
+		return t.fingerprint()
+	default:
+		return "", nil
+	}
+}
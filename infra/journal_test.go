@@ -0,0 +1,52 @@
+package infra
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "micro-platform-journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "journal.json")
+
+	j, err := OpenJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := j.Record("k8s", "hash", JournalSucceeded, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.Record("namespaces", "hash", JournalFailed, errors.New("failed")); err != nil {
+		t.Fatal(err)
+	}
+
+	j, err = OpenJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !j.Completed("k8s", "hash") {
+		t.Error("Expected k8s to be completed")
+	}
+	if j.Completed("k8s", "changed") {
+		t.Error("Expected k8s with a different configuration not to be completed")
+	}
+	if j.Completed("namespaces", "hash") {
+		t.Error("Expected failed namespaces not to be completed")
+	}
+	if j.Completed("k8s", "") {
+		t.Error("Expected tasks without a hash never to be completed")
+	}
+	if err := j.Forget("k8s"); err != nil {
+		t.Fatal(err)
+	}
+	if j.Completed("k8s", "hash") {
+		t.Error("Expected forgotten k8s not to be completed")
+	}
+}
@@ -18,11 +18,16 @@ func (k *Kubernetes) Steps(runID int32) ([]Step, error) {
 	var s []Step
 	k8sName := k.internalName("k8s")
 	configName := k.internalName("kubeconfig")
-	vars := make(map[string]string)
-	vars["name"] = k.Name
-	vars["kubernetes"] = k.Provider
-	vars["region"] = k.Region
-	vars["args"] = fmt.Sprintf(`["%s","%s"]`, k8sName, viper.GetString("aws-region"))
+	// Each module has its own variables, as they're changed in place, e.g.
+	// when output references are resolved or the kubeconfig is destroyed
+	newVars := func() map[string]interface{} {
+		return map[string]interface{}{
+			"name":       k.Name,
+			"kubernetes": k.Provider,
+			"region":     k.Region,
+			"args":       []string{k8sName, viper.GetString("aws-region")},
+		}
+	}
 	remoteStates := make(map[string]string)
 	remoteStates["k8s"] = k8sName
 	s = append(s,
@@ -31,9 +36,9 @@ func (k *Kubernetes) Steps(runID int32) ([]Step, error) {
 			&TerraformModule{
 				ID:        k8sName,
 				Name:      k8sName,
-				Source:    "./infra/kubernetes/" + k.Provider,
+				Source:    "embed://kubernetes/" + k.Provider,
 				Path:      fmt.Sprintf("/tmp/%s-%d", k8sName, runID),
-				Variables: vars,
+				Variables: newVars(),
 			},
 		},
 		// Grab the Kubernetes Config
@@ -41,9 +46,9 @@ func (k *Kubernetes) Steps(runID int32) ([]Step, error) {
 			&TerraformModule{
 				ID:           configName,
 				Name:         configName,
-				Source:       "./infra/kubernetes/kubeconfig",
+				Source:       "embed://kubernetes/kubeconfig",
 				Path:         fmt.Sprintf("/tmp/%s-%d", configName, runID),
-				Variables:    vars,
+				Variables:    newVars(),
 				RemoteStates: remoteStates,
 			},
 		},
@@ -55,11 +60,11 @@ func (k *Kubernetes) Steps(runID int32) ([]Step, error) {
 func (k *Kubernetes) Config(runID int32, path string) ([]Step, error) {
 	k8sName := k.internalName("k8s")
 	configName := k.internalName("kubeconfig")
-	vars := make(map[string]string)
+	vars := make(map[string]interface{})
 	vars["name"] = k.Name
 	vars["kubernetes"] = k.Provider
 	vars["region"] = k.Region
-	vars["args"] = fmt.Sprintf(`["%s","%s"]`, k8sName, viper.GetString("aws-region"))
+	vars["args"] = []string{k8sName, viper.GetString("aws-region")}
 	vars["output_path"] = path
 	remoteStates := make(map[string]string)
 	remoteStates["k8s"] = k8sName
@@ -68,7 +73,7 @@ func (k *Kubernetes) Config(runID int32, path string) ([]Step, error) {
 			&TerraformModule{
 				ID:           configName,
 				Name:         configName,
-				Source:       "./infra/kubernetes/kubeconfig",
+				Source:       "embed://kubernetes/kubeconfig",
 				Path:         fmt.Sprintf("/tmp/%s-%d", configName, runID),
 				Variables:    vars,
 				RemoteStates: remoteStates,
@@ -1,3 +1,9 @@
+provider "cloudflare" {
+  version    = "~> 2.3"
+  api_token  = var.cloudflare_api_token
+  account_id = var.cloudflare_account_id
+}
+
 resource "random_id" "kv_identifier" {
   byte_length = 4
 }
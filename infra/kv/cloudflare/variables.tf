@@ -0,0 +1,9 @@
+variable "cloudflare_account_id" {
+  description = "Cloudflare Account ID (For connecting to the Cloudflare API)"
+  type        = string
+}
+
+variable "cloudflare_api_token" {
+  description = "Cloudflare API token (For connecting to the Cloudflare API)"
+  type        = string
+}
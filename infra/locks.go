@@ -0,0 +1,245 @@
+package infra
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/pkg/errors"
+)
+
+// DefaultStaleLockAge is how old a state lock must be before it's assumed to
+// have been left behind by a run that crashed
+const DefaultStaleLockAge = time.Hour
+
+// lockTableKey is the hash key terraform's s3 backend expects the lock table to have
+const lockTableKey = "LockID"
+
+// StateLock is a lock terraform holds on a module's state
+type StateLock struct {
+	// Path of the locked state, e.g. bucket/module-id
+	Path string `json:"-"`
+	// ID of the lock, as needed by terraform force-unlock
+	ID        string    `json:"ID"`
+	Operation string    `json:"Operation"`
+	Who       string    `json:"Who"`
+	Version   string    `json:"Version"`
+	Created   time.Time `json:"Created"`
+
+	// info is the lock as stored, so it's only deleted if it hasn't changed
+	info string
+}
+
+func (l *StateLock) String() string {
+	return fmt.Sprintf("%s locked by %s for %s at %s (lock ID %s)", l.Path, l.Who, l.Operation, l.Created.Format(time.RFC3339), l.ID)
+}
+
+// lockTable is the DynamoDB table terraform's s3 backend locks state with
+type lockTable struct {
+	client dynamodbiface.DynamoDBAPI
+	table  string
+	bucket string
+}
+
+// Validate checks the table exists with the LockID hash key terraform
+// expects, and that conditional writes work so only one run can hold a lock
+func (l *lockTable) Validate(ctx context.Context, id string) error {
+	out, err := l.client.DescribeTableWithContext(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(l.table)})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeResourceNotFoundException {
+			return errors.Errorf("The lock table %s doesn't exist", l.table)
+		}
+		return errors.Wrap(err, "Could not describe the lock table")
+	}
+	var hashKey string
+	for _, k := range out.Table.KeySchema {
+		if aws.StringValue(k.KeyType) == dynamodb.KeyTypeHash {
+			hashKey = aws.StringValue(k.AttributeName)
+		}
+	}
+	if hashKey != lockTableKey || len(out.Table.KeySchema) != 1 {
+		return errors.Errorf("The lock table %s must have the single hash key %s, it has %s", l.table, lockTableKey, hashKey)
+	}
+	for _, a := range out.Table.AttributeDefinitions {
+		if aws.StringValue(a.AttributeName) == lockTableKey && aws.StringValue(a.AttributeType) != dynamodb.ScalarAttributeTypeS {
+			return errors.Errorf("The %s key of the lock table %s must be a string", lockTableKey, l.table)
+		}
+	}
+
+	// Take a lock on a key no module uses, the same way terraform does
+	key := map[string]*dynamodb.AttributeValue{
+		lockTableKey: {S: aws.String(l.bucket + "/" + id + "-lock-check")},
+	}
+	item := map[string]*dynamodb.AttributeValue{
+		lockTableKey: key[lockTableKey],
+		"Info":       {S: aws.String(id)},
+	}
+	put := &dynamodb.PutItemInput{
+		TableName:           aws.String(l.table),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(LockID)"),
+	}
+	if _, err := l.client.PutItemWithContext(ctx, put); err != nil {
+		return errors.Wrap(err, "Could not put a lock in to the lock table")
+	}
+	_, err = l.client.PutItemWithContext(ctx, put)
+	if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != dynamodb.ErrCodeConditionalCheckFailedException {
+		l.client.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{TableName: aws.String(l.table), Key: key})
+		if err == nil {
+			return errors.New("Took the same lock twice, state locking won't work")
+		}
+		return errors.Wrap(err, "Unexpected error taking a held lock")
+	}
+	if _, err := l.client.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+		TableName:           aws.String(l.table),
+		Key:                 key,
+		ConditionExpression: aws.String("attribute_exists(LockID)"),
+	}); err != nil {
+		return errors.Wrap(err, "Could not delete a lock from the lock table")
+	}
+	return nil
+}
+
+// Locks returns the locks held on state in the bucket
+func (l *lockTable) Locks(ctx context.Context) ([]*StateLock, error) {
+	var locks []*StateLock
+	input := &dynamodb.ScanInput{
+		TableName: aws.String(l.table),
+		// Terraform also stores digests of each state in the table, they have no Info
+		FilterExpression:          aws.String("begins_with(LockID, :bucket) AND attribute_exists(Info)"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":bucket": {S: aws.String(l.bucket + "/")}},
+	}
+	for {
+		out, err := l.client.ScanWithContext(ctx, input)
+		if err != nil {
+			return nil, errors.Wrap(err, "Could not scan the lock table")
+		}
+		for _, item := range out.Items {
+			lock := &StateLock{
+				Path: aws.StringValue(item[lockTableKey].S),
+				info: aws.StringValue(item["Info"].S),
+			}
+			if err := json.Unmarshal([]byte(lock.info), lock); err != nil {
+				lock.ID = "unknown"
+				lock.Who = "unknown"
+			}
+			locks = append(locks, lock)
+		}
+		if len(out.LastEvaluatedKey) == 0 {
+			return locks, nil
+		}
+		input.ExclusiveStartKey = out.LastEvaluatedKey
+	}
+}
+
+// Lock takes a lock on the state at lock.Path, failing if it's already held
+func (l *lockTable) Lock(ctx context.Context, lock *StateLock) error {
+	info, err := json.Marshal(lock)
+	if err != nil {
+		return err
+	}
+	_, err = l.client.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(l.table),
+		Item: map[string]*dynamodb.AttributeValue{
+			lockTableKey: {S: aws.String(lock.Path)},
+			"Info":       {S: aws.String(string(info))},
+		},
+		ConditionExpression: aws.String("attribute_not_exists(LockID)"),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return errors.Errorf("The state %s is locked, another run may be in progress", lock.Path)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "Could not lock %s", lock.Path)
+	}
+	lock.info = string(info)
+	return nil
+}
+
+// SetDigest records the MD5 digest of the state at path, which terraform
+// checks the state it reads against. A nil state removes the digest.
+func (l *lockTable) SetDigest(ctx context.Context, path string, state []byte) error {
+	key := map[string]*dynamodb.AttributeValue{lockTableKey: {S: aws.String(path + "-md5")}}
+	var err error
+	if state == nil {
+		_, err = l.client.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{TableName: aws.String(l.table), Key: key})
+	} else {
+		key["Digest"] = &dynamodb.AttributeValue{S: aws.String(fmt.Sprintf("%x", md5.Sum(state)))}
+		_, err = l.client.PutItemWithContext(ctx, &dynamodb.PutItemInput{TableName: aws.String(l.table), Item: key})
+	}
+	return errors.Wrapf(err, "Could not update the digest of %s", path)
+}
+
+// Unlock deletes a lock, as long as it hasn't been released and taken again
+func (l *lockTable) Unlock(ctx context.Context, lock *StateLock) error {
+	_, err := l.client.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(l.table),
+		Key: map[string]*dynamodb.AttributeValue{
+			lockTableKey: {S: aws.String(lock.Path)},
+		},
+		ConditionExpression:       aws.String("Info = :info"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":info": {S: aws.String(lock.info)}},
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return errors.Errorf("The lock on %s changed, not unlocking it", lock.Path)
+	}
+	return err
+}
+
+// checkLocks reports locks on the platform's state, the keys with one of
+// StatePrefixes. Locks older than StaleLockAge are stale; they're removed if
+// ForceUnlock is set, otherwise they're an error, as every run would fail to take them.
+func (r *RemoteState) checkLocks(ctx context.Context, l *lockTable) error {
+	locks, err := l.Locks(ctx)
+	if err != nil {
+		return err
+	}
+	maxAge := r.StaleLockAge
+	if maxAge == 0 {
+		maxAge = DefaultStaleLockAge
+	}
+	var stale []string
+	for _, lock := range locks {
+		if !r.ownsLock(l, lock) {
+			continue
+		}
+		if time.Since(lock.Created) < maxAge {
+			logf(ctx, r, "State is locked, another run may be in progress: %s", lock)
+			continue
+		}
+		if !r.ForceUnlock {
+			stale = append(stale, lock.String())
+			continue
+		}
+		if err := l.Unlock(ctx, lock); err != nil {
+			return errors.Wrapf(err, "Could not force unlock %s", lock.Path)
+		}
+		logf(ctx, r, "Force unlocked stale lock: %s", lock)
+	}
+	if len(stale) > 0 {
+		return errors.Errorf("Found stale state locks, left behind by runs that crashed or were killed:\n%s\nCheck nothing is running, then rerun with --force-unlock to remove them",
+			strings.Join(stale, "\n"))
+	}
+	return nil
+}
+
+// ownsLock returns true if the lock is on a state key with one of StatePrefixes
+func (r *RemoteState) ownsLock(l *lockTable, lock *StateLock) bool {
+	if len(r.StatePrefixes) == 0 {
+		return true
+	}
+	key := strings.TrimPrefix(lock.Path, l.bucket+"/")
+	for _, prefix := range r.StatePrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,129 @@
+package infra
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// fakeLockTable implements the DynamoDB calls the lock checks make
+type fakeLockTable struct {
+	dynamodbiface.DynamoDBAPI
+	hashKey string
+	items   map[string]map[string]*dynamodb.AttributeValue
+	// ignoreConditions makes conditional puts always succeed
+	ignoreConditions bool
+}
+
+func (f *fakeLockTable) DescribeTableWithContext(ctx aws.Context, in *dynamodb.DescribeTableInput, opts ...request.Option) (*dynamodb.DescribeTableOutput, error) {
+	return &dynamodb.DescribeTableOutput{Table: &dynamodb.TableDescription{
+		KeySchema:            []*dynamodb.KeySchemaElement{{AttributeName: aws.String(f.hashKey), KeyType: aws.String(dynamodb.KeyTypeHash)}},
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{{AttributeName: aws.String(f.hashKey), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)}},
+	}}, nil
+}
+
+func (f *fakeLockTable) PutItemWithContext(ctx aws.Context, in *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error) {
+	id := aws.StringValue(in.Item[lockTableKey].S)
+	if _, ok := f.items[id]; ok && !f.ignoreConditions {
+		return nil, awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "exists", nil)
+	}
+	f.items[id] = in.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (f *fakeLockTable) DeleteItemWithContext(ctx aws.Context, in *dynamodb.DeleteItemInput, opts ...request.Option) (*dynamodb.DeleteItemOutput, error) {
+	id := aws.StringValue(in.Key[lockTableKey].S)
+	item, ok := f.items[id]
+	if info, set := in.ExpressionAttributeValues[":info"]; set && (!ok || aws.StringValue(item["Info"].S) != aws.StringValue(info.S)) {
+		return nil, awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "changed", nil)
+	}
+	delete(f.items, id)
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+
+func (f *fakeLockTable) ScanWithContext(ctx aws.Context, in *dynamodb.ScanInput, opts ...request.Option) (*dynamodb.ScanOutput, error) {
+	prefix := aws.StringValue(in.ExpressionAttributeValues[":bucket"].S)
+	out := &dynamodb.ScanOutput{}
+	for id, item := range f.items {
+		if _, ok := item["Info"]; ok && strings.HasPrefix(id, prefix) {
+			out.Items = append(out.Items, item)
+		}
+	}
+	return out, nil
+}
+
+func (f *fakeLockTable) lock(path, who string, created time.Time) {
+	info, _ := json.Marshal(StateLock{ID: "lock-" + who, Operation: "OperationTypeApply", Who: who, Created: created})
+	f.items[path] = map[string]*dynamodb.AttributeValue{
+		lockTableKey: {S: aws.String(path)},
+		"Info":       {S: aws.String(string(info))},
+	}
+}
+
+func TestLockTableValidate(t *testing.T) {
+	ctx := context.Background()
+	fake := &fakeLockTable{hashKey: lockTableKey, items: make(map[string]map[string]*dynamodb.AttributeValue)}
+	l := &lockTable{client: fake, table: "lock", bucket: "state"}
+	if err := l.Validate(ctx, "check"); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.items) != 0 {
+		t.Errorf("Expected the check lock to be removed, got %v", fake.items)
+	}
+
+	fake.ignoreConditions = true
+	if err := l.Validate(ctx, "check"); err == nil || !strings.Contains(err.Error(), "state locking won't work") {
+		t.Errorf("Expected a locking error, got %v", err)
+	}
+
+	fake.hashKey = "id"
+	if err := l.Validate(ctx, "check"); err == nil || !strings.Contains(err.Error(), "must have the single hash key LockID") {
+		t.Errorf("Expected a hash key error, got %v", err)
+	}
+}
+
+func TestCheckLocks(t *testing.T) {
+	ctx := withObserver(context.Background(), &recordingObserver{})
+	fake := &fakeLockTable{hashKey: lockTableKey, items: make(map[string]map[string]*dynamodb.AttributeValue)}
+	l := &lockTable{client: fake, table: "lock", bucket: "state"}
+	fake.lock("state/micro-lon1-do-k8s", "crashed@ci", time.Now().Add(-3*time.Hour))
+	fake.lock("state/micro-lon1-do-network", "running@laptop", time.Now().Add(-time.Minute))
+	fake.lock("other/micro-lon1-do-k8s", "other@ci", time.Now().Add(-3*time.Hour))
+	// Another platform sharing the bucket
+	fake.lock("state/micro-staging-lon1-do-k8s", "staging@ci", time.Now().Add(-3*time.Hour))
+	// Digests aren't locks
+	fake.items["state/micro-lon1-do-k8s-md5"] = map[string]*dynamodb.AttributeValue{
+		lockTableKey: {S: aws.String("state/micro-lon1-do-k8s-md5")},
+		"Digest":     {S: aws.String("abc")},
+	}
+
+	r := &RemoteState{ID: "check", Name: "check", StatePrefixes: []string{"micro-global-", "micro-lon1-do-"}}
+	err := r.checkLocks(ctx, l)
+	if err == nil || !strings.Contains(err.Error(), "state/micro-lon1-do-k8s locked by crashed@ci") {
+		t.Fatalf("Expected a stale lock error, got %v", err)
+	}
+	if strings.Contains(err.Error(), "running@laptop") || strings.Contains(err.Error(), "other@ci") || strings.Contains(err.Error(), "staging@ci") {
+		t.Errorf("Expected only the stale lock on this bucket to be reported, got %v", err)
+	}
+
+	r.ForceUnlock = true
+	if err := r.checkLocks(ctx, l); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fake.items["state/micro-lon1-do-k8s"]; ok {
+		t.Error("Expected the stale lock to be removed")
+	}
+	for _, id := range []string{"state/micro-lon1-do-network", "other/micro-lon1-do-k8s", "state/micro-lon1-do-k8s-md5", "state/micro-staging-lon1-do-k8s"} {
+		if _, ok := fake.items[id]; !ok {
+			t.Errorf("Expected %s to be left alone", id)
+		}
+	}
+}
@@ -0,0 +1,413 @@
+package infra
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/user"
+	"path/filepath"
+	"reflect"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+)
+
+// StateMover is a state store states can be migrated to and from
+type StateMover interface {
+	StateStore
+	// LockState locks the state for key the way terraform does, so no run can
+	// change it until it's unlocked. The state needn't exist yet.
+	LockState(ctx context.Context, key string, lock *StateLock) (LockedState, error)
+}
+
+// LockedState is a state locked by LockState
+type LockedState interface {
+	// WriteState replaces the state
+	WriteState(ctx context.Context, data []byte) error
+	// DeleteState deletes the state
+	DeleteState(ctx context.Context) error
+	// Unlock releases the lock
+	Unlock(ctx context.Context) error
+}
+
+// MigrateStatus is what migrating a state did
+type MigrateStatus string
+
+const (
+	// MigrateCopied means the state was copied to the destination
+	MigrateCopied MigrateStatus = "copied"
+	// MigrateUnchanged means the destination already had the same state
+	MigrateUnchanged MigrateStatus = "unchanged"
+	// MigrateMissing means there was no state to copy, e.g. the module was never applied
+	MigrateMissing MigrateStatus = "missing"
+)
+
+// MigrateResult is the outcome of migrating a state
+type MigrateResult struct {
+	Key     string
+	Status  MigrateStatus
+	Serial  int64
+	Lineage string
+	// Deleted is true if the source state was deleted
+	Deleted bool
+}
+
+// StateKeys returns the keys the modules in steps store their state under
+func StateKeys(steps []Step) []string {
+	var keys []string
+	for _, s := range steps {
+		for _, t := range s {
+			if m, ok := t.(*TerraformModule); ok {
+				keys = append(keys, m.ID)
+			}
+		}
+	}
+	return keys
+}
+
+// MigrateState copies the state stored for each key from one store to the
+// other, deleting the source if deleteSource is set. Both states are locked
+// while they're copied. A destination state with a different lineage or a
+// higher serial is never overwritten, and every copy is read back to check
+// its serial and lineage. It returns the results of the states migrated
+// before any error.
+func MigrateState(ctx context.Context, from, to StateBackend, keys []string, deleteSource bool) ([]*MigrateResult, error) {
+	if reflect.DeepEqual(from, to) {
+		return nil, errors.New("Can't migrate state to the store it's already in")
+	}
+	src, ok := from.(StateMover)
+	if !ok {
+		return nil, errors.Errorf("Migrating state isn't supported by the %s state store", stateStoreName(from))
+	}
+	dst, ok := to.(StateMover)
+	if !ok {
+		return nil, errors.Errorf("Migrating state isn't supported by the %s state store", stateStoreName(to))
+	}
+	var results []*MigrateResult
+	for _, key := range keys {
+		r, err := migrateState(ctx, src, dst, key, deleteSource)
+		if err != nil {
+			return results, errors.Wrapf(err, "Could not migrate %s", key)
+		}
+		results = append(results, r)
+	}
+	return results, nil
+}
+
+func migrateState(ctx context.Context, from, to StateMover, key string, deleteSource bool) (r *MigrateResult, err error) {
+	r = &MigrateResult{Key: key}
+	if _, data, err := from.ReadState(ctx, key); errors.Cause(err) == ErrStateNotFound || err == nil && len(data) == 0 {
+		r.Status = MigrateMissing
+		return r, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	src, err := from.LockState(ctx, key, newStateLock("migrate"))
+	if err != nil {
+		return nil, err
+	}
+	defer unlockState(src, key, &err)
+	// Read it again now it's locked, in case a run changed it
+	_, data, err := from.ReadState(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	state, err := ParseState(data)
+	if err != nil {
+		return nil, err
+	}
+	r.Serial, r.Lineage = state.Serial, state.Lineage
+
+	dst, err := to.LockState(ctx, key, newStateLock("migrate"))
+	if err != nil {
+		return nil, err
+	}
+	defer unlockState(dst, key, &err)
+	r.Status = MigrateCopied
+	_, existing, err := to.ReadState(ctx, key)
+	if err != nil && errors.Cause(err) != ErrStateNotFound {
+		return nil, err
+	}
+	if len(existing) != 0 {
+		current, err := ParseState(existing)
+		if err != nil {
+			return nil, errors.Wrap(err, "The destination state is invalid")
+		}
+		switch {
+		case current.Lineage != state.Lineage:
+			return nil, errors.Errorf("The destination already has an unrelated state, with lineage %s rather than %s", current.Lineage, state.Lineage)
+		case current.Serial > state.Serial:
+			return nil, errors.Errorf("The destination state is newer than the source, its serial is %d rather than %d", current.Serial, state.Serial)
+		case current.Serial == state.Serial && !bytes.Equal(normaliseState(existing), normaliseState(data)):
+			return nil, errors.Errorf("The destination state has the same serial, %d, but different content", current.Serial)
+		case current.Serial == state.Serial:
+			r.Status = MigrateUnchanged
+		}
+	}
+
+	if r.Status == MigrateCopied {
+		if err := dst.WriteState(ctx, data); err != nil {
+			return nil, err
+		}
+		_, written, err := to.ReadState(ctx, key)
+		if err != nil {
+			return nil, errors.Wrap(err, "Could not read back the copied state")
+		}
+		copied, err := ParseState(written)
+		if err != nil {
+			return nil, errors.Wrap(err, "The copied state is invalid")
+		}
+		if copied.Serial != state.Serial || copied.Lineage != state.Lineage || !bytes.Equal(written, data) {
+			return nil, errors.Errorf("Read back a different state, with serial %d and lineage %s", copied.Serial, copied.Lineage)
+		}
+	}
+
+	if deleteSource {
+		if err := src.DeleteState(ctx); err != nil {
+			return nil, errors.Wrap(err, "Copied the state, but could not delete the source")
+		}
+		r.Deleted = true
+	}
+	return r, nil
+}
+
+// normaliseState returns the state re-encoded, so states that only differ in
+// whitespace compare equal
+func normaliseState(data []byte) []byte {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return data
+	}
+	b, _ := json.Marshal(v)
+	return b
+}
+
+// unlockState unlocks a state, setting *err if it can't be unlocked. It's
+// unlocked even if the migration was cancelled, so the state isn't left locked.
+func unlockState(l LockedState, key string, err *error) {
+	if uerr := l.Unlock(context.Background()); uerr != nil && *err == nil {
+		*err = errors.Wrapf(uerr, "Could not unlock %s, it may need to be force unlocked", key)
+	}
+}
+
+// newStateLock returns a lock for operation, with the details terraform
+// shows when it can't take a lock
+func newStateLock(operation string) *StateLock {
+	id := make([]byte, 16)
+	rand.Read(id)
+	who := "unknown"
+	if u, err := user.Current(); err == nil {
+		who = u.Username
+	}
+	if host, err := os.Hostname(); err == nil {
+		who += "@" + host
+	}
+	return &StateLock{
+		ID:        fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:]),
+		Operation: "micro-platform " + operation,
+		Who:       who,
+		Version:   "micro-platform",
+		Created:   time.Now().UTC(),
+	}
+}
+
+// lockPath returns the file the lock on the state for key is recorded in
+func (b *LocalBackend) lockPath(key string) string {
+	return filepath.Join(b.Dir, "."+key+".tfstate.lock.info")
+}
+
+// LockState records a lock in .<key>.tfstate.lock.info. Terraform locks local
+// state with flock rather than this file, so the lock only keeps other
+// migrations out; don't run terraform while migrating local state.
+func (b *LocalBackend) LockState(ctx context.Context, key string, lock *StateLock) (LockedState, error) {
+	if err := os.MkdirAll(b.Dir, 0o700); err != nil {
+		return nil, err
+	}
+	lock.Path = b.Path(key)
+	info, err := json.Marshal(lock)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(b.lockPath(key), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if os.IsExist(err) {
+		held, _ := ioutil.ReadFile(b.lockPath(key))
+		return nil, errors.Errorf("The state %s is locked: %s", key, held)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := f.Write(info); err != nil {
+		os.Remove(b.lockPath(key))
+		return nil, err
+	}
+	return &localLockedState{backend: b, key: key}, nil
+}
+
+type localLockedState struct {
+	backend *LocalBackend
+	key     string
+}
+
+// WriteState writes the state to a temporary file and renames it, so the
+// state is never partially written
+func (l *localLockedState) WriteState(ctx context.Context, data []byte) error {
+	f, err := ioutil.TempFile(l.backend.Dir, "."+l.key+".tfstate.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), l.backend.Path(l.key))
+}
+
+func (l *localLockedState) DeleteState(ctx context.Context) error {
+	return os.Remove(l.backend.Path(l.key))
+}
+
+func (l *localLockedState) Unlock(ctx context.Context) error {
+	return os.Remove(l.backend.lockPath(l.key))
+}
+
+// LockState takes the lock terraform takes in the lock table. Without a lock
+// table, state isn't locked.
+func (b *S3Backend) LockState(ctx context.Context, key string, lock *StateLock) (LockedState, error) {
+	l := &s3LockedState{backend: b, key: key}
+	if len(b.LockTable) == 0 {
+		return l, nil
+	}
+	l.table = &lockTable{
+		client: dynamodb.New(session.New(&aws.Config{Region: aws.String(b.Region)})),
+		table:  b.LockTable,
+		bucket: b.Bucket,
+	}
+	lock.Path = b.Bucket + "/" + key
+	if err := l.table.Lock(ctx, lock); err != nil {
+		return nil, err
+	}
+	l.lock = lock
+	return l, nil
+}
+
+type s3LockedState struct {
+	backend *S3Backend
+	key     string
+	table   *lockTable
+	lock    *StateLock
+}
+
+// WriteState uploads the state, and records its digest in the lock table as
+// terraform does, otherwise terraform refuses to read it
+func (l *s3LockedState) WriteState(ctx context.Context, data []byte) error {
+	_, err := l.backend.client().PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(l.backend.Bucket),
+		Key:         aws.String(l.key),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("application/json"),
+	})
+	if err != nil {
+		return errors.Wrap(err, "Could not upload state")
+	}
+	if l.table != nil {
+		return l.table.SetDigest(ctx, l.backend.Bucket+"/"+l.key, data)
+	}
+	return nil
+}
+
+func (l *s3LockedState) DeleteState(ctx context.Context) error {
+	_, err := l.backend.client().DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(l.backend.Bucket),
+		Key:    aws.String(l.key),
+	})
+	if err != nil {
+		return errors.Wrap(err, "Could not delete state")
+	}
+	if l.table != nil {
+		return l.table.SetDigest(ctx, l.backend.Bucket+"/"+l.key, nil)
+	}
+	return nil
+}
+
+func (l *s3LockedState) Unlock(ctx context.Context) error {
+	if l.table == nil {
+		return nil
+	}
+	return l.table.Unlock(ctx, l.lock)
+}
+
+// LockState takes a lease on the state's blob, as terraform does. Like
+// terraform, an empty blob is created to lease if the state doesn't exist.
+func (b *AzureRMBackend) LockState(ctx context.Context, key string, lock *StateLock) (LockedState, error) {
+	client := newAzureBlobClient(b)
+	l := &azureLockedState{client: client, container: b.Container, key: key}
+	lease, err := client.AcquireLease(ctx, b.Container, key, -1)
+	if aerr, ok := err.(*azureError); ok && aerr.Status == http.StatusNotFound {
+		if err := client.Put(ctx, b.Container, key, "", nil); err != nil {
+			return nil, errors.Wrap(err, "Could not create a blob to lock")
+		}
+		l.created = true
+		lease, err = client.AcquireLease(ctx, b.Container, key, -1)
+	}
+	if aerr, ok := err.(*azureError); ok && aerr.Status == http.StatusConflict {
+		return nil, errors.Errorf("The state %s is locked, another run may be in progress", key)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "Could not lock %s", key)
+	}
+	l.lease = lease
+	return l, nil
+}
+
+type azureLockedState struct {
+	client    *azureBlobClient
+	container string
+	key       string
+	lease     string
+	// created is true if the blob was created to be locked and hasn't been written
+	created bool
+	deleted bool
+}
+
+func (l *azureLockedState) WriteState(ctx context.Context, data []byte) error {
+	if err := l.client.Put(ctx, l.container, l.key, l.lease, data); err != nil {
+		return errors.Wrap(err, "Could not upload state")
+	}
+	l.created = false
+	return nil
+}
+
+func (l *azureLockedState) DeleteState(ctx context.Context) error {
+	if err := l.client.Delete(ctx, l.container, l.key, l.lease); err != nil {
+		return errors.Wrap(err, "Could not delete state")
+	}
+	l.deleted = true
+	return nil
+}
+
+// Unlock releases the lease, deleting the blob if it was only created to be locked
+func (l *azureLockedState) Unlock(ctx context.Context) error {
+	switch {
+	case l.deleted:
+		return nil
+	case l.created:
+		return l.client.Delete(ctx, l.container, l.key, l.lease)
+	default:
+		return l.client.ReleaseLease(ctx, l.container, l.key, l.lease)
+	}
+}
@@ -0,0 +1,135 @@
+package infra
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testLocalStores(t *testing.T) (*LocalBackend, *LocalBackend, func()) {
+	dir, err := ioutil.TempDir("", "micro-migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	from, to := &LocalBackend{Dir: filepath.Join(dir, "from")}, &LocalBackend{Dir: filepath.Join(dir, "to")}
+	os.Mkdir(from.Dir, 0700)
+	os.Mkdir(to.Dir, 0700)
+	return from, to, func() { os.RemoveAll(dir) }
+}
+
+func TestMigrateState(t *testing.T) {
+	from, to, cleanup := testLocalStores(t)
+	defer cleanup()
+	ioutil.WriteFile(from.Path("micro-lon1-do-network"), []byte(testState), 0600)
+
+	keys := []string{"micro-lon1-do-k8s", "micro-lon1-do-network"}
+	results, err := MigrateState(context.Background(), from, to, keys, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || results[0].Status != MigrateMissing || results[1].Status != MigrateCopied || results[1].Serial != 7 {
+		t.Fatalf("Unexpected results %+v %+v", results[0], results[1])
+	}
+	if b, _ := ioutil.ReadFile(to.Path("micro-lon1-do-network")); string(b) != testState {
+		t.Errorf("Expected the state to be copied, got %s", b)
+	}
+	if _, err := os.Stat(from.lockPath("micro-lon1-do-network")); !os.IsNotExist(err) {
+		t.Error("Expected the source to be unlocked")
+	}
+
+	// Migrating again finds the same state and deletes the source
+	results, err = MigrateState(context.Background(), from, to, keys, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[1].Status != MigrateUnchanged || !results[1].Deleted {
+		t.Errorf("Unexpected result %+v", results[1])
+	}
+	if _, err := os.Stat(from.Path("micro-lon1-do-network")); !os.IsNotExist(err) {
+		t.Error("Expected the source to be deleted")
+	}
+}
+
+func TestMigrateStateConflicts(t *testing.T) {
+	newer := strings.Replace(testState, `"serial": 7`, `"serial": 8`, 1)
+	unrelated := strings.Replace(testState, "6f0e2d6a", "00000000", 1)
+	tests := []struct {
+		name        string
+		destination string
+		err         string
+	}{
+		{"newer", newer, "newer than the source"},
+		{"unrelated", unrelated, "unrelated state"},
+		{"same serial", strings.Replace(testState, "private", "public", 1), "different content"},
+	}
+	for _, test := range tests {
+		from, to, cleanup := testLocalStores(t)
+		ioutil.WriteFile(from.Path("micro-global-kv"), []byte(testState), 0600)
+		ioutil.WriteFile(to.Path("micro-global-kv"), []byte(test.destination), 0600)
+		_, err := MigrateState(context.Background(), from, to, []string{"micro-global-kv"}, true)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: expected an error containing %q, got %v", test.name, test.err, err)
+		}
+		if b, _ := ioutil.ReadFile(to.Path("micro-global-kv")); string(b) != test.destination {
+			t.Errorf("%s: expected the destination to be left alone", test.name)
+		}
+		if _, err := os.Stat(from.Path("micro-global-kv")); err != nil {
+			t.Errorf("%s: expected the source to be kept", test.name)
+		}
+		cleanup()
+	}
+}
+
+func TestMigrateStateLocked(t *testing.T) {
+	from, to, cleanup := testLocalStores(t)
+	defer cleanup()
+	ioutil.WriteFile(from.Path("micro-global-kv"), []byte(testState), 0600)
+	l, err := from.LockState(context.Background(), "micro-global-kv", newStateLock("apply"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := MigrateState(context.Background(), from, to, []string{"micro-global-kv"}, false); err == nil || !strings.Contains(err.Error(), "locked") {
+		t.Errorf("Expected a locked error, got %v", err)
+	}
+	l.Unlock(context.Background())
+	if _, err := MigrateState(context.Background(), from, to, []string{"micro-global-kv"}, false); err != nil {
+		t.Error(err)
+	}
+	if _, err := MigrateState(context.Background(), from, from, []string{"micro-global-kv"}, false); err == nil {
+		t.Error("Expected an error migrating to the same store")
+	}
+}
+
+func TestMigrateStateAzure(t *testing.T) {
+	fake := &fakeBlobService{blobs: make(map[string][]byte), leases: make(map[string]string)}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	os.Setenv("ARM_ACCESS_KEY", azuriteKey)
+	defer os.Unsetenv("ARM_ACCESS_KEY")
+	azure := &AzureRMBackend{StorageAccount: azuriteAccount, Container: "tfstate", Endpoint: srv.URL + "/" + azuriteAccount}
+	local, _, cleanup := testLocalStores(t)
+	defer cleanup()
+	ioutil.WriteFile(local.Path("micro-lon1-do-network"), []byte(testState), 0600)
+
+	keys := []string{"micro-lon1-do-k8s", "micro-lon1-do-network"}
+	if _, err := MigrateState(context.Background(), local, azure, keys, true); err != nil {
+		t.Fatal(err)
+	}
+	blob := "/" + azuriteAccount + "/tfstate/micro-lon1-do-network"
+	if string(fake.blobs[blob]) != testState || len(fake.blobs) != 1 || len(fake.leases) != 0 {
+		t.Fatalf("Expected only the state to be copied and unlocked, got %v %v", fake.blobs, fake.leases)
+	}
+
+	// And back again, deleting the blob
+	results, err := MigrateState(context.Background(), azure, local, keys, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[1].Status != MigrateCopied || !results[1].Deleted || len(fake.blobs) != 0 {
+		t.Errorf("Expected the blob to be moved back, got %+v %v", results[1], fake.blobs)
+	}
+}
@@ -0,0 +1,46 @@
+package infra
+
+import (
+	"context"
+	"embed"
+	"io/fs"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// modules are the terraform modules bundled with the platform, so the binary
+// doesn't need the repository next to it. They're sourced as embed://<dir>,
+// e.g. embed://kubernetes/do
+//
+//go:embed control/*.tf resource/*.tf network/*.tf network/service/*.tf
+//go:embed kubernetes/*/*.tf kv/*/*.tf gslb/*/*.tf
+var modules embed.FS
+
+// embeddedModule returns the directory of the module in an embed:// source
+func embeddedModule(u *url.URL) string {
+	return strings.Trim(path.Join(u.Host, u.Path), "/")
+}
+
+// fetchEmbedded copies a module bundled in the binary in to the module path
+func (t *TerraformModule) fetchEmbedded(ctx context.Context, u *url.URL) error {
+	root := embeddedModule(u)
+	if fi, err := fs.Stat(modules, root); err != nil || !fi.IsDir() {
+		return errors.New("Module " + t.Name + ": no embedded module " + root)
+	}
+	return fs.WalkDir(modules, root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		f, err := modules.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		rel := strings.TrimPrefix(p, root+"/")
+		return writeFile(filepath.Join(t.Path, filepath.FromSlash(rel)), f, 0o644)
+	})
+}
@@ -0,0 +1,65 @@
+package infra
+
+import (
+	"context"
+	"io/fs"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFetchEmbedded(t *testing.T) {
+	dir, err := ioutil.TempDir("", "micro-platform-embed-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	u, _ := url.Parse("embed://network")
+	m := &TerraformModule{Name: "test", Path: dir}
+	if err := m.fetchEmbedded(context.Background(), u); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{"api.tf", "variables.tf", "service/service.tf"} {
+		if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(f))); err != nil {
+			t.Errorf("Expected %s to be copied: %v", f, err)
+		}
+	}
+
+	u, _ = url.Parse("embed://kv/missing")
+	if err := m.fetchEmbedded(context.Background(), u); err == nil || !strings.Contains(err.Error(), "no embedded module kv/missing") {
+		t.Errorf("Expected a missing module error, got %v", err)
+	}
+}
+
+func TestPlatformModulesEmbedded(t *testing.T) {
+	p := &Platform{Name: "micro", Kv: "cloudflare"}
+	for _, provider := range []string{"aws", "azure", "do"} {
+		p.Regions = append(p.Regions, Region{Provider: provider, Region: "region"})
+	}
+	steps, err := p.Steps()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range steps {
+		for _, task := range s {
+			m, ok := task.(*TerraformModule)
+			if !ok {
+				continue
+			}
+			u, err := url.Parse(m.Source)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if u.Scheme != "embed" {
+				t.Errorf("%s: expected an embedded source, got %s", m.Name, m.Source)
+				continue
+			}
+			if _, err := fs.Stat(modules, embeddedModule(u)); err != nil {
+				t.Errorf("%s: %v", m.Name, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,13 @@
+resource "kubernetes_secret" "cloudflare_credentials" {
+  metadata {
+    name      = "cloudfare-credentials"
+    namespace = data.terraform_remote_state.namespaces.outputs.network_namespace
+  }
+  data = {
+    "CF_ACCOUNT_ID"           = var.cloudflare_account_id
+    "CF_API_TOKEN"            = var.cloudflare_api_token
+    "KV_NAMESPACE_ID"         = data.terraform_remote_state.kv.outputs.kv_namespace_id
+    "KV_NAMESPACE_ID_RUNTIME" = data.terraform_remote_state.kv.outputs.kv_namespace_id_runtime
+    "MICRO_MU_DNS_ZONE_ID"    = var.cloudflare_dns_zone_id
+  }
+}
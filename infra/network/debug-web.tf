@@ -0,0 +1,13 @@
+module "debug_web" {
+  source = "./service"
+
+  resource_namespace = data.terraform_remote_state.namespaces.outputs.resource_namespace
+  network_namespace  = data.terraform_remote_state.namespaces.outputs.network_namespace
+
+  service_name       = "debug-web"
+  create_k8s_service = false
+
+  extra_env_vars = {
+    "MICRO_NETDATA_URL" = "http://netdata.${data.terraform_remote_state.namespaces.outputs.resource_namespace}.svc:19999"
+  }
+}
@@ -0,0 +1,9 @@
+module "debug" {
+  source = "./service"
+
+  resource_namespace = data.terraform_remote_state.namespaces.outputs.resource_namespace
+  network_namespace  = data.terraform_remote_state.namespaces.outputs.network_namespace
+
+  service_name       = "debug"
+  create_k8s_service = false
+}
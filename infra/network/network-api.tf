@@ -0,0 +1,13 @@
+module "network_api" {
+  source = "./service"
+
+  resource_namespace = data.terraform_remote_state.namespaces.outputs.resource_namespace
+  network_namespace  = data.terraform_remote_state.namespaces.outputs.network_namespace
+
+  service_name       = "network-api"
+  create_k8s_service = false
+
+  extra_env_vars = {
+    "MICRO_SERVER_ADDRESS" = "0.0.0.0:9090"
+  }
+}
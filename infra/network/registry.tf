@@ -0,0 +1,9 @@
+module "registry" {
+  source = "./service"
+
+  resource_namespace = data.terraform_remote_state.namespaces.outputs.resource_namespace
+  network_namespace  = data.terraform_remote_state.namespaces.outputs.network_namespace
+
+  service_name = "registry"
+  service_port = 8000
+}
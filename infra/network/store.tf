@@ -0,0 +1,14 @@
+module "store" {
+  source = "./service"
+
+  resource_namespace = data.terraform_remote_state.namespaces.outputs.resource_namespace
+  network_namespace  = data.terraform_remote_state.namespaces.outputs.network_namespace
+
+  service_name       = "store"
+  create_k8s_service = false
+
+  extra_env_vars = {
+    "MICRO_STORE_BACKEND" = "cockroach"
+    "MICRO_STORE_NODES"   = "host=cockroachdb-public.${data.terraform_remote_state.namespaces.outputs.resource_namespace}.svc port=26257 sslmode=disable user=root"
+  }
+}
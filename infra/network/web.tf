@@ -0,0 +1,20 @@
+module "web" {
+  source = "./service"
+
+  resource_namespace = data.terraform_remote_state.namespaces.outputs.resource_namespace
+  network_namespace  = data.terraform_remote_state.namespaces.outputs.network_namespace
+
+  service_name       = "web"
+  service_port       = 443
+  create_k8s_ingress = true
+  domain_names = ["web.${var.domain_name}", "web-${var.region_slug}.cloud.${var.domain_name}"]
+
+  extra_env_vars = {
+    "MICRO_ENABLE_ACME"   = "true"
+    "MICRO_ACME_PROVIDER" = "certmagic"
+    "MICRO_ACME_HOSTS"    = "*.${var.domain_name},*.cloud.${var.domain_name},${var.domain_name}"
+    "CF_API_TOKEN"        = var.cloudflare_api_token
+    "CF_ACCOUNT_ID"       = var.cloudflare_account_id
+    "KV_NAMESPACE_ID"     = data.terraform_remote_state.kv.outputs.kv_namespace_id
+  }
+}
@@ -1,8 +1,7 @@
 package infra
 
 import (
-	"fmt"
-	"os"
+	"context"
 )
 
 // Noop is a task that prints the stage it is on, but otherwise does nothing
@@ -12,31 +11,31 @@ type Noop struct {
 }
 
 // Validate prints Validating
-func (n *Noop) Validate() error {
-	_, err := fmt.Fprintf(os.Stderr, "[%s] Validating (no-op)\n", n.Name)
-	return err
+func (n *Noop) Validate(ctx context.Context) error {
+	logf(ctx, n, "Validating (no-op)")
+	return nil
 }
 
 // Plan prints Planning
-func (n *Noop) Plan() error {
-	_, err := fmt.Fprintf(os.Stderr, "[%s] Planning (no-op)\n", n.Name)
-	return err
+func (n *Noop) Plan(ctx context.Context) error {
+	logf(ctx, n, "Planning (no-op)")
+	return nil
 }
 
 // Apply prints Applying
-func (n *Noop) Apply() error {
-	_, err := fmt.Fprintf(os.Stderr, "[%s] Applying (no-op)\n", n.Name)
-	return err
+func (n *Noop) Apply(ctx context.Context) error {
+	logf(ctx, n, "Applying (no-op)")
+	return nil
 }
 
 // Finalise prints Finalising
-func (n *Noop) Finalise() error {
-	_, err := fmt.Fprintf(os.Stderr, "[%s] Finalising (no-op)\n", n.Name)
-	return err
+func (n *Noop) Finalise(ctx context.Context) error {
+	logf(ctx, n, "Finalising (no-op)")
+	return nil
 }
 
 // Destroy prints Destroying
-func (n *Noop) Destroy() error {
-	_, err := fmt.Fprintf(os.Stderr, "[%s] Destroying (no-op)\n", n.Name)
-	return err
+func (n *Noop) Destroy(ctx context.Context) error {
+	logf(ctx, n, "Destroying (no-op)")
+	return nil
 }
@@ -1,6 +1,7 @@
 package infra
 
 import (
+	"context"
 	"testing"
 )
 
@@ -9,16 +10,16 @@ func TestNoop(t *testing.T) {
 		ID:   "test-module-noop",
 		Name: "test-module-noop",
 	}
-	if err := n.Validate(); err != nil {
+	if err := n.Validate(context.Background()); err != nil {
 		t.Error(err)
 	}
-	if err := n.Plan(); err != nil {
+	if err := n.Plan(context.Background()); err != nil {
 		t.Error(err)
 	}
-	if err := n.Apply(); err != nil {
+	if err := n.Apply(context.Background()); err != nil {
 		t.Error(err)
 	}
-	if err := n.Finalise(); err != nil {
+	if err := n.Finalise(context.Background()); err != nil {
 		t.Error(err)
 	}
 }
@@ -0,0 +1,157 @@
+package infra
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// EventType is the kind of event sent to an Observer
+type EventType string
+
+const (
+	// EventTaskStarted is sent when the executor starts a phase of a task
+	EventTaskStarted EventType = "task_started"
+	// EventTaskValidated is sent when a task has been validated
+	EventTaskValidated EventType = "task_validated"
+	// EventTaskPlanned is sent when a task has been planned
+	EventTaskPlanned EventType = "task_planned"
+	// EventTaskApplied is sent when a task has been applied
+	EventTaskApplied EventType = "task_applied"
+	// EventTaskDestroyed is sent when a task has been destroyed
+	EventTaskDestroyed EventType = "task_destroyed"
+	// EventTaskFailed is sent when a phase of a task returns an error
+	EventTaskFailed EventType = "task_failed"
+	// EventOutput is a line of output from terraform
+	EventOutput EventType = "output"
+	// EventLog is a message from a task or the executor
+	EventLog EventType = "log"
+)
+
+// Phases of a task
+const (
+	PhaseValidate = "validate"
+	PhasePlan     = "plan"
+	PhaseApply    = "apply"
+	PhaseDestroy  = "destroy"
+)
+
+// Output streams
+const (
+	StreamStdout = "stdout"
+	StreamStderr = "stderr"
+)
+
+// Event describes progress made by the executor or a task
+type Event struct {
+	Type EventType `json:"type"`
+	// ID and Name of the task the event is about
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Phase of the task, for step, task and failure events
+	Phase string `json:"phase,omitempty"`
+	// Stream the output was written to, for output events
+	Stream string `json:"stream,omitempty"`
+	// Message is the output line or log message
+	Message string `json:"message,omitempty"`
+	// Error is set for failure events
+	Error error     `json:"-"`
+	Time  time.Time `json:"time"`
+}
+
+// Observer receives events as steps are executed. Events from tasks running in
+// parallel are sent concurrently.
+type Observer interface {
+	Notify(e Event)
+}
+
+// Observers sends events to every observer in the list
+type Observers []Observer
+
+// Notify sends the event to every observer
+func (o Observers) Notify(e Event) {
+	for _, obs := range o {
+		obs.Notify(e)
+	}
+}
+
+// ConsoleObserver prints output and log messages prefixed with the task name
+type ConsoleObserver struct {
+	// Stdout receives terraform's stdout
+	Stdout io.Writer
+	// Stderr receives terraform's stderr and log messages
+	Stderr io.Writer
+
+	mu sync.Mutex
+}
+
+// NewConsoleObserver returns an observer that prints to stdout and stderr
+func NewConsoleObserver() *ConsoleObserver {
+	return &ConsoleObserver{Stdout: os.Stdout, Stderr: os.Stderr}
+}
+
+// Notify prints output and log events
+func (c *ConsoleObserver) Notify(e Event) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch e.Type {
+	case EventOutput:
+		out := c.Stderr
+		if e.Stream == StreamStdout {
+			out = c.Stdout
+		}
+		fmt.Fprintf(out, "[%s] %s\n", e.Name, e.Message)
+	case EventLog:
+		fmt.Fprintf(c.Stderr, "[%s] %s\n", e.Name, e.Message)
+	}
+}
+
+type observerKey struct{}
+
+// withObserver returns a context that sends task events to o
+func withObserver(ctx context.Context, o Observer) context.Context {
+	return context.WithValue(ctx, observerKey{}, o)
+}
+
+// notify sends an event about a task to the context's observer, or the console
+func notify(ctx context.Context, t Task, e Event) {
+	o, ok := ctx.Value(observerKey{}).(Observer)
+	if !ok {
+		o = defaultObserver
+	}
+	e.ID = taskID(t)
+	e.Name = taskName(t)
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	o.Notify(e)
+}
+
+// logf sends a log message about a task
+func logf(ctx context.Context, t Task, format string, a ...interface{}) {
+	notify(ctx, t, Event{Type: EventLog, Message: fmt.Sprintf(format, a...)})
+}
+
+var defaultObserver Observer = NewConsoleObserver()
+
+// phaseEvents are the events sent when each phase of a task succeeds
+var phaseEvents = map[string]EventType{
+	PhaseValidate: EventTaskValidated,
+	PhasePlan:     EventTaskPlanned,
+	PhaseApply:    EventTaskApplied,
+	PhaseDestroy:  EventTaskDestroyed,
+}
+
+// runPhase runs a phase of a task, notifying observers as it starts and ends
+func runPhase(ctx context.Context, t Task, phase string, fn func(context.Context) error) error {
+	notify(ctx, t, Event{Type: EventTaskStarted, Phase: phase})
+	if err := fn(ctx); err != nil {
+		notify(ctx, t, Event{Type: EventTaskFailed, Phase: phase, Error: err, Message: err.Error()})
+		return err
+	}
+	notify(ctx, t, Event{Type: phaseEvents[phase], Phase: phase})
+	return nil
+}
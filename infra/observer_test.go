@@ -0,0 +1,45 @@
+package infra
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+type recordingObserver struct {
+	sync.Mutex
+	events []Event
+}
+
+func (r *recordingObserver) Notify(e Event) {
+	r.Lock()
+	r.events = append(r.events, e)
+	r.Unlock()
+}
+
+func TestObserver(t *testing.T) {
+	obs := &recordingObserver{}
+	steps := []Step{{&Noop{ID: "noop", Name: "noop"}}}
+	if err := ExecuteApply(context.Background(), steps, Observe(obs)); err != nil {
+		t.Fatal(err)
+	}
+	expected := []EventType{
+		EventTaskStarted, EventLog, EventTaskValidated,
+		EventTaskStarted, EventLog, EventTaskApplied,
+		EventLog,
+	}
+	if len(obs.events) != len(expected) {
+		t.Fatalf("Expected %d events, got %+v", len(expected), obs.events)
+	}
+	for i, e := range obs.events {
+		if e.Type != expected[i] {
+			t.Errorf("Expected event %d to be %s, got %s", i, expected[i], e.Type)
+		}
+		if e.ID != "noop" {
+			t.Errorf("Expected event %d to be about noop, got %s", i, e.ID)
+		}
+	}
+	if obs.events[4].Message != "Applying (no-op)" {
+		t.Errorf("Unexpected log message %q", obs.events[4].Message)
+	}
+}
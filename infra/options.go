@@ -0,0 +1,151 @@
+package infra
+
+import "time"
+
+// DefaultConcurrency is the number of tasks run in parallel when no limit is given
+const DefaultConcurrency = 4
+
+// Options configure how steps are executed
+type Options struct {
+	// Concurrency is the maximum number of tasks run at once
+	Concurrency int
+	// PlanDir is where plans are saved to and applied from
+	PlanDir string
+	// PlanKey encrypts saved plans that hold secrets
+	PlanKey string
+	// InterruptTimeout is how long an interrupted task has to exit
+	InterruptTimeout time.Duration
+	// Journal records the outcome of each task
+	Journal *Journal
+	// Resume skips tasks the journal records as already applied
+	Resume bool
+	// Rollback destroys the tasks an apply created if it fails
+	Rollback bool
+	// Timeout limits each phase of terraform modules that don't set their own
+	Timeout time.Duration
+	// RequireChecksum rejects http and https module sources without a checksum
+	RequireChecksum bool
+	// GitCacheDir is where git module sources are cloned to
+	GitCacheDir string
+	// StaleLockAge is how old a state lock must be to be reported as stale
+	StaleLockAge time.Duration
+	// ForceUnlock removes stale state locks
+	ForceUnlock bool
+	// Observers receive events as tasks run. Defaults to the console
+	Observers []Observer
+}
+
+// Option sets an executor option
+type Option func(o *Options)
+
+// Concurrency limits the number of tasks run in parallel.
+// A value below 1 runs every task as soon as it is ready.
+func Concurrency(n int) Option {
+	return func(o *Options) {
+		o.Concurrency = n
+	}
+}
+
+// PlanDir saves a plan artifact for every terraform module in dir when
+// planning, and applies those artifacts when applying
+func PlanDir(dir string) Option {
+	return func(o *Options) {
+		o.PlanDir = dir
+	}
+}
+
+// PlanKey is the passphrase the saved plans of modules with secret variables
+// are encrypted with. It must be the same when applying them.
+func PlanKey(key string) Option {
+	return func(o *Options) {
+		o.PlanKey = key
+	}
+}
+
+// InterruptTimeout sets how long terraform is given to exit gracefully when
+// the context is cancelled, before it is killed
+func InterruptTimeout(d time.Duration) Option {
+	return func(o *Options) {
+		o.InterruptTimeout = d
+	}
+}
+
+// WithJournal records the outcome of every task applied or destroyed in j
+func WithJournal(j *Journal) Option {
+	return func(o *Options) {
+		o.Journal = j
+	}
+}
+
+// Resume skips tasks that the journal records as already applied with the
+// same configuration, continuing a failed apply from where it stopped
+func Resume(b bool) Option {
+	return func(o *Options) {
+		o.Resume = b
+	}
+}
+
+// Rollback destroys the tasks that a failed apply newly created, in reverse
+// order. Tasks whose state existed before the apply are left alone.
+func Rollback(b bool) Option {
+	return func(o *Options) {
+		o.Rollback = b
+	}
+}
+
+// Timeout limits how long each phase of a terraform module may take, for
+// modules that don't have a timeout of their own
+func Timeout(d time.Duration) Option {
+	return func(o *Options) {
+		o.Timeout = d
+	}
+}
+
+// RequireChecksum rejects terraform modules downloaded over http or https
+// that don't have a sha256 checksum to verify them against
+func RequireChecksum(b bool) Option {
+	return func(o *Options) {
+		o.RequireChecksum = b
+	}
+}
+
+// GitCacheDir sets where git module sources are cloned to. The clones are
+// shared by every module and kept between runs, so only new commits are fetched.
+func GitCacheDir(dir string) Option {
+	return func(o *Options) {
+		o.GitCacheDir = dir
+	}
+}
+
+// StaleLockAge sets how old a state lock must be before it's reported as
+// left behind by a crashed run
+func StaleLockAge(d time.Duration) Option {
+	return func(o *Options) {
+		o.StaleLockAge = d
+	}
+}
+
+// ForceUnlock removes stale state locks when checking the remote state,
+// instead of failing. Only use it when nothing else is running.
+func ForceUnlock(b bool) Option {
+	return func(o *Options) {
+		o.ForceUnlock = b
+	}
+}
+
+// Observe sends events to the observers instead of printing them to the console
+func Observe(obs ...Observer) Option {
+	return func(o *Options) {
+		o.Observers = append(o.Observers, obs...)
+	}
+}
+
+func newOptions(opts ...Option) Options {
+	o := Options{
+		Concurrency: DefaultConcurrency,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
@@ -0,0 +1,267 @@
+package infra
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// outputRef matches a reference to another task's output in a variable,
+// e.g. ${task.k8s.cluster_name}
+var outputRef = regexp.MustCompile(`\$\{task\.([A-Za-z0-9_-]+)\.([A-Za-z0-9_-]+)\}`)
+
+// Outputter is a task with outputs that later tasks can reference
+type Outputter interface {
+	// Outputs returns the outputs of the task, once it has been planned or applied
+	Outputs() map[string]interface{}
+}
+
+// Outputs returns the terraform outputs read after the last plan or apply
+func (t *TerraformModule) Outputs() map[string]interface{} {
+	return t.outputs
+}
+
+// readOutputs reads the module's outputs from its state
+func (t *TerraformModule) readOutputs(ctx context.Context) error {
+	out, err := t.outputTerraform(ctx, "output", "-json")
+	if err != nil {
+		return errors.Wrap(err, "terraform output failed")
+	}
+	var outputs map[string]struct {
+		Value interface{} `json:"value"`
+	}
+	if err := json.Unmarshal(out, &outputs); err != nil {
+		return errors.Wrap(err, "Couldn't parse terraform outputs")
+	}
+	t.outputs = make(map[string]interface{}, len(outputs))
+	for k, v := range outputs {
+		t.outputs[k] = v.Value
+	}
+	return nil
+}
+
+// outputRefs returns the names of the tasks referenced in variables, sorted
+func outputRefs(vars map[string]interface{}) []string {
+	names := make(map[string]bool)
+	var find func(v interface{})
+	find = func(v interface{}) {
+		switch val := v.(type) {
+		case string:
+			for _, m := range outputRef.FindAllStringSubmatch(val, -1) {
+				names[m[1]] = true
+			}
+		case []string:
+			for _, s := range val {
+				find(s)
+			}
+		case []interface{}:
+			for _, e := range val {
+				find(e)
+			}
+		case map[string]string:
+			for _, s := range val {
+				find(s)
+			}
+		case map[string]interface{}:
+			for _, e := range val {
+				find(e)
+			}
+		}
+	}
+	for _, v := range vars {
+		find(v)
+	}
+	var refs []string
+	for name := range names {
+		refs = append(refs, name)
+	}
+	sort.Strings(refs)
+	return refs
+}
+
+// refNode returns the task a reference names, or nil if there isn't one. The
+// name is a task ID, or else the kind of a module in the same region, e.g. k8s
+// from micro-lon1-do-network is micro-lon1-do-k8s.
+func (g *Graph) refNode(from, name string) *node {
+	if n, ok := g.byID[name]; ok {
+		return n
+	}
+	if i := strings.LastIndex(from, "-"); i != -1 {
+		return g.byID[from[:i+1]+name]
+	}
+	return nil
+}
+
+// unknownOutputError is returned resolving an output of a task with no outputs
+// at all, as it has no state yet, or no longer
+type unknownOutputError struct {
+	id, key string
+}
+
+func (e *unknownOutputError) Error() string {
+	return fmt.Sprintf("Task %s has no output %s, it may need to be applied first", e.id, e.key)
+}
+
+// isUnknownOutput returns true if err is caused by an unknown output
+func isUnknownOutput(err error) bool {
+	_, ok := errors.Cause(err).(*unknownOutputError)
+	return ok
+}
+
+// resolveOutputs replaces references to other tasks' outputs in a module's
+// variables with their values. It's called once the referenced tasks are done.
+func (g *Graph) resolveOutputs(task Task) error {
+	return g.resolveTaskOutputs(task, false)
+}
+
+// resolveKnownOutputs resolves references like resolveOutputs, but outputs of
+// tasks without state are unknown rather than an error. A reference that is the
+// whole value is resolved to null, otherwise to an empty string. It's for
+// destroy, which doesn't need the real values.
+func (g *Graph) resolveKnownOutputs(task Task) error {
+	return g.resolveTaskOutputs(task, true)
+}
+
+func (g *Graph) resolveTaskOutputs(task Task, unknown bool) error {
+	t, ok := task.(*TerraformModule)
+	if !ok {
+		return nil
+	}
+	for k, v := range t.Variables {
+		resolved, err := g.resolveValue(t.ID, v, unknown)
+		if err != nil {
+			return errors.Wrapf(err, "Couldn't resolve variable %s", k)
+		}
+		t.Variables[k] = resolved
+	}
+	return nil
+}
+
+func (g *Graph) resolveValue(from string, v interface{}, unknown bool) (interface{}, error) {
+	switch val := v.(type) {
+	case string:
+		return g.resolveString(from, val, unknown)
+	case []string:
+		list := make([]interface{}, len(val))
+		for i, s := range val {
+			r, err := g.resolveString(from, s, unknown)
+			if err != nil {
+				return nil, err
+			}
+			list[i] = r
+		}
+		return list, nil
+	case []interface{}:
+		list := make([]interface{}, len(val))
+		for i, e := range val {
+			r, err := g.resolveValue(from, e, unknown)
+			if err != nil {
+				return nil, err
+			}
+			list[i] = r
+		}
+		return list, nil
+	case map[string]string:
+		m := make(map[string]interface{}, len(val))
+		for k, s := range val {
+			r, err := g.resolveString(from, s, unknown)
+			if err != nil {
+				return nil, err
+			}
+			m[k] = r
+		}
+		return m, nil
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(val))
+		for k, e := range val {
+			r, err := g.resolveValue(from, e, unknown)
+			if err != nil {
+				return nil, err
+			}
+			m[k] = r
+		}
+		return m, nil
+	default:
+		return v, nil
+	}
+}
+
+// resolveString resolves the references in s. A string that is a single
+// reference takes the output's value and type, e.g. a list; otherwise the
+// outputs are substituted in to the string.
+func (g *Graph) resolveString(from, s string, unknown bool) (interface{}, error) {
+	matches := outputRef.FindAllStringSubmatchIndex(s, -1)
+	if len(matches) == 0 {
+		return s, nil
+	}
+	if m := matches[0]; len(matches) == 1 && m[0] == 0 && m[1] == len(s) {
+		v, err := g.output(from, s[m[2]:m[3]], s[m[4]:m[5]])
+		if unknown && isUnknownOutput(err) {
+			return nil, nil
+		}
+		return v, err
+	}
+	var err error
+	resolved := outputRef.ReplaceAllStringFunc(s, func(ref string) string {
+		m := outputRef.FindStringSubmatch(ref)
+		v, oerr := g.output(from, m[1], m[2])
+		if unknown && isUnknownOutput(oerr) {
+			return ""
+		}
+		if oerr != nil {
+			if err == nil {
+				err = oerr
+			}
+			return ref
+		}
+		if str, ok := v.(string); ok {
+			return str
+		}
+		b, _ := json.Marshal(v)
+		return string(b)
+	})
+	return resolved, err
+}
+
+// output returns the value of an output of the task that name refers to
+func (g *Graph) output(from, name, key string) (interface{}, error) {
+	n := g.refNode(from, name)
+	if n == nil {
+		return nil, errors.Errorf("%s references unknown task %s", from, name)
+	}
+	o, ok := n.task.(Outputter)
+	if !ok {
+		return nil, errors.Errorf("Task %s has no outputs", n.id)
+	}
+	outputs := o.Outputs()
+	v, ok := outputs[key]
+	if !ok && len(outputs) == 0 {
+		return nil, &unknownOutputError{id: n.id, key: key}
+	}
+	if !ok {
+		return nil, errors.Errorf("Task %s has no output %s", n.id, key)
+	}
+	return v, nil
+}
+
+// referenced returns the tasks whose outputs are referenced by another task
+func (g *Graph) referenced() map[Task]bool {
+	tasks := make(map[Task]bool)
+	for _, n := range g.nodes {
+		t, ok := n.task.(*TerraformModule)
+		if !ok {
+			continue
+		}
+		for _, name := range outputRefs(t.Variables) {
+			if dep := g.refNode(t.ID, name); dep != nil {
+				tasks[dep.task] = true
+			}
+		}
+	}
+	return tasks
+}
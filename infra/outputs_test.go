@@ -0,0 +1,112 @@
+package infra
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestResolveOutputs(t *testing.T) {
+	k8s := &TerraformModule{
+		ID:   "micro-lon1-do-k8s",
+		Name: "micro-lon1-do-k8s",
+		outputs: map[string]interface{}{
+			"cluster_name": "micro-lon1",
+			"node_pools":   []interface{}{"default", "spot"},
+		},
+	}
+	kv := &TerraformModule{
+		ID:      "micro-global-kv",
+		Name:    "micro-global-kv",
+		outputs: map[string]interface{}{"namespace_id": "abc123"},
+	}
+	network := &TerraformModule{
+		ID:   "micro-lon1-do-network",
+		Name: "micro-lon1-do-network",
+		Variables: map[string]interface{}{
+			"cluster":    "${task.k8s.cluster_name}",
+			"pools":      "${task.k8s.node_pools}",
+			"hostname":   "${task.k8s.cluster_name}.micro.mu",
+			"kv":         []string{"${task.micro-global-kv.namespace_id}"},
+			"labels":     map[string]string{"cluster": "${task.k8s.cluster_name}"},
+			"replicas":   3,
+			"unrelated":  "${var.something}",
+			"pools_text": "pools: ${task.k8s.node_pools}",
+		},
+	}
+	g, err := NewGraph([]Step{{network, k8s, kv}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deps := make(map[string]bool)
+	for _, d := range g.byID[network.ID].deps {
+		deps[d.id] = true
+	}
+	if !deps[k8s.ID] || !deps[kv.ID] || len(deps) != 2 {
+		t.Errorf("Expected network to depend on k8s and kv, got %v", deps)
+	}
+	if !g.referenced()[k8s] || !g.referenced()[kv] || g.referenced()[network] {
+		t.Error("Expected k8s and kv to be referenced")
+	}
+
+	if err := g.resolveOutputs(network); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"cluster":    "micro-lon1",
+		"pools":      []interface{}{"default", "spot"},
+		"hostname":   "micro-lon1.micro.mu",
+		"kv":         []interface{}{"abc123"},
+		"labels":     map[string]interface{}{"cluster": "micro-lon1"},
+		"replicas":   3,
+		"unrelated":  "${var.something}",
+		"pools_text": `pools: ["default","spot"]`,
+	}
+	if !reflect.DeepEqual(network.Variables, expected) {
+		t.Errorf("Expected %v, got %v", expected, network.Variables)
+	}
+}
+
+func TestResolveOutputsErrors(t *testing.T) {
+	k8s := &TerraformModule{ID: "micro-lon1-do-k8s", Name: "micro-lon1-do-k8s"}
+	tests := map[string]string{
+		"${task.k8s.cluster_name}":  "has no output cluster_name",
+		"x-${task.k8s.cluster_id}":  "has no output cluster_id",
+		"${task.noop.cluster_name}": "has no outputs",
+	}
+	for ref, msg := range tests {
+		m := &TerraformModule{
+			ID:        "micro-lon1-do-network",
+			Name:      "micro-lon1-do-network",
+			Variables: map[string]interface{}{"v": ref},
+		}
+		g, err := NewGraph([]Step{{k8s, &Noop{ID: "noop", Name: "noop"}, m}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := g.resolveOutputs(m); err == nil || !strings.Contains(err.Error(), msg) {
+			t.Errorf("%s: expected error containing %q, got %v", ref, msg, err)
+		}
+	}
+}
+
+func TestOutputRefDependencies(t *testing.T) {
+	k8s := &TerraformModule{ID: "micro-lon1-do-k8s", Name: "micro-lon1-do-k8s"}
+	m := &TerraformModule{
+		ID:        "micro-lon1-do-network",
+		Name:      "micro-lon1-do-network",
+		Variables: map[string]interface{}{"a": "${task.k8s.cluster_name}", "b": "${task.micro-lon1-do-k8s.cluster_id}"},
+	}
+	g, err := NewGraph([]Step{{k8s, m}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deps := g.dependencies(m); len(deps) != 1 || deps[0] != k8s.ID {
+		t.Errorf("Expected a single dependency on %s, got %v", k8s.ID, deps)
+	}
+
+	m.Variables = map[string]interface{}{"v": "${task.missing.value}"}
+	if _, err := NewGraph([]Step{{k8s, m}}); err == nil || !strings.Contains(err.Error(), "references unknown task missing") {
+		t.Errorf("Expected an unknown task error, got %v", err)
+	}
+}
@@ -0,0 +1,71 @@
+package infra
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+// PlanReport summarises the changes a plan would make to each module
+type PlanReport struct {
+	Modules []ModulePlan `json:"modules"`
+	// Deferred are the IDs of modules that can't be planned until the modules
+	// whose outputs they use have been applied
+	Deferred []string `json:"deferred,omitempty"`
+}
+
+// ModulePlan summarises the changes a plan would make to a single module
+type ModulePlan struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Revision is the commit SHA a git source was checked out at
+	Revision string `json:"revision,omitempty"`
+	Create   int    `json:"create"`
+	Update   int    `json:"update"`
+	Delete   int    `json:"delete"`
+	// Changes lists every resource that would change
+	Changes []ResourceChange `json:"changes,omitempty"`
+}
+
+// ResourceChange is a resource that a plan would change
+type ResourceChange struct {
+	Address string   `json:"address"`
+	Actions []string `json:"actions"`
+}
+
+// parsePlan summarises the output of terraform show -json <planfile>
+func parsePlan(b []byte) (*ModulePlan, error) {
+	var plan struct {
+		ResourceChanges []struct {
+			Address string `json:"address"`
+			Change  struct {
+				Actions []string `json:"actions"`
+			} `json:"change"`
+		} `json:"resource_changes"`
+	}
+	if err := json.Unmarshal(b, &plan); err != nil {
+		return nil, errors.Wrap(err, "Couldn't parse terraform plan")
+	}
+	m := &ModulePlan{}
+	for _, rc := range plan.ResourceChanges {
+		changed := false
+		for _, a := range rc.Change.Actions {
+			switch a {
+			case "create":
+				m.Create++
+			case "update":
+				m.Update++
+			case "delete":
+				m.Delete++
+			default:
+				// no-op and read don't change anything
+				continue
+			}
+			changed = true
+		}
+		if changed {
+			m.Changes = append(m.Changes, ResourceChange{Address: rc.Address, Actions: rc.Change.Actions})
+		}
+	}
+	return m, nil
+}
@@ -0,0 +1,28 @@
+package infra
+
+import (
+	"testing"
+)
+
+func TestParsePlan(t *testing.T) {
+	show := `{
+  "format_version": "0.1",
+  "resource_changes": [
+    {"address": "kubernetes_namespace.control", "change": {"actions": ["create"]}},
+    {"address": "kubernetes_namespace.network", "change": {"actions": ["no-op"]}},
+    {"address": "kubernetes_namespace.resource", "change": {"actions": ["delete", "create"]}},
+    {"address": "kubernetes_secret.cloudflare", "change": {"actions": ["update"]}},
+    {"address": "data.terraform_remote_state.k8s", "change": {"actions": ["read"]}}
+  ]
+}`
+	m, err := parsePlan([]byte(show))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Create != 2 || m.Update != 1 || m.Delete != 1 {
+		t.Errorf("Expected 2 to create, 1 to update, 1 to delete, got %d, %d, %d", m.Create, m.Update, m.Delete)
+	}
+	if len(m.Changes) != 3 {
+		t.Errorf("Expected 3 changed resources, got %d", len(m.Changes))
+	}
+}
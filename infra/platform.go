@@ -3,6 +3,7 @@ package infra
 import (
 	"fmt"
 	"math/rand"
+	"sort"
 	"strings"
 	"time"
 
@@ -11,17 +12,45 @@ import (
 
 // Platform defines a complete platform
 type Platform struct {
-	Name    string
-	Domain  string
-	Gslb    string
-	Kv      string
-	Regions []struct {
-		Provider string
-		Region   string
-		Control  []string
-		Resource []string
-		Network  []string
-	}
+	Name   string
+	Domain string
+	// Gslb is the global load balancer in front of every region, e.g.
+	// cloudflare. Empty for none.
+	Gslb string
+	Kv   string
+	// Retry is the retry policy for every terraform module in the platform
+	Retry RetryPolicy
+	// Timeout limits each phase of every terraform module, 0 for no limit
+	Timeout time.Duration
+	// Timeouts override Timeout for a kind of module, e.g. network: 45m
+	Timeouts map[string]time.Duration
+	// Secrets are where the secrets the modules need are read from, by
+	// variable name, e.g. cloudflare_api_token: vault:secret/data/micro#cloudflare.
+	// Secrets that aren't set are read from the environment, see DefaultSecrets.
+	Secrets map[string]string
+	// Variables are set in every module that declares them, e.g. replicas: 3
+	Variables map[string]interface{}
+	Regions   []Region
+}
+
+// DefaultSecrets are where each secret is read from unless the platform sets it
+var DefaultSecrets = map[string]string{
+	"cloudflare_account_id":  "env:CLOUDFLARE_ACCOUNT_ID",
+	"cloudflare_dns_zone_id": "env:CLOUDFLARE_DNS_ZONE_ID",
+	"cloudflare_api_token":   "env:CLOUDFLARE_API_TOKEN",
+}
+
+// Region is a cloud provider's region the platform is deployed to
+type Region struct {
+	Provider string
+	Region   string
+	// Control, Resource and Network are the services to deploy in the
+	// region, from the Catalogue. An empty list deploys every service.
+	Control  []string
+	Resource []string
+	Network  []string
+	// Variables override the platform's variables in the region
+	Variables map[string]interface{}
 }
 
 // Steps generates an action plan from a Platform description
@@ -31,19 +60,50 @@ func (p *Platform) Steps() ([]Step, error) {
 	runID := rand.Int31()
 	var steps []Step
 	// 1: Ensure Remote state is available
-	steps = append(steps, Step{&RemoteState{ID: p.Name + "-check-remote-state", Name: p.Name + "-check-remote-state"}})
+	checkID := p.Name + "-check-remote-state"
+	prefixes := []string{p.Name + "-global-"}
+	for _, r := range p.Regions {
+		prefixes = append(prefixes, p.Name+"-"+r.Region+"-"+r.Provider+"-")
+	}
+	steps = append(steps, Step{&RemoteState{ID: checkID, Name: checkID, StatePrefixes: prefixes}})
 
 	// 2: Set up KV namespace
-	steps = append(steps, Step{
+	kvVars := make(map[string]interface{})
+	if err := p.setSecrets("embed://kv/"+p.Kv, kvVars); err != nil {
+		return nil, err
+	}
+	kv := Step{
 		&TerraformModule{
-			ID:     p.Name + "-global-kv",
-			Name:   p.Name + "-global-kv",
-			Source: "./infra/kv/" + p.Kv,
-			Path:   fmt.Sprintf("/tmp/%s-%d", p.Name+"-kv", runID),
+			ID:        p.Name + "-global-kv",
+			Name:      p.Name + "-global-kv",
+			Source:    "embed://kv/" + p.Kv,
+			Path:      fmt.Sprintf("/tmp/%s-%d", p.Name+"-kv", runID),
+			Variables: kvVars,
+			DependsOn: []string{checkID},
 		},
-	})
+	}
+	steps = append(steps, kv)
 
+	// Regions are independent of each other, so the nth step of every region is
+	// merged in to a single step and the regions are provisioned in parallel
+	var regions [][]Step
+	used := make(map[string]bool)
+	// The network services of each region, which the gslb balances
+	network := make(map[string]interface{})
 	for _, r := range p.Regions {
+		var steps []Step
+		services, err := selectRegionServices(r.Region, r.Provider, r.Control, r.Resource, r.Network)
+		if err != nil {
+			return nil, err
+		}
+		var names []string
+		for _, s := range services[ServiceNetwork] {
+			names = append(names, s.Name)
+		}
+		network[r.Region+"-"+r.Provider] = names
+		if len(p.Gslb) != 0 && !hasService(services[ServiceResource], gslbIngress) {
+			return nil, errors.Errorf("Region %s-%s: the gslb needs the %s resource, add it to the region's resource list", r.Region, r.Provider, gslbIngress)
+		}
 		// 2.1 Create Kubernetes cluster
 		k := &Kubernetes{
 			Name:     p.Name,
@@ -52,12 +112,17 @@ func (p *Platform) Steps() ([]Step, error) {
 		}
 		cluster, err := k.Steps(runID)
 		if err != nil {
-			return steps, errors.Wrap(err, "Kubernetes cluster steps failed")
+			return nil, errors.Wrap(err, "Kubernetes cluster steps failed")
+		}
+		for _, t := range cluster[0] {
+			if m, ok := t.(*TerraformModule); ok {
+				m.DependsOn = append(m.DependsOn, checkID)
+			}
 		}
 		steps = append(steps, cluster...)
 
 		// 2.2 Create namespaces
-		vars := make(map[string]string)
+		vars := make(map[string]interface{})
 		env := make(map[string]string)
 		vars["control_namespace"] = strings.ToLower(fmt.Sprintf("%s-control", p.Name))
 		vars["resource_namespace"] = strings.ToLower(fmt.Sprintf("%s-resource", p.Name))
@@ -67,29 +132,27 @@ func (p *Platform) Steps() ([]Step, error) {
 			&TerraformModule{
 				ID:        p.Name + "-" + r.Region + "-" + r.Provider + "-namespaces",
 				Name:      p.Name + "-" + r.Region + "-" + r.Provider + "-namespaces",
-				Source:    "./infra/kubernetes/namespaces",
+				Source:    "embed://kubernetes/namespaces",
 				Path:      fmt.Sprintf("/tmp/%s-%s-%s-namespaces-%d", p.Name, r.Region, r.Provider, runID),
 				Variables: vars,
 				Env:       env,
+				DependsOn: []string{k.internalName("kubeconfig")},
 			},
 		})
 
 		// 2.3 Create shared resources
-		vars = make(map[string]string)
+		vars = make(map[string]interface{})
 		env = make(map[string]string)
 		remoteStates := make(map[string]string)
-		if r.Provider == "aws" {
-			vars["in_aws"] = "true"
-		} else {
-			vars["in_aws"] = "false"
-		}
+		vars["in_aws"] = r.Provider == "aws"
 		env["KUBECONFIG"] = fmt.Sprintf("/tmp/%s-%s-%s-kubeconfig-%d/kubeconfig", p.Name, r.Region, r.Provider, runID)
 		remoteStates["namespaces"] = p.Name + "-" + r.Region + "-" + r.Provider + "-namespaces"
 		steps = append(steps, Step{
 			&TerraformModule{
 				ID:           p.Name + "-" + r.Region + "-" + r.Provider + "-resource",
 				Name:         p.Name + "-" + r.Region + "-" + r.Provider + "-resource",
-				Source:       "./infra/resource",
+				Source:       "embed://resource",
+				Files:        serviceFiles(ServiceResource, services[ServiceResource]),
 				Path:         fmt.Sprintf("/tmp/%s-%s-%s-resource-%d", p.Name, r.Region, r.Provider, runID),
 				Variables:    vars,
 				Env:          env,
@@ -98,7 +161,7 @@ func (p *Platform) Steps() ([]Step, error) {
 		})
 
 		// 2.4 Create control plane
-		vars = make(map[string]string)
+		vars = make(map[string]interface{})
 		env = make(map[string]string)
 		remoteStates = make(map[string]string)
 		vars["domain_name"] = p.Domain
@@ -108,22 +171,25 @@ func (p *Platform) Steps() ([]Step, error) {
 			&TerraformModule{
 				ID:           p.Name + "-" + r.Region + "-" + r.Provider + "-control",
 				Name:         p.Name + "-" + r.Region + "-" + r.Provider + "-control",
-				Source:       "./infra/control",
+				Source:       "embed://control",
+				Files:        serviceFiles(ServiceControl, services[ServiceControl]),
 				Path:         fmt.Sprintf("/tmp/%s-%s-%s-control-%d", p.Name, r.Region, r.Provider, runID),
 				Variables:    vars,
 				Env:          env,
 				RemoteStates: remoteStates,
+				// The micro services need the shared resources to be running
+				DependsOn: []string{p.Name + "-" + r.Region + "-" + r.Provider + "-resource"},
 			},
 		})
 
 		// 2.5 Create network
-		vars = make(map[string]string)
+		vars = make(map[string]interface{})
 		env = make(map[string]string)
 		remoteStates = make(map[string]string)
 		vars["domain_name"] = p.Domain
-		vars["cloudflare_account_id"] = "TODO"
-		vars["cloudflare_dns_zone_id"] = "TODO"
-		vars["cloudflare_api_token"] = "TODO"
+		if err := p.setSecrets("embed://network", vars); err != nil {
+			return nil, err
+		}
 		vars["region_slug"] = r.Region + "-" + r.Provider
 		env["KUBECONFIG"] = fmt.Sprintf("/tmp/%s-%s-%s-kubeconfig-%d/kubeconfig", p.Name, r.Region, r.Provider, runID)
 		remoteStates["namespaces"] = p.Name + "-" + r.Region + "-" + r.Provider + "-namespaces"
@@ -132,14 +198,130 @@ func (p *Platform) Steps() ([]Step, error) {
 			&TerraformModule{
 				ID:           p.Name + "-" + r.Region + "-" + r.Provider + "-network",
 				Name:         p.Name + "-" + r.Region + "-" + r.Provider + "-network",
-				Source:       "./infra/network",
+				Source:       "embed://network",
+				Files:        serviceFiles(ServiceNetwork, services[ServiceNetwork]),
 				Path:         fmt.Sprintf("/tmp/%s-%s-%s-network-%d", p.Name, r.Region, r.Provider, runID),
 				Variables:    vars,
 				Env:          env,
 				RemoteStates: remoteStates,
+				// The micro services need the shared resources to be running
+				DependsOn: []string{p.Name + "-" + r.Region + "-" + r.Provider + "-resource"},
 			},
 		})
+		// The region's variables take precedence over the platform's
+		set, err := setVariables(mergeVariables(p.Variables, r.Variables), steps)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Region %s-%s", r.Region, r.Provider)
+		}
+		if unused := unusedVariables(r.Variables, set); len(unused) != 0 {
+			return nil, variablesError("Region "+r.Region+"-"+r.Provider, unused)
+		}
+		for k := range set {
+			used[k] = true
+		}
+		regions = append(regions, steps)
 	}
 
+	steps = append(steps, mergeSteps(regions...)...)
+
+	// 3: Load balance across the regions
+	global := []Step{kv}
+	if len(p.Gslb) != 0 {
+		gslb, err := p.gslbStep(runID, network)
+		if err != nil {
+			return nil, err
+		}
+		steps = append(steps, gslb)
+		global = append(global, gslb)
+	}
+
+	// The global modules only use the platform's variables
+	set, err := setVariables(p.Variables, global)
+	if err != nil {
+		return nil, err
+	}
+	for k := range set {
+		used[k] = true
+	}
+	if unused := unusedVariables(p.Variables, used); len(unused) != 0 {
+		return nil, variablesError("Platform "+p.Name, unused)
+	}
+
+	if err := p.Retry.Validate(); err != nil {
+		return nil, err
+	}
+	for _, s := range steps {
+		for _, t := range s {
+			if m, ok := t.(*TerraformModule); ok {
+				m.Retry = &p.Retry
+				m.Timeout = p.Timeout
+				if d, ok := p.Timeouts[moduleKind(m.ID)]; ok {
+					m.Timeout = d
+				}
+			}
+		}
+	}
 	return steps, nil
 }
+
+// mergeSteps combines lists of steps so that the nth step of each list runs in parallel
+func mergeSteps(lists ...[]Step) []Step {
+	var merged []Step
+	for _, l := range lists {
+		for i, s := range l {
+			if i == len(merged) {
+				merged = append(merged, Step{})
+			}
+			merged[i] = append(merged[i], s...)
+		}
+	}
+	return merged
+}
+
+// moduleKinds are the kinds of module a platform is made of
+var moduleKinds = []string{"k8s", "kubeconfig", "namespaces", "kv", ServiceResource, ServiceControl, ServiceNetwork, "gslb"}
+
+// globalModuleKinds are the kinds of module shared by every region
+var globalModuleKinds = map[string]bool{"kv": true, "gslb": true}
+
+// moduleKind returns the kind of module from its ID, e.g. micro-lon1-do-network is a network
+func moduleKind(id string) string {
+	return id[strings.LastIndex(id, "-")+1:]
+}
+
+// setSecrets sets references to every secret an embedded module declares a
+// variable for, e.g. the Cloudflare credentials
+func (p *Platform) setSecrets(source string, vars map[string]interface{}) error {
+	declared := declaredVariables(source)
+	names := make([]string, 0, len(DefaultSecrets))
+	for name := range DefaultSecrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !declared[name] {
+			continue
+		}
+		ref, err := p.secret(name)
+		if err != nil {
+			return err
+		}
+		vars[name] = ref
+	}
+	return nil
+}
+
+// secret returns a reference to one of the platform's secrets, which is
+// resolved when the module is run
+func (p *Platform) secret(name string) (string, error) {
+	ref, ok := p.Secrets[name]
+	if !ok {
+		ref = DefaultSecrets[name]
+	}
+	ref = "${" + strings.TrimSuffix(strings.TrimPrefix(ref, "${"), "}") + "}"
+	if secretRef.FindString(ref) != ref {
+		// The value isn't printed in case it's the secret itself
+		return "", errors.Errorf("Secret %s isn't a secret reference, expected env:, file:, sops: or vault:", name)
+	}
+	return ref, nil
+}
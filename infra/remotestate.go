@@ -1,98 +1,188 @@
 package infra
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
+	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/pkg/errors"
-	"github.com/spf13/viper"
 )
 
 // RemoteState is an action that verifies remote state is available
 type RemoteState struct {
 	ID   string
 	Name string
+	// Backend to check. Defaults to the state-store config
+	Backend StateBackend
+	// StaleLockAge is how old a lock must be to be reported as stale.
+	// Defaults to DefaultStaleLockAge
+	StaleLockAge time.Duration
+	// ForceUnlock removes stale locks instead of failing
+	ForceUnlock bool
+	// StatePrefixes are the prefixes of the state keys locks are checked on,
+	// e.g. micro-lon1-do-, so other platforms' locks in the same bucket are
+	// left alone. Empty checks every lock in the bucket.
+	StatePrefixes []string
 }
 
 // Validate checks the remote state buckets and table exist
-func (r *RemoteState) Validate() error {
-	if err := r.validateConfig(); err != nil {
-		fmt.Fprintf(os.Stdout, "[%s] The remote state backend is invalid!\n", r.Name)
+func (r *RemoteState) Validate(ctx context.Context) error {
+	if err := r.validateConfig(ctx); err != nil {
+		logf(ctx, r, "The remote state backend is invalid!")
 		return err
 	}
-	fmt.Fprintf(os.Stdout, "[%s] The remote state backend is valid\n", r.Name)
+	logf(ctx, r, "The remote state backend is valid")
 	return nil
 }
 
 // Plan does nothing
-func (r *RemoteState) Plan() error {
+func (r *RemoteState) Plan(ctx context.Context) error {
 	return nil
 }
 
 // Apply does nothing
-func (r *RemoteState) Apply() error {
+func (r *RemoteState) Apply(ctx context.Context) error {
 	return nil
 }
 
 // Finalise does nothing
-func (r *RemoteState) Finalise() error {
+func (r *RemoteState) Finalise(ctx context.Context) error {
 	return nil
 }
 
 // Destroy does nothing
-func (r *RemoteState) Destroy() error {
+func (r *RemoteState) Destroy(ctx context.Context) error {
 	return nil
 }
 
-func (r *RemoteState) validateConfig() error {
-	stateStore := viper.GetString("state-store")
-	switch stateStore {
-	case "aws":
-		return r.validateAws()
-	case "azure":
-		return r.validateAzure()
+func (r *RemoteState) validateConfig(ctx context.Context) error {
+	backend := r.Backend
+	if backend == nil {
+		var err error
+		if backend, err = configuredStateBackend(); err != nil {
+			return err
+		}
+	}
+	switch b := backend.(type) {
+	case *S3Backend:
+		return r.validateAws(ctx, b)
+	case *AzureRMBackend:
+		return r.validateAzure(ctx, b)
+	case *LocalBackend:
+		return r.validateLocal(ctx, b)
 	default:
-		return errors.Errorf("%s is not a supported state store", stateStore)
+		// terraform init fails if the other backends can't be reached
+		return nil
 	}
 }
 
-func (r *RemoteState) validateAzure() error {
-	//TODO: meaningful validation
+// validateAzure does a put, get and delete round trip against the state
+// container, and checks blobs can be leased, as that's how state is locked.
+// The blob is deleted however the check fails. Only shared key and SAS token
+// auth are supported, with Azure AD credentials the check is skipped.
+func (r *RemoteState) validateAzure(ctx context.Context, b *AzureRMBackend) (err error) {
+	client := newAzureBlobClient(b)
+	if !client.hasCredentials() {
+		logf(ctx, r, "Neither ARM_ACCESS_KEY nor ARM_SAS_TOKEN is set, assuming terraform uses Azure AD credentials and skipping the state container checks")
+		return nil
+	}
+	if err := client.Put(ctx, b.Container, r.ID, "", []byte(r.ID)); err != nil {
+		return errors.Wrap(err, "Could not put a blob in to the remote state container")
+	}
+	// lease is held until it's released, and a leased blob can only be
+	// deleted with its lease ID
+	var lease string
+	defer func() {
+		// ctx may have been cancelled, the blob should still be cleaned up
+		cctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if lease != "" {
+			if rerr := client.ReleaseLease(cctx, b.Container, r.ID, lease); rerr != nil && err == nil {
+				err = errors.Wrap(rerr, "Could not release a lease on a blob, state can't be unlocked")
+			}
+		}
+		if derr := client.Delete(cctx, b.Container, r.ID, ""); derr != nil && err == nil {
+			err = errors.Wrap(derr, "Error deleting blob from Azure")
+		}
+	}()
+	body, _, err := client.Get(ctx, b.Container, r.ID)
+	if err != nil {
+		return errors.Wrap(err, "Could not read back a blob from the remote state container")
+	}
+	if string(body) != r.ID {
+		return fmt.Errorf("Read back an invalid value from remote state. Expected %s, got %s", r.ID, string(body))
+	}
+
+	if lease, err = client.AcquireLease(ctx, b.Container, r.ID, 15*time.Second); err != nil {
+		return errors.Wrap(err, "Could not acquire a lease on a blob, state can't be locked")
+	}
+	// A second lease must be refused, otherwise two applies could hold the lock at once
+	_, err = client.AcquireLease(ctx, b.Container, r.ID, 15*time.Second)
+	if ae, ok := err.(*azureError); !ok || ae.Status != http.StatusConflict {
+		if err == nil {
+			return errors.New("Acquired two leases on the same blob, state locking won't work")
+		}
+		return errors.Wrap(err, "Unexpected error acquiring a lease on a leased blob")
+	}
+	if err := client.ReleaseLease(ctx, b.Container, r.ID, lease); err != nil {
+		return errors.Wrap(err, "Could not release a lease on a blob, state can't be unlocked")
+	}
+	lease = ""
 	return nil
 }
 
-func (r *RemoteState) validateAws() error {
-	client := s3.New(
-		session.New(
-			&aws.Config{
-				Region: func() *string {
-					if r := os.Getenv("AWS_REGION"); len(r) != 0 {
-						return &r
-					}
-					return aws.String("eu-west-2")
-				}(),
-			},
-		),
+// validateLocal checks the state directory can be written to
+func (r *RemoteState) validateLocal(ctx context.Context, b *LocalBackend) error {
+	if err := os.MkdirAll(b.Dir, 0o700); err != nil {
+		return errors.Wrap(err, "Could not create the local state directory")
+	}
+	path := filepath.Join(b.Dir, r.ID)
+	if err := ioutil.WriteFile(path, []byte(r.ID), 0o600); err != nil {
+		return errors.Wrap(err, "Could not write to the local state directory")
+	}
+	defer os.Remove(path)
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.Wrap(err, "Could not read back a file from the local state directory")
+	}
+	if string(body) != r.ID {
+		return fmt.Errorf("Read back an invalid value from local state. Expected %s, got %s", r.ID, string(body))
+	}
+	return nil
+}
+
+func (r *RemoteState) validateAws(ctx context.Context, b *S3Backend) error {
+	sess := session.New(
+		&aws.Config{
+			Region: aws.String(b.Region),
+		},
 	)
-	if _, err := client.PutObject(
+	client := s3.New(sess)
+	if _, err := client.PutObjectWithContext(
+		ctx,
 		&s3.PutObjectInput{
 			Key:    aws.String(r.ID),
-			Bucket: aws.String(viper.GetString("aws-s3-bucket")),
+			Bucket: aws.String(b.Bucket),
 			Body:   strings.NewReader(r.ID),
 		},
 	); err != nil {
 		return errors.Wrap(err, "Could not put an object in to the remote state bucket")
 	}
 
-	read, err := client.GetObject(
+	read, err := client.GetObjectWithContext(
+		ctx,
 		&s3.GetObjectInput{
 			Key:    aws.String(r.ID),
-			Bucket: aws.String(viper.GetString("aws-s3-bucket")),
+			Bucket: aws.String(b.Bucket),
 		},
 	)
 	if err != nil {
@@ -107,13 +197,23 @@ func (r *RemoteState) validateAws() error {
 		return fmt.Errorf("Read back an invalid value from remote state. Expected %s, got %s", r.ID, string(body))
 	}
 
-	if _, err := client.DeleteObject(
+	if _, err := client.DeleteObjectWithContext(
+		ctx,
 		&s3.DeleteObjectInput{
 			Key:    aws.String(r.ID),
-			Bucket: aws.String(viper.GetString("aws-s3-bucket")),
+			Bucket: aws.String(b.Bucket),
 		},
 	); err != nil {
 		return errors.Wrap(err, "Error deleting object from S3")
 	}
-	return nil
+
+	if len(b.LockTable) == 0 {
+		logf(ctx, r, "No lock table is configured, state won't be locked")
+		return nil
+	}
+	locks := &lockTable{client: dynamodb.New(sess), table: b.LockTable, bucket: b.Bucket}
+	if err := locks.Validate(ctx, r.ID); err != nil {
+		return err
+	}
+	return r.checkLocks(ctx, locks)
 }
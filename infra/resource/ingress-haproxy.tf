@@ -213,3 +213,16 @@ resource "kubernetes_service" "haproxy_ingress" {
     ignore_changes = [metadata.0.annotations]
   }
 }
+
+locals {
+  haproxy_load_balancer = kubernetes_service.haproxy_ingress.load_balancer_ingress[0]
+}
+
+output "ingress_address" {
+  description = "Address of the region's ingress load balancer, for global load balancing"
+  value = {
+    ip4      = local.haproxy_load_balancer.ip == null ? "" : local.haproxy_load_balancer.ip
+    ip6      = ""
+    hostname = local.haproxy_load_balancer.hostname == null ? "" : local.haproxy_load_balancer.hostname
+  }
+}
@@ -0,0 +1,121 @@
+package infra
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultRetryable matches terraform errors caused by transient cloud failures.
+// Only network timeouts are matched, as a resource that times out waiting to
+// become ready, e.g. a cluster, would most likely time out again.
+var DefaultRetryable = []string{
+	`(?i)rate limit`,
+	`(?i)too many requests`,
+	`i/o timeout`,
+	`TLS handshake timeout`,
+	`Client\.Timeout exceeded`,
+	`connection timed out`,
+	`(?i)connection reset`,
+	`(?i)temporarily unavailable`,
+	`(?i)internal server error`,
+	`(?i)bad gateway`,
+	`(?i)service unavailable`,
+	`(?i)gateway time-?out`,
+	// Status codes only count next to a status, not as e.g. line numbers
+	`(?i)(status( code)?:?|StatusCode:|HTTP/\d(\.\d)?) ?(429|50[0234])\b`,
+}
+
+// RetryPolicy retries terraform commands that fail with transient errors
+type RetryPolicy struct {
+	// Attempts is the maximum number of times a command is run, including the first
+	Attempts int
+	// Backoff is the delay before the first retry, doubled for every attempt after
+	Backoff time.Duration
+	// MaxBackoff caps the delay between attempts
+	MaxBackoff time.Duration `mapstructure:"max-backoff"`
+	// Retryable are regular expressions matched against terraform's stderr,
+	// a failure is only retried if one matches. Defaults to DefaultRetryable
+	Retryable []string
+}
+
+// Validate checks the retry policy's regular expressions compile
+func (r *RetryPolicy) Validate() error {
+	_, err := r.patterns()
+	return err
+}
+
+func (r *RetryPolicy) patterns() ([]*regexp.Regexp, error) {
+	exprs := r.Retryable
+	if len(exprs) == 0 {
+		exprs = DefaultRetryable
+	}
+	var patterns []*regexp.Regexp
+	for _, e := range exprs {
+		re, err := regexp.Compile(e)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid retryable error %q", e)
+		}
+		patterns = append(patterns, re)
+	}
+	return patterns, nil
+}
+
+// retryable returns true if err is a terraform failure matching the policy
+func (r *RetryPolicy) retryable(err error) bool {
+	tfErr, ok := errors.Cause(err).(*terraformError)
+	if !ok {
+		return false
+	}
+	patterns, perr := r.patterns()
+	if perr != nil {
+		return false
+	}
+	for _, re := range patterns {
+		if re.MatchString(tfErr.stderr) {
+			return true
+		}
+	}
+	return false
+}
+
+// terraformError is returned when terraform exits unsuccessfully
+type terraformError struct {
+	err     error
+	command string
+	// stderr is everything terraform wrote to stderr
+	stderr string
+}
+
+func (e *terraformError) Error() string {
+	return fmt.Sprintf("terraform %s failed: %s", e.command, e.err.Error())
+}
+
+// retry calls fn until it succeeds, fails with an error the retry policy
+// doesn't match, runs out of attempts or ctx is done
+func (t *TerraformModule) retry(ctx context.Context, fn func() error) error {
+	if t.Retry == nil || t.Retry.Attempts < 2 {
+		return fn()
+	}
+	backoff := t.Retry.Backoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		// Once interrupted or timed out, terraform's failure isn't transient
+		if err == nil || ctx.Err() != nil || attempt >= t.Retry.Attempts || !t.Retry.retryable(err) {
+			return err
+		}
+		logf(ctx, t, "Transient error, retrying in %s (attempt %d of %d)", backoff, attempt+1, t.Retry.Attempts)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if t.Retry.MaxBackoff > 0 && backoff > t.Retry.MaxBackoff {
+			backoff = t.Retry.MaxBackoff
+		}
+	}
+}
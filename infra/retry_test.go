@@ -0,0 +1,66 @@
+package infra
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestRetry(t *testing.T) {
+	m := &TerraformModule{
+		Name:  "test",
+		Retry: &RetryPolicy{Attempts: 3},
+	}
+	for _, tc := range []struct {
+		stderr   string
+		attempts int
+	}{
+		{stderr: "Error: GET https://api.digitalocean.com/v2/kubernetes/clusters: 429 Too Many Requests", attempts: 3},
+		{stderr: "Error: Invalid resource type", attempts: 1},
+		{stderr: "Error: dial tcp 10.0.0.1:443: i/o timeout", attempts: 3},
+		{stderr: "Error: timeout while waiting for state to become 'running'", attempts: 1},
+		{stderr: "Error: waiting for the load balancer: unexpected status code: 503", attempts: 3},
+		{stderr: "Error: POST https://management.azure.com/: 502 Bad Gateway", attempts: 3},
+		{stderr: "Error: Unsupported argument\n\n  on main.tf line 500, in resource \"aws_instance\" \"node\":", attempts: 1},
+		{stderr: "Error: Invalid value for port 504", attempts: 1},
+	} {
+		attempts := 0
+		err := m.retry(context.Background(), func() error {
+			attempts++
+			return &terraformError{err: errors.New("exit status 1"), command: "apply", stderr: tc.stderr}
+		})
+		if err == nil {
+			t.Error("Expected an error")
+		}
+		if attempts != tc.attempts {
+			t.Errorf("Expected %d attempts for %q, got %d", tc.attempts, tc.stderr, attempts)
+		}
+	}
+
+	attempts := 0
+	if err := m.retry(context.Background(), func() error {
+		attempts++
+		if attempts == 1 {
+			return &terraformError{err: errors.New("exit status 1"), command: "apply", stderr: "connection reset by peer"}
+		}
+		return nil
+	}); err != nil {
+		t.Errorf("Expected the retry to succeed, got %v", err)
+	}
+
+	// An interrupted command isn't retried, even if terraform's error matches
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	attempts = 0
+	m.retry(ctx, func() error {
+		attempts++
+		return &terraformError{err: errors.New("exit status 1"), command: "apply", stderr: "connection reset by peer"}
+	})
+	if attempts != 1 {
+		t.Errorf("Expected no retries once cancelled, got %d attempts", attempts)
+	}
+
+	if err := (&RetryPolicy{Retryable: []string{"("}}).Validate(); err == nil {
+		t.Error("Expected an invalid retryable pattern to fail validation")
+	}
+}
@@ -0,0 +1,76 @@
+package infra
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// RollbackError is returned when an apply fails and the tasks it created were rolled back
+type RollbackError struct {
+	// Err is the error that caused the rollback
+	Err error
+	// RolledBack are the IDs of the tasks that were destroyed
+	RolledBack []string
+	// Failed are the IDs of tasks that couldn't be destroyed, and why
+	Failed map[string]error
+}
+
+func (r *RollbackError) Error() string {
+	msg := fmt.Sprintf("%s\nRolled back: %s", r.Err.Error(), strings.Join(r.RolledBack, ", "))
+	for id, err := range r.Failed {
+		msg += fmt.Sprintf("\nCouldn't roll back %s: %s", id, err.Error())
+	}
+	return msg
+}
+
+// Cause returns the error that caused the rollback
+func (r *RollbackError) Cause() error {
+	return r.Err
+}
+
+// taskIsNew returns true if the task has no existing state, so applying it creates it
+func taskIsNew(ctx context.Context, task Task) (bool, error) {
+	switch t := task.(type) {
+	case *TerraformModule:
+		exists, err := t.Exists(ctx)
+		return !exists, err
+	default:
+		// Other tasks don't create anything
+		return false, nil
+	}
+}
+
+// rollback destroys the created tasks in reverse order. A task is only started
+// once its dependencies have completed, so this destroys dependents first.
+// Tasks that something which couldn't be destroyed depends on are left alone.
+func rollback(ctx context.Context, o Options, g *Graph, created []Task, cause error) error {
+	r := &RollbackError{Err: cause, Failed: make(map[string]error)}
+	blocked := make(map[string]bool)
+	for i := len(created) - 1; i >= 0; i-- {
+		t := created[i]
+		id := taskID(t)
+		if blocked[id] {
+			r.Failed[id] = errors.New("a task that depends on it couldn't be rolled back")
+		} else {
+			logf(ctx, t, "Rolling back")
+			if err := runPhase(ctx, t, PhaseDestroy, t.Destroy); err != nil {
+				r.Failed[id] = err
+			} else if o.Journal != nil {
+				if err := o.Journal.Forget(id); err != nil {
+					r.Failed[id] = errors.Wrap(err, "Couldn't update journal")
+				}
+			}
+		}
+		if _, failed := r.Failed[id]; failed {
+			for _, dep := range g.dependencies(t) {
+				blocked[dep] = true
+			}
+			continue
+		}
+		r.RolledBack = append(r.RolledBack, id)
+	}
+	return r
+}
@@ -0,0 +1,46 @@
+package infra
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// destroyTask records the order tasks are destroyed in
+type destroyTask struct {
+	Noop
+	order *[]string
+	err   error
+}
+
+func (d *destroyTask) Destroy(ctx context.Context) error {
+	*d.order = append(*d.order, d.ID)
+	return d.err
+}
+
+func TestRollback(t *testing.T) {
+	var order []string
+	created := []Task{
+		&destroyTask{Noop: Noop{ID: "k8s", Name: "k8s"}, order: &order},
+		&destroyTask{Noop: Noop{ID: "namespaces", Name: "namespaces"}, order: &order, err: errors.New("stuck")},
+		&destroyTask{Noop: Noop{ID: "control", Name: "control"}, order: &order},
+	}
+	g, err := NewGraph([]Step{created})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = rollback(context.Background(), newOptions(), g, created, errors.New("apply failed"))
+	r, ok := err.(*RollbackError)
+	if !ok {
+		t.Fatalf("Expected a RollbackError, got %v", err)
+	}
+	if got := len(order); got != 3 || order[0] != "control" || order[2] != "k8s" {
+		t.Errorf("Expected tasks to be destroyed in reverse, got %v", order)
+	}
+	if len(r.RolledBack) != 2 {
+		t.Errorf("Expected 2 tasks to be rolled back, got %v", r.RolledBack)
+	}
+	if _, ok := r.Failed[taskID(created[1])]; !ok {
+		t.Errorf("Expected namespaces to fail to roll back, got %v", r.Failed)
+	}
+}
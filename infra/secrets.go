@@ -0,0 +1,302 @@
+package infra
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/mitchellh/go-homedir"
+	"github.com/pkg/errors"
+)
+
+// secretRef matches a reference to a secret in a variable, e.g.
+// ${env:CLOUDFLARE_API_TOKEN}, ${file:/run/secrets/token},
+// ${sops:secrets.enc.yaml#cloudflare.api_token} or
+// ${vault:secret/data/micro/cloudflare#api_token}
+var secretRef = regexp.MustCompile(`\$\{(env|file|sops|vault):([^}]+)\}`)
+
+// secretProvider returns the secret a reference points to, e.g. for
+// env:CLOUDFLARE_API_TOKEN it's passed CLOUDFLARE_API_TOKEN
+type secretProvider func(ctx context.Context, ref string) (string, error)
+
+var secretProviders = map[string]secretProvider{
+	"env":   envSecret,
+	"file":  fileSecret,
+	"sops":  sopsSecret,
+	"vault": vaultSecret,
+}
+
+// envSecret reads an environment variable
+func envSecret(ctx context.Context, name string) (string, error) {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return "", errors.Errorf("%s is not set", name)
+	}
+	return v, nil
+}
+
+// fileSecret reads a file, without its trailing newline
+func fileSecret(ctx context.Context, path string) (string, error) {
+	path, err := homedir.Expand(path)
+	if err != nil {
+		return "", err
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// sopsSecret decrypts a file with sops. A key path after # extracts a single
+// value, e.g. secrets.enc.yaml#cloudflare.api_token
+func sopsSecret(ctx context.Context, ref string) (string, error) {
+	path, key := splitSecretKey(ref)
+	args := []string{"--decrypt"}
+	if len(key) != 0 {
+		var extract strings.Builder
+		for _, k := range strings.Split(key, ".") {
+			extract.WriteString(`["` + k + `"]`)
+		}
+		args = append(args, "--extract", extract.String())
+	}
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "sops", append(args, path)...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", errors.Wrapf(err, "sops couldn't decrypt %s: %s", path, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimRight(string(out), "\r\n"), nil
+}
+
+// vaultSecret reads a field of a Vault secret from VAULT_ADDR, authenticated
+// with VAULT_TOKEN or ~/.vault-token, e.g. secret/data/micro/cloudflare#api_token.
+// Both KV version 1 and 2 secrets are supported.
+func vaultSecret(ctx context.Context, ref string) (string, error) {
+	path, field := splitSecretKey(ref)
+	if len(field) == 0 {
+		return "", errors.New("vault secrets must name a field, e.g. vault:secret/data/micro#token")
+	}
+	addr := os.Getenv("VAULT_ADDR")
+	if len(addr) == 0 {
+		return "", errors.New("VAULT_ADDR is not set")
+	}
+	token := os.Getenv("VAULT_TOKEN")
+	if len(token) == 0 {
+		if home, err := homedir.Dir(); err == nil {
+			b, _ := ioutil.ReadFile(filepath.Join(home, ".vault-token"))
+			token = strings.TrimSpace(string(b))
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(addr, "/")+"/v1/"+strings.TrimLeft(path, "/"), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if ns := os.Getenv("VAULT_NAMESPACE"); len(ns) != 0 {
+		req.Header.Set("X-Vault-Namespace", ns)
+	}
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("vault returned %s reading %s", rsp.Status, path)
+	}
+	var secret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(rsp.Body).Decode(&secret); err != nil {
+		return "", errors.Wrapf(err, "Couldn't parse vault secret %s", path)
+	}
+	data := secret.Data
+	// KV version 2 nests the secret in data, next to its metadata
+	if inner, ok := data["data"].(map[string]interface{}); ok {
+		if _, ok := data["metadata"]; ok {
+			data = inner
+		}
+	}
+	v, ok := data[field]
+	if !ok {
+		return "", errors.Errorf("vault secret %s has no field %s", path, field)
+	}
+	if s, ok := v.(string); ok {
+		return s, nil
+	}
+	b, _ := json.Marshal(v)
+	return string(b), nil
+}
+
+// splitSecretKey splits a reference in to a path and the key after #
+func splitSecretKey(ref string) (string, string) {
+	if i := strings.LastIndex(ref, "#"); i != -1 {
+		return ref[:i], ref[i+1:]
+	}
+	return ref, ""
+}
+
+// hasSecretRefs returns true if a variable references a secret
+func hasSecretRefs(v interface{}) bool {
+	switch val := v.(type) {
+	case string:
+		return secretRef.MatchString(val)
+	case []string:
+		for _, s := range val {
+			if secretRef.MatchString(s) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, e := range val {
+			if hasSecretRefs(e) {
+				return true
+			}
+		}
+	case map[string]string:
+		for _, s := range val {
+			if secretRef.MatchString(s) {
+				return true
+			}
+		}
+	case map[string]interface{}:
+		for _, e := range val {
+			if hasSecretRefs(e) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// resolveSecrets splits the module's variables in to those written to the
+// tfvars file, and those referencing secrets. The secrets are resolved and
+// returned as TF_VAR_ environment variables, so they're kept out of the tfvars
+// file. terraform does write them in to plans and state, which is why saved
+// plans of modules with secrets are encrypted. Every secret is remembered so
+// it can be redacted from terraform's output. Variables an embedded module
+// doesn't declare are dropped, as terraform warns about them, or with
+// -var-file fails.
+func (t *TerraformModule) resolveSecrets(ctx context.Context) (map[string]interface{}, []string, error) {
+	vars := make(map[string]interface{}, len(t.Variables))
+	var env []string
+	declared := declaredVariables(t.Source)
+	for k, v := range t.Variables {
+		if declared != nil && !declared[k] {
+			continue
+		}
+		if !hasSecretRefs(v) {
+			vars[k] = v
+			continue
+		}
+		resolved, err := t.resolveSecretValue(ctx, v)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "Module %s: couldn't resolve the secret in variable %s", t.Name, k)
+		}
+		s, ok := resolved.(string)
+		if !ok {
+			// terraform parses TF_VAR_ values of complex types as HCL, which JSON is
+			b, err := json.Marshal(resolved)
+			if err != nil {
+				return nil, nil, err
+			}
+			s = string(b)
+		}
+		env = append(env, fmt.Sprintf("TF_VAR_%s=%s", k, s))
+	}
+	return vars, env, nil
+}
+
+func (t *TerraformModule) resolveSecretValue(ctx context.Context, v interface{}) (interface{}, error) {
+	switch val := v.(type) {
+	case string:
+		return t.resolveSecretString(ctx, val)
+	case []string:
+		list := make([]interface{}, len(val))
+		for i, s := range val {
+			r, err := t.resolveSecretString(ctx, s)
+			if err != nil {
+				return nil, err
+			}
+			list[i] = r
+		}
+		return list, nil
+	case []interface{}:
+		list := make([]interface{}, len(val))
+		for i, e := range val {
+			r, err := t.resolveSecretValue(ctx, e)
+			if err != nil {
+				return nil, err
+			}
+			list[i] = r
+		}
+		return list, nil
+	case map[string]string:
+		m := make(map[string]interface{}, len(val))
+		for k, s := range val {
+			r, err := t.resolveSecretString(ctx, s)
+			if err != nil {
+				return nil, err
+			}
+			m[k] = r
+		}
+		return m, nil
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(val))
+		for k, e := range val {
+			r, err := t.resolveSecretValue(ctx, e)
+			if err != nil {
+				return nil, err
+			}
+			m[k] = r
+		}
+		return m, nil
+	default:
+		return v, nil
+	}
+}
+
+// resolveSecretString replaces the secret references in s with their values.
+// Each secret is read once per run.
+func (t *TerraformModule) resolveSecretString(ctx context.Context, s string) (string, error) {
+	var err error
+	resolved := secretRef.ReplaceAllStringFunc(s, func(ref string) string {
+		if err != nil {
+			return ref
+		}
+		if v, ok := t.secrets[ref]; ok {
+			return v
+		}
+		m := secretRef.FindStringSubmatch(ref)
+		v, serr := secretProviders[m[1]](ctx, m[2])
+		if serr != nil {
+			err = errors.Wrap(serr, m[1]+":"+m[2])
+			return ref
+		}
+		if t.secrets == nil {
+			t.secrets = make(map[string]string)
+		}
+		t.secrets[ref] = v
+		return v
+	})
+	return resolved, err
+}
+
+// redact replaces the secrets the module has resolved in s
+func (t *TerraformModule) redact(s string) string {
+	for _, v := range t.secrets {
+		if len(v) != 0 {
+			s = strings.Replace(s, v, "(secret)", -1)
+		}
+	}
+	return s
+}
@@ -0,0 +1,215 @@
+package infra
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestSecretProviders(t *testing.T) {
+	dir, err := ioutil.TempDir("", "micro-platform-secrets-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "token"), []byte("from-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "root" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/secret/data/micro":
+			w.Write([]byte(`{"data": {"data": {"token": "from-vault-v2"}, "metadata": {"version": 1}}}`))
+		case "/v1/kv/micro":
+			w.Write([]byte(`{"data": {"token": "from-vault-v1"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer vault.Close()
+	os.Setenv("MICRO_PLATFORM_TEST_SECRET", "from-env")
+	os.Setenv("VAULT_ADDR", vault.URL)
+	os.Setenv("VAULT_TOKEN", "root")
+	defer os.Unsetenv("MICRO_PLATFORM_TEST_SECRET")
+	defer os.Unsetenv("VAULT_ADDR")
+	defer os.Unsetenv("VAULT_TOKEN")
+
+	m := &TerraformModule{}
+	tests := []struct {
+		in, out, err string
+	}{
+		{in: "${env:MICRO_PLATFORM_TEST_SECRET}", out: "from-env"},
+		{in: "Bearer ${file:" + filepath.Join(dir, "token") + "}", out: "Bearer from-file"},
+		{in: "${vault:secret/data/micro#token}", out: "from-vault-v2"},
+		{in: "${vault:kv/micro#token}", out: "from-vault-v1"},
+		{in: "${env:MICRO_PLATFORM_TEST_UNSET}", err: "env:MICRO_PLATFORM_TEST_UNSET: MICRO_PLATFORM_TEST_UNSET is not set"},
+		{in: "${file:" + filepath.Join(dir, "missing") + "}", err: "no such file"},
+		{in: "${vault:kv/micro#password}", err: "has no field password"},
+		{in: "${vault:kv/missing#token}", err: "404"},
+		{in: "${vault:kv/micro}", err: "must name a field"},
+	}
+	for _, test := range tests {
+		out, err := m.resolveSecretString(context.Background(), test.in)
+		if len(test.err) != 0 {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: expected an error containing %q, got %v", test.in, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.in, err)
+		} else if out != test.out {
+			t.Errorf("%s: expected %q, got %q", test.in, test.out, out)
+		}
+	}
+}
+
+func TestResolveSecrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "micro-platform-secrets-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv("MICRO_PLATFORM_TEST_SECRET", "s3cr3t-t0k3n")
+	defer os.Unsetenv("MICRO_PLATFORM_TEST_SECRET")
+
+	m := &TerraformModule{
+		Name: "network",
+		Path: dir,
+		Variables: map[string]interface{}{
+			"domain_name": "micro.mu",
+			"api_token":   "${env:MICRO_PLATFORM_TEST_SECRET}",
+			"headers":     map[string]string{"Authorization": "Bearer ${env:MICRO_PLATFORM_TEST_SECRET}"},
+		},
+	}
+	vars, env, err := m.resolveSecrets(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(vars, map[string]interface{}{"domain_name": "micro.mu"}) {
+		t.Errorf("Expected only variables without secrets to be written, got %v", vars)
+	}
+	sort.Strings(env)
+	expected := []string{
+		"TF_VAR_api_token=s3cr3t-t0k3n",
+		`TF_VAR_headers={"Authorization":"Bearer s3cr3t-t0k3n"}`,
+	}
+	if !reflect.DeepEqual(env, expected) {
+		t.Errorf("Expected secrets in the environment %v, got %v", expected, env)
+	}
+	if m.Variables["api_token"] != "${env:MICRO_PLATFORM_TEST_SECRET}" {
+		t.Errorf("Expected the module to keep the reference, got %v", m.Variables["api_token"])
+	}
+	if s := m.redact(`api_token = "s3cr3t-t0k3n"`); s != `api_token = "(secret)"` {
+		t.Errorf("Expected the secret to be redacted, got %s", s)
+	}
+
+	if err := m.writeVariables(vars); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, tfVarsFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "s3cr3t") {
+		t.Errorf("Expected no secrets in %s, got %s", tfVarsFile, b)
+	}
+}
+
+func TestResolveSecretsUndeclared(t *testing.T) {
+	os.Setenv("MICRO_PLATFORM_TEST_SECRET", "s3cr3t-t0k3n")
+	defer os.Unsetenv("MICRO_PLATFORM_TEST_SECRET")
+
+	// The kubeconfig module doesn't declare name, region or token
+	m := &TerraformModule{
+		Name:   "kubeconfig",
+		Source: "embed://kubernetes/kubeconfig",
+		Variables: map[string]interface{}{
+			"name":       "micro",
+			"region":     "lon1",
+			"kubernetes": "digitalocean",
+			"token":      "${env:MICRO_PLATFORM_TEST_SECRET}",
+		},
+	}
+	vars, env, err := m.resolveSecrets(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(vars, map[string]interface{}{"kubernetes": "digitalocean"}) {
+		t.Errorf("Expected only declared variables to be written, got %v", vars)
+	}
+	if len(env) != 0 {
+		t.Errorf("Expected undeclared secrets to be dropped, got %d", len(env))
+	}
+}
+
+func TestPlatformSecrets(t *testing.T) {
+	p := &Platform{Name: "micro", Kv: "cloudflare", Regions: []Region{{Provider: "do", Region: "lon1"}}}
+	network := func() *TerraformModule {
+		steps, err := p.Steps()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range steps {
+			for _, task := range s {
+				if m, ok := task.(*TerraformModule); ok && moduleKind(m.ID) == "network" {
+					return m
+				}
+			}
+		}
+		t.Fatal("Expected a network module")
+		return nil
+	}
+	if v := network().Variables["cloudflare_api_token"]; v != "${env:CLOUDFLARE_API_TOKEN}" {
+		t.Errorf("Expected the token to be read from the environment by default, got %v", v)
+	}
+	p.Secrets = map[string]string{"cloudflare_api_token": "vault:secret/data/micro#cloudflare"}
+	m := network()
+	if v := m.Variables["cloudflare_api_token"]; v != "${vault:secret/data/micro#cloudflare}" {
+		t.Errorf("Expected the configured secret, got %v", v)
+	}
+	if v := m.Variables["cloudflare_account_id"]; v != "${env:CLOUDFLARE_ACCOUNT_ID}" {
+		t.Errorf("Expected the other secrets to keep their defaults, got %v", v)
+	}
+
+	// Every cloudflare module gets the secrets it declares
+	p.Gslb = "cloudflare"
+	steps, err := p.Steps()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"micro-global-kv", "micro-global-gslb"} {
+		var m *TerraformModule
+		for _, s := range steps {
+			for _, task := range s {
+				if tm, ok := task.(*TerraformModule); ok && tm.ID == id {
+					m = tm
+				}
+			}
+		}
+		if m == nil {
+			t.Fatalf("Expected a module %s", id)
+		}
+		if v := m.Variables["cloudflare_api_token"]; v != "${vault:secret/data/micro#cloudflare}" {
+			t.Errorf("%s: expected the configured secret, got %v", id, v)
+		}
+		if v := m.Variables["cloudflare_account_id"]; v != "${env:CLOUDFLARE_ACCOUNT_ID}" {
+			t.Errorf("%s: expected the default account id, got %v", id, v)
+		}
+	}
+	p.Gslb = ""
+	p.Secrets = map[string]string{"cloudflare_api_token": "hunter2"}
+	if _, err := p.Steps(); err == nil || !strings.Contains(err.Error(), "isn't a secret reference") {
+		t.Errorf("Expected an invalid reference error, got %v", err)
+	}
+}
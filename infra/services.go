@@ -0,0 +1,165 @@
+package infra
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Kinds of service a region deploys, each by its own module
+const (
+	ServiceControl  = "control"
+	ServiceResource = "resource"
+	ServiceNetwork  = "network"
+)
+
+// Service is a service a region can deploy
+type Service struct {
+	Name string
+	// Kind is the module that deploys it
+	Kind string
+	// Requires are the resource services it needs running in the same region
+	Requires []string
+}
+
+// File returns the .tf file in the module that defines the service
+func (s Service) File() string {
+	return s.Name + ".tf"
+}
+
+// micro services find each other with etcd and talk over nats
+var microRequires = []string{"etcd", "nats"}
+
+// Catalogue is every service the bundled control, resource and network modules define
+var Catalogue = []Service{
+	{Name: "bot", Kind: ServiceControl, Requires: microRequires},
+	{Name: "network", Kind: ServiceControl, Requires: microRequires},
+
+	{Name: "athens", Kind: ServiceResource},
+	{Name: "cockroachdb", Kind: ServiceResource},
+	{Name: "etcd", Kind: ServiceResource},
+	{Name: "ingress-haproxy", Kind: ServiceResource},
+	{Name: "jaeger", Kind: ServiceResource},
+	{Name: "nats", Kind: ServiceResource},
+	{Name: "netdata", Kind: ServiceResource},
+
+	{Name: "api", Kind: ServiceNetwork, Requires: microRequires},
+	{Name: "broker", Kind: ServiceNetwork, Requires: microRequires},
+	{Name: "debug", Kind: ServiceNetwork, Requires: microRequires},
+	{Name: "debug-web", Kind: ServiceNetwork, Requires: append([]string{"netdata"}, microRequires...)},
+	{Name: "monitor", Kind: ServiceNetwork, Requires: microRequires},
+	{Name: "network-api", Kind: ServiceNetwork, Requires: microRequires},
+	{Name: "proxy", Kind: ServiceNetwork, Requires: microRequires},
+	{Name: "registry", Kind: ServiceNetwork, Requires: microRequires},
+	{Name: "router", Kind: ServiceNetwork, Requires: microRequires},
+	{Name: "store", Kind: ServiceNetwork, Requires: append([]string{"cockroachdb"}, microRequires...)},
+	{Name: "web", Kind: ServiceNetwork, Requires: microRequires},
+}
+
+// moduleFiles are the files of each module every service needs
+var moduleFiles = map[string][]string{
+	ServiceControl:  {"variables.tf", "control.tf"},
+	ServiceResource: {"variables.tf"},
+	ServiceNetwork:  {"variables.tf", "credentials.tf"},
+}
+
+// selectServices returns the services of a kind named in a region's config.
+// An empty list selects every service of the kind.
+func selectServices(kind string, names []string) ([]Service, error) {
+	var selected []Service
+	if len(names) == 0 {
+		for _, s := range Catalogue {
+			if s.Kind == kind {
+				selected = append(selected, s)
+			}
+		}
+		return selected, nil
+	}
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if seen[name] {
+			return nil, errors.Errorf("%s service %s is listed twice", kind, name)
+		}
+		seen[name] = true
+		s, ok := findService(kind, name)
+		if !ok {
+			return nil, errors.Errorf("Unknown %s service %s, expected one of %s", kind, name, strings.Join(serviceNames(kind), ", "))
+		}
+		selected = append(selected, s)
+	}
+	return selected, nil
+}
+
+func findService(kind, name string) (Service, bool) {
+	for _, s := range Catalogue {
+		if s.Kind == kind && s.Name == name {
+			return s, true
+		}
+	}
+	return Service{}, false
+}
+
+func hasService(services []Service, name string) bool {
+	for _, s := range services {
+		if s.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func serviceNames(kind string) []string {
+	var names []string
+	for _, s := range Catalogue {
+		if s.Kind == kind {
+			names = append(names, s.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// serviceFiles returns the files of a module that deploy the services
+func serviceFiles(kind string, services []Service) []string {
+	files := append([]string(nil), moduleFiles[kind]...)
+	for _, s := range services {
+		files = append(files, s.File())
+	}
+	return files
+}
+
+// regionServices are the services a region deploys, by kind
+type regionServices map[string][]Service
+
+// serviceKinds are the kinds of service, in the order they're deployed
+var serviceKinds = []string{ServiceResource, ServiceControl, ServiceNetwork}
+
+// selectRegionServices selects the control, resource and network services of
+// a region, checking every service's requirements are deployed in the region too
+func selectRegionServices(region, provider string, control, resource, network []string) (regionServices, error) {
+	rs := make(regionServices)
+	names := map[string][]string{ServiceControl: control, ServiceResource: resource, ServiceNetwork: network}
+	for _, kind := range serviceKinds {
+		s, err := selectServices(kind, names[kind])
+		if err != nil {
+			return nil, errors.Wrapf(err, "Region %s-%s", region, provider)
+		}
+		rs[kind] = s
+	}
+	resources := make(map[string]bool)
+	for _, s := range rs[ServiceResource] {
+		resources[s.Name] = true
+	}
+	for _, kind := range serviceKinds {
+		for _, s := range rs[kind] {
+			for _, req := range s.Requires {
+				if !resources[req] {
+					return nil, errors.Errorf("Region %s-%s: %s service %s requires the %s resource, add it to the region's resource list",
+						region, provider, kind, s.Name, req)
+				}
+			}
+		}
+	}
+	return rs, nil
+}
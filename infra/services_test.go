@@ -0,0 +1,115 @@
+package infra
+
+import (
+	"context"
+	"io/fs"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// TestCatalogue checks the catalogue matches the files of the bundled modules
+func TestCatalogue(t *testing.T) {
+	for _, kind := range serviceKinds {
+		files, err := fs.Glob(modules, kind+"/*.tf")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, f := range files {
+			got = append(got, path.Base(f))
+		}
+		services, _ := selectServices(kind, nil)
+		want := serviceFiles(kind, services)
+		sort.Strings(want)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: the catalogue has files %v, the module has %v", kind, want, got)
+		}
+	}
+}
+
+func TestPlatformServices(t *testing.T) {
+	p := &Platform{Name: "micro", Kv: "cloudflare", Regions: []Region{{
+		Provider: "do",
+		Region:   "lon1",
+		Control:  []string{"network"},
+		Resource: []string{"etcd", "nats", "cockroachdb"},
+		Network:  []string{"registry", "store"},
+	}}}
+	steps, err := p.Steps()
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string][]string)
+	for _, s := range steps {
+		for _, task := range s {
+			if m, ok := task.(*TerraformModule); ok {
+				files[moduleKind(m.ID)] = m.Files
+			}
+		}
+	}
+	expected := map[string][]string{
+		"control":  {"variables.tf", "control.tf", "network.tf"},
+		"resource": {"variables.tf", "etcd.tf", "nats.tf", "cockroachdb.tf"},
+		"network":  {"variables.tf", "credentials.tf", "registry.tf", "store.tf"},
+	}
+	for kind, want := range expected {
+		if !reflect.DeepEqual(files[kind], want) {
+			t.Errorf("%s: expected files %v, got %v", kind, want, files[kind])
+		}
+	}
+	if files["k8s"] != nil || files["kv"] != nil {
+		t.Errorf("Expected the other modules to use every file, got %v", files)
+	}
+
+	// Omitted lists deploy everything
+	p.Regions[0] = Region{Provider: "do", Region: "lon1"}
+	if _, err := p.Steps(); err != nil {
+		t.Error(err)
+	}
+
+	tests := []struct {
+		region Region
+		err    string
+	}{
+		{Region{Network: []string{"regsitry"}}, "Unknown network service regsitry, expected one of api, broker"},
+		{Region{Control: []string{"bot", "bot"}}, "listed twice"},
+		{Region{Resource: []string{"etcd", "nats"}, Network: []string{"store"}}, "network service store requires the cockroachdb resource"},
+		{Region{Resource: []string{"cockroachdb"}}, "control service bot requires the etcd resource"},
+	}
+	for _, test := range tests {
+		test.region.Provider, test.region.Region = "do", "lon1"
+		p.Regions[0] = test.region
+		if _, err := p.Steps(); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("Expected an error containing %q, got %v", test.err, err)
+		}
+	}
+}
+
+func TestTerraformModuleFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "micro-platform-files-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	m := &TerraformModule{Name: "network", Path: dir, Files: []string{"variables.tf", "credentials.tf", "web.tf"}}
+	if err := m.fetchEmbedded(context.Background(), &url.URL{Scheme: "embed", Host: "network"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.selectFiles(); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*.tf"))
+	if len(files) != 3 {
+		t.Errorf("Expected only the selected files, got %v", files)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "service", "service.tf")); err != nil {
+		t.Error("Expected files in sub directories to be kept")
+	}
+}
@@ -0,0 +1,277 @@
+package infra
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+)
+
+// StateStore is a state backend whose states can be listed and read
+type StateStore interface {
+	// States lists every state in the backend
+	States(ctx context.Context) ([]StateObject, error)
+	// ReadState returns the state stored for key
+	ReadState(ctx context.Context, key string) (*StateObject, []byte, error)
+}
+
+// ErrStateNotFound is the cause of the error returned reading a state that doesn't exist
+var ErrStateNotFound = errors.New("State not found")
+
+// StateObject describes a state stored in a backend
+type StateObject struct {
+	Key      string
+	Modified time.Time
+	Size     int64
+}
+
+// ConfiguredStateStore returns the state-store config as a StateStore
+func ConfiguredStateStore() (StateStore, error) {
+	backend, err := configuredStateBackend()
+	if err != nil {
+		return nil, err
+	}
+	return asStateStore(backend)
+}
+
+func asStateStore(backend StateBackend) (StateStore, error) {
+	store, ok := backend.(StateStore)
+	if !ok {
+		return nil, errors.Errorf("Unsupported backend: states can't be listed or read in the %s state store, only in aws, azure and local", stateStoreName(backend))
+	}
+	return store, nil
+}
+
+// stateStoreName returns the state-store config value of a backend
+func stateStoreName(backend StateBackend) string {
+	switch backend.(type) {
+	case *S3Backend:
+		return "aws"
+	case *AzureRMBackend:
+		return "azure"
+	case *LocalBackend:
+		return "local"
+	case *GCSBackend:
+		return "gcs"
+	case *HTTPBackend:
+		return "http"
+	case *ConsulBackend:
+		return "consul"
+	case *PgBackend:
+		return "pg"
+	default:
+		return fmt.Sprintf("%T", backend)
+	}
+}
+
+// States lists the .tfstate files in the state directory
+func (b *LocalBackend) States(ctx context.Context) ([]StateObject, error) {
+	files, err := ioutil.ReadDir(b.Dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var states []StateObject
+	for _, fi := range files {
+		if fi.Mode().IsRegular() && strings.HasSuffix(fi.Name(), ".tfstate") {
+			states = append(states, StateObject{
+				Key:      strings.TrimSuffix(fi.Name(), ".tfstate"),
+				Modified: fi.ModTime(),
+				Size:     fi.Size(),
+			})
+		}
+	}
+	return states, nil
+}
+
+// ReadState reads a state file
+func (b *LocalBackend) ReadState(ctx context.Context, key string) (*StateObject, []byte, error) {
+	fi, err := os.Stat(b.Path(key))
+	if os.IsNotExist(err) {
+		return nil, nil, errors.Wrap(ErrStateNotFound, key)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := ioutil.ReadFile(b.Path(key))
+	if err != nil {
+		return nil, nil, err
+	}
+	return &StateObject{Key: key, Modified: fi.ModTime(), Size: fi.Size()}, data, nil
+}
+
+func (b *S3Backend) client() *s3.S3 {
+	return s3.New(session.New(&aws.Config{Region: aws.String(b.Region)}))
+}
+
+// States lists the objects in the state bucket
+func (b *S3Backend) States(ctx context.Context) ([]StateObject, error) {
+	var states []StateObject
+	err := b.client().ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{Bucket: aws.String(b.Bucket)}, func(page *s3.ListObjectsV2Output, last bool) bool {
+		for _, o := range page.Contents {
+			// States of terraform workspaces other than default aren't the platform's
+			if strings.HasPrefix(aws.StringValue(o.Key), "env:/") {
+				continue
+			}
+			states = append(states, StateObject{
+				Key:      aws.StringValue(o.Key),
+				Modified: aws.TimeValue(o.LastModified),
+				Size:     aws.Int64Value(o.Size),
+			})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not list the state bucket")
+	}
+	return states, nil
+}
+
+// ReadState downloads a state from the bucket
+func (b *S3Backend) ReadState(ctx context.Context, key string) (*StateObject, []byte, error) {
+	out, err := b.client().GetObjectWithContext(ctx, &s3.GetObjectInput{Bucket: aws.String(b.Bucket), Key: aws.String(key)})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+		return nil, nil, errors.Wrap(ErrStateNotFound, key)
+	}
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "Could not read state %s", key)
+	}
+	defer out.Body.Close()
+	data, err := ioutil.ReadAll(out.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &StateObject{Key: key, Modified: aws.TimeValue(out.LastModified), Size: int64(len(data))}, data, nil
+}
+
+// States lists the blobs in the state container
+func (b *AzureRMBackend) States(ctx context.Context) ([]StateObject, error) {
+	states, err := newAzureBlobClient(b).List(ctx, b.Container)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not list the state container")
+	}
+	return states, nil
+}
+
+// ReadState downloads a state from the container
+func (b *AzureRMBackend) ReadState(ctx context.Context, key string) (*StateObject, []byte, error) {
+	data, modified, err := newAzureBlobClient(b).Get(ctx, b.Container, key)
+	if aerr, ok := err.(*azureError); ok && aerr.Status == http.StatusNotFound {
+		return nil, nil, errors.Wrap(ErrStateNotFound, key)
+	}
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "Could not read state %s", key)
+	}
+	return &StateObject{Key: key, Modified: modified, Size: int64(len(data))}, data, nil
+}
+
+// State is the part of a terraform state file the platform reads
+type State struct {
+	Version          int             `json:"version"`
+	TerraformVersion string          `json:"terraform_version"`
+	Serial           int64           `json:"serial"`
+	Lineage          string          `json:"lineage"`
+	Resources        []StateResource `json:"resources"`
+}
+
+// StateResource is a resource in a terraform state
+type StateResource struct {
+	Module    string            `json:"module,omitempty"`
+	Mode      string            `json:"mode"`
+	Type      string            `json:"type"`
+	Name      string            `json:"name"`
+	Instances []json.RawMessage `json:"instances"`
+}
+
+// Address returns the resource's address, e.g. module.vpc.aws_subnet.private
+func (r StateResource) Address() string {
+	addr := r.Type + "." + r.Name
+	if r.Mode == "data" {
+		addr = "data." + addr
+	}
+	if len(r.Module) != 0 {
+		addr = r.Module + "." + addr
+	}
+	return addr
+}
+
+// ParseState parses a terraform state file
+func ParseState(b []byte) (*State, error) {
+	var s State
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, errors.Wrap(err, "Couldn't parse terraform state")
+	}
+	if s.Version < 4 {
+		return nil, errors.Errorf("Terraform state version %d isn't supported, it was written by terraform %s", s.Version, s.TerraformVersion)
+	}
+	return &s, nil
+}
+
+// StateKey is a state key split in to the parts Platform.Steps names modules with
+type StateKey struct {
+	Key      string
+	Platform string
+	// Region is global for modules shared by every region
+	Region   string
+	Provider string
+	Module   string
+}
+
+// ParseStateKey splits a state key in to platform, region, provider and
+// module, e.g. micro-lon1-do-network or micro-global-kv. It returns false
+// if the key isn't the state of one of the platforms' modules, e.g. it's
+// another platform's or micro-check-remote-state.
+func ParseStateKey(key string, platforms []string) (StateKey, bool) {
+	// Match the longest name first, in case one platform's name prefixes another's
+	names := append([]string(nil), platforms...)
+	sort.Slice(names, func(i, j int) bool { return len(names[i]) > len(names[j]) })
+	for _, name := range names {
+		if !strings.HasPrefix(key, name+"-") {
+			continue
+		}
+		rest := key[len(name)+1:]
+		if strings.HasPrefix(rest, "global-") {
+			module := strings.TrimPrefix(rest, "global-")
+			if !globalModuleKinds[module] {
+				continue
+			}
+			return StateKey{Key: key, Platform: name, Region: "global", Module: module}, true
+		}
+		// Regions can contain dashes, e.g. eu-west-2, providers and modules don't
+		parts := strings.Split(rest, "-")
+		module := parts[len(parts)-1]
+		if len(parts) < 3 || globalModuleKinds[module] || !isModuleKind(module) {
+			continue
+		}
+		return StateKey{
+			Key:      key,
+			Platform: name,
+			Region:   strings.Join(parts[:len(parts)-2], "-"),
+			Provider: parts[len(parts)-2],
+			Module:   module,
+		}, true
+	}
+	return StateKey{Key: key}, false
+}
+
+func isModuleKind(kind string) bool {
+	for _, k := range moduleKinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,113 @@
+package infra
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testState = `{
+  "version": 4,
+  "terraform_version": "0.12.26",
+  "serial": 7,
+  "lineage": "6f0e2d6a-2a7b-9d3c-1c8e-0c5e4d1b2a3f",
+  "outputs": {},
+  "resources": [
+    {"mode": "data", "type": "digitalocean_kubernetes_versions", "name": "versions", "instances": [{}]},
+    {"module": "module.vpc", "mode": "managed", "type": "aws_subnet", "name": "private", "instances": [{}, {}, {}]}
+  ]
+}`
+
+func TestLocalStates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "micro-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := &LocalBackend{Dir: filepath.Join(dir, "state")}
+	if states, err := store.States(context.Background()); err != nil || len(states) != 0 {
+		t.Fatalf("Expected no states before the directory exists, got %v %v", states, err)
+	}
+	os.Mkdir(store.Dir, 0700)
+	ioutil.WriteFile(store.Path("micro-lon1-do-network"), []byte(testState), 0600)
+	ioutil.WriteFile(filepath.Join(store.Dir, "micro-lon1-do-network.tfstate.backup"), []byte(testState), 0600)
+
+	states, err := store.States(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(states) != 1 || states[0].Key != "micro-lon1-do-network" || states[0].Size != int64(len(testState)) {
+		t.Fatalf("Expected only the state file, got %+v", states)
+	}
+	obj, data, err := store.ReadState(context.Background(), "micro-lon1-do-network")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !obj.Modified.Equal(states[0].Modified) || string(data) != testState {
+		t.Errorf("Unexpected state %+v", obj)
+	}
+	if _, _, err := store.ReadState(context.Background(), "micro-lon1-do-k8s"); err == nil {
+		t.Error("Expected an error reading a state that doesn't exist")
+	}
+}
+
+func TestParseState(t *testing.T) {
+	s, err := ParseState([]byte(testState))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Serial != 7 || s.Lineage != "6f0e2d6a-2a7b-9d3c-1c8e-0c5e4d1b2a3f" || len(s.Resources) != 2 {
+		t.Fatalf("Unexpected state %+v", s)
+	}
+	if a := s.Resources[0].Address(); a != "data.digitalocean_kubernetes_versions.versions" {
+		t.Errorf("Unexpected address %s", a)
+	}
+	if a := s.Resources[1].Address(); a != "module.vpc.aws_subnet.private" || len(s.Resources[1].Instances) != 3 {
+		t.Errorf("Unexpected address %s", a)
+	}
+	if _, err := ParseState([]byte(`{"version": 3, "terraform_version": "0.11.14"}`)); err == nil {
+		t.Error("Expected an error parsing a version 3 state")
+	}
+}
+
+func TestParseStateKey(t *testing.T) {
+	platforms := []string{"micro", "micro-staging"}
+	tests := []struct {
+		key      string
+		ok       bool
+		expected StateKey
+	}{
+		{"micro-global-kv", true, StateKey{Platform: "micro", Region: "global", Module: "kv"}},
+		{"micro-lon1-do-network", true, StateKey{Platform: "micro", Region: "lon1", Provider: "do", Module: "network"}},
+		{"micro-eu-west-2-aws-k8s", true, StateKey{Platform: "micro", Region: "eu-west-2", Provider: "aws", Module: "k8s"}},
+		{"micro-staging-lon1-do-control", true, StateKey{Platform: "micro-staging", Region: "lon1", Provider: "do", Module: "control"}},
+		{"other-lon1-do-network", false, StateKey{}},
+		{"micro-k8s", false, StateKey{}},
+		{"micro-check-remote-state", false, StateKey{}},
+		{"micro-lon1-do-k8s-lock-check", false, StateKey{}},
+		{"micro-global-network", false, StateKey{}},
+		{"micro-lon1-do-kv", false, StateKey{}},
+		{"micro-eu-west-2-aws-kubeconfig", true, StateKey{Platform: "micro", Region: "eu-west-2", Provider: "aws", Module: "kubeconfig"}},
+	}
+	for _, test := range tests {
+		k, ok := ParseStateKey(test.key, platforms)
+		test.expected.Key = test.key
+		if ok != test.ok || k != test.expected {
+			t.Errorf("%s: expected %+v %v, got %+v %v", test.key, test.expected, test.ok, k, ok)
+		}
+	}
+}
+
+func TestUnsupportedStateStore(t *testing.T) {
+	for _, b := range []StateBackend{&GCSBackend{}, &HTTPBackend{}, &ConsulBackend{}, &PgBackend{}} {
+		if _, err := asStateStore(b); err == nil || !strings.Contains(err.Error(), "Unsupported backend: states can't be listed or read in the "+stateStoreName(b)) {
+			t.Errorf("Expected an unsupported backend error, got %v", err)
+		}
+	}
+	if _, err := asStateStore(&LocalBackend{}); err != nil {
+		t.Error(err)
+	}
+}
@@ -2,18 +2,21 @@ package infra
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
-	"text/template"
+	"time"
 
 	"github.com/pkg/errors"
-	"github.com/spf13/viper"
 )
 
 // TerraformModule is a task that fetches and applies a terraform module
@@ -24,20 +27,73 @@ type TerraformModule struct {
 	Name string
 	// Path is the path to the module. It's set to working directory for terraform
 	Path string
-	// Source is a net.URL to the module
+	// Source is a net.URL to the module. http and https sources are tar.gz or
+	// zip archives, e.g. https://example.com/modules.tar.gz//network?sha256=...
+	// git, git+https and git+ssh sources are git repositories checked out at
+	// an optional ref, e.g. git+https://github.com/org/repo.git//network?ref=v1.0.0
+	// embed sources are modules bundled in the binary, e.g. embed://network
 	Source string
+	// RequireChecksum rejects http and https sources without a sha256 checksum
+	RequireChecksum bool
+	// GitCacheDir is where git sources are cloned to. Defaults to DefaultGitCacheDir
+	GitCacheDir string
+	// Files, if set, are glob patterns of the .tf files in the root of the
+	// source to use, e.g. to deploy only some of the services a module defines.
+	// The other .tf files in the root are removed once the source is fetched.
+	Files []string
 	// Any environment variables to pass to terraform
 	Env map[string]string
-	// Any terraform variables
-	Variables map[string]string
+	// Any terraform variables. Values can be strings, numbers, bools, lists or
+	// maps, they're written to micro-platform.auto.tfvars.json with their types
+	Variables map[string]interface{}
 	// Any remote states to import key = state name, value = remote state ID
 	RemoteStates map[string]string
+	// IDs of any other tasks that must complete first, e.g. one that writes a kubeconfig
+	DependsOn []string
 	// Dry-run
 	DryRun bool
+	// Timeout limits how long each phase of the module may take, 0 for no limit
+	Timeout time.Duration
+	// Retry retries validate, apply and destroy when they fail with a
+	// transient error, nil to never retry. Saved plans are never retried.
+	Retry *RetryPolicy
+	// InterruptTimeout is how long terraform is given to exit after being
+	// interrupted, before it is killed. Defaults to DefaultInterruptTimeout
+	InterruptTimeout time.Duration
+	// Backend stores the module's state. Defaults to the state-store config
+	Backend StateBackend
+	// PlanDir, if set, is where Plan saves the plan and where Apply reads it
+	// from, so that apply makes exactly the changes that were reviewed
+	PlanDir string
+	// PlanKey encrypts the saved plans of modules with secret variables, as
+	// terraform writes every variable's value in to the plan
+	PlanKey string
+
+	// summary of the last plan
+	summary *ModulePlan
+	// revision is the commit a git source was checked out at
+	revision string
+	// outputs read from the state after the last plan or apply
+	outputs map[string]interface{}
+	// secrets resolved from the variables, by reference, to redact from output
+	secrets map[string]string
 }
 
+// DefaultInterruptTimeout is how long terraform is given to exit after being interrupted
+const DefaultInterruptTimeout = time.Minute
+
+// tfPlanFile is where Plan saves the plan, relative to the module path
+const tfPlanFile = "micro-platform.tfplan"
+
+// tfVarsFile is where the module's variables are written, relative to the module path
+const tfVarsFile = "micro-platform.auto.tfvars.json"
+
 // Validate attempts to fetch terraform code then runs terraform init and terraform validate
-func (t *TerraformModule) Validate() error {
+func (t *TerraformModule) Validate(ctx context.Context) error {
+	return t.withTimeout(ctx, PhaseValidate, t.validate)
+}
+
+func (t *TerraformModule) validate(ctx context.Context) error {
 	if err := os.MkdirAll(t.Path, 0o777); err != nil {
 		return err
 	}
@@ -50,19 +106,27 @@ func (t *TerraformModule) Validate() error {
 		return err
 	}
 	switch u.Scheme {
-	case "http":
-		fallthrough
-	case "https":
-		return errors.New("TODO: Download and extract " + u.String() + " to " + t.Path)
-	case "git":
-		return errors.New("TODO: Clone " + u.String() + " to " + t.Path)
+	case "http", "https":
+		if err := t.fetchArchive(ctx, u); err != nil {
+			return err
+		}
+	case "git", "git+https", "git+ssh", "git+file":
+		if err := t.fetchGit(ctx, u); err != nil {
+			return err
+		}
+	case "embed":
+		if err := t.fetchEmbedded(ctx, u); err != nil {
+			return err
+		}
 	default:
 		if len(u.Scheme) == 0 {
-			fmt.Fprintf(os.Stderr, "[%s] No source scheme provided, assuming path to directory\n", t.Name)
+			logf(ctx, t, "No source scheme provided, assuming path to directory")
 			if _, err := os.Stat(u.Path); err != nil {
 				return err
 			}
-			if err := filepath.Walk(u.Path, t.filecopy); err != nil {
+			if err := filepath.Walk(u.Path, func(path string, fi os.FileInfo, err error) error {
+				return t.filecopy(ctx, path, fi, err)
+			}); err != nil {
 				return errors.Wrap(err, "filepath.Walk failed")
 			}
 		} else {
@@ -70,6 +134,10 @@ func (t *TerraformModule) Validate() error {
 		}
 	}
 
+	if err := t.selectFiles(); err != nil {
+		return err
+	}
+
 	// Set up remote state storage
 	if err := t.generateBackendConfig(); err != nil {
 		return err
@@ -81,104 +149,296 @@ func (t *TerraformModule) Validate() error {
 	}
 
 	// Initialise terraform and validate the syntax is correct
-	if err := t.execTerraform(context.Background(), "init"); err != nil {
+	return t.retry(ctx, func() error {
+		if err := t.execTerraform(ctx, "init"); err != nil {
+			return err
+		}
+		return t.execTerraform(ctx, "validate")
+	})
+}
+
+// selectFiles removes the .tf files in the root of the module that don't match Files
+func (t *TerraformModule) selectFiles() error {
+	if t.Files == nil {
+		return nil
+	}
+	for _, pattern := range t.Files {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return errors.Wrapf(err, "Module %s: invalid file pattern %s", t.Name, pattern)
+		}
+	}
+	files, err := filepath.Glob(filepath.Join(t.Path, "*.tf"))
+	if err != nil {
 		return err
 	}
-	return t.execTerraform(context.Background(), "validate")
+	for _, f := range files {
+		name := filepath.Base(f)
+		if generatedFiles[name] || matchAny(t.Files, name) {
+			continue
+		}
+		if err := os.Remove(f); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-// Plan runs terraform plan
-func (t *TerraformModule) Plan() error {
-	return t.execTerraform(context.Background(), "plan")
+func matchAny(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if ok, _ := filepath.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
 }
 
-// Apply runs terraform apply
-func (t *TerraformModule) Apply() error {
-	if t.DryRun {
-		_, err := fmt.Fprintf(os.Stderr, "[%s] Dry run enabled, skipping apply\n", t.Name)
+// Plan runs terraform plan, saving the plan so the changes can be summarised
+func (t *TerraformModule) Plan(ctx context.Context) error {
+	return t.withTimeout(ctx, PhasePlan, t.plan)
+}
+
+func (t *TerraformModule) plan(ctx context.Context) error {
+	if err := t.execTerraform(ctx, "plan", "-input=false", "-out="+tfPlanFile); err != nil {
 		return err
 	}
-	return t.execTerraform(context.Background(), "apply", "-auto-approve")
+	out, err := t.outputTerraform(ctx, "show", "-json", tfPlanFile)
+	if err != nil {
+		return errors.Wrap(err, "terraform show failed")
+	}
+	plan, err := parsePlan(out)
+	if err != nil {
+		return err
+	}
+	plan.ID = t.ID
+	plan.Name = t.Name
+	plan.Revision = t.revision
+	t.summary = plan
+	// Later modules may reference outputs that are already in the state. If
+	// there's no state yet, they'll fail with a clearer error when resolving them.
+	if err := t.readOutputs(ctx); err != nil {
+		logf(ctx, t, "Couldn't read outputs: %s", err)
+	}
+	if len(t.PlanDir) != 0 {
+		return t.savePlan()
+	}
+	return nil
+}
+
+// PlanSummary returns the changes found by the last call to Plan, or nil
+func (t *TerraformModule) PlanSummary() *ModulePlan {
+	return t.summary
+}
+
+// Apply runs terraform apply, applying the saved plan if PlanDir is set
+func (t *TerraformModule) Apply(ctx context.Context) error {
+	return t.withTimeout(ctx, PhaseApply, t.apply)
 }
 
-// Destroy runs terraform apply
-func (t *TerraformModule) Destroy() error {
+func (t *TerraformModule) apply(ctx context.Context) error {
 	if t.DryRun {
-		_, err := fmt.Fprintf(os.Stderr, "[%s] Dry run enabled, skipping destroy\n", t.Name)
+		logf(ctx, t, "Dry run enabled, skipping apply")
+		return nil
+	}
+	if len(t.PlanDir) != 0 {
+		if err := t.loadPlan(); err != nil {
+			return err
+		}
+		// A saved plan can't be applied twice, terraform refuses it as stale once
+		// the first attempt has changed the state, so it's never retried. Plan
+		// again to pick up from a transient failure.
+		if err := t.execTerraform(ctx, "apply", "-input=false", tfPlanFile); err != nil {
+			return err
+		}
+		return t.readOutputs(ctx)
+	}
+	if err := t.retry(ctx, func() error {
+		return t.execTerraform(ctx, "apply", "-auto-approve")
+	}); err != nil {
 		return err
 	}
-	return t.execTerraform(context.Background(), "destroy", "-auto-approve")
+	return t.readOutputs(ctx)
+}
+
+// Destroy runs terraform destroy
+func (t *TerraformModule) Destroy(ctx context.Context) error {
+	return t.withTimeout(ctx, PhaseDestroy, t.destroy)
+}
+
+func (t *TerraformModule) destroy(ctx context.Context) error {
+	if t.DryRun {
+		logf(ctx, t, "Dry run enabled, skipping destroy")
+		return nil
+	}
+	return t.retry(ctx, func() error {
+		return t.execTerraform(ctx, "destroy", "-auto-approve")
+	})
+}
+
+// withTimeout runs a phase of the module, interrupting it if it takes longer than Timeout
+func (t *TerraformModule) withTimeout(ctx context.Context, phase string, fn func(context.Context) error) error {
+	if t.Timeout <= 0 {
+		return fn(ctx)
+	}
+	tctx, cancel := context.WithTimeout(ctx, t.Timeout)
+	defer cancel()
+	err := fn(tctx)
+	if err != nil && tctx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+		return errors.Wrapf(err, "Module %s timed out during %s after %s", t.Name, phase, t.Timeout)
+	}
+	return err
+}
+
+// Exists returns true if the module already has resources in its state.
+// It must be called after Validate.
+func (t *TerraformModule) Exists(ctx context.Context) (bool, error) {
+	out, err := t.outputTerraform(ctx, "state", "list")
+	if err != nil {
+		return false, errors.Wrap(err, "terraform state list failed")
+	}
+	return len(bytes.TrimSpace(out)) != 0, nil
 }
 
 // Finalise removes the directory
-func (t *TerraformModule) Finalise() error {
+func (t *TerraformModule) Finalise(ctx context.Context) error {
 	return os.RemoveAll(t.Path)
 }
 
 func (t *TerraformModule) execTerraform(ctx context.Context, args ...string) error {
-	// Set up terraform command
-	tf := exec.CommandContext(ctx, "terraform", args...)
+	return t.runTerraform(ctx, nil, args...)
+}
+
+// outputTerraform runs terraform and returns its stdout instead of logging it
+func (t *TerraformModule) outputTerraform(ctx context.Context, args ...string) ([]byte, error) {
+	var out bytes.Buffer
+	err := t.runTerraform(ctx, &out, args...)
+	return out.Bytes(), err
+}
+
+// runTerraform runs terraform in the module directory. stderr is always logged,
+// stdout is written to w, or logged if w is nil.
+func (t *TerraformModule) runTerraform(ctx context.Context, w io.Writer, args ...string) error {
+	// Secrets are resolved on every run and passed in the environment, so
+	// they're kept out of the tfvars file. terraform still writes them in to
+	// plans, see savePlan
+	vars, secretEnv, err := t.resolveSecrets(ctx)
+	if err != nil {
+		return err
+	}
+	// Variables can change between runs, e.g. before destroying a kubeconfig
+	if err := t.writeVariables(vars); err != nil {
+		return errors.Wrap(err, "Couldn't write terraform variables")
+	}
+
+	// Set up terraform command. It isn't started with exec.CommandContext, as that
+	// kills terraform outright; it's interrupted below so it can release state locks
+	tf := exec.Command("terraform", args...)
+	// Run terraform in its own process group so an interrupt from the terminal
+	// only reaches us, otherwise terraform would see it twice and exit immediately
+	setProcessGroup(tf)
 	tf.Dir = t.Path
 	tf.Env = os.Environ()
 	for k, v := range t.Env {
 		tf.Env = append(tf.Env, fmt.Sprintf("%s=%s", k, v))
 	}
-	for k, v := range t.Variables {
-		tf.Env = append(tf.Env, fmt.Sprintf("TF_VAR_%s=%s", k, v))
-	}
+	tf.Env = append(tf.Env, secretEnv...)
 	tf.Env = append(tf.Env, "TF_PLUGIN_CACHE_DIR=/tmp/micro-platform-plugin-cache")
-	stdout, err := tf.StdoutPipe()
-	if err != nil {
-		return errors.Wrap(err, "StdoutPipe failed")
+
+	type ioPair struct {
+		in     io.Reader
+		stream string
+	}
+	var pairs []ioPair
+	if w != nil {
+		tf.Stdout = w
+	} else {
+		stdout, err := tf.StdoutPipe()
+		if err != nil {
+			return errors.Wrap(err, "StdoutPipe failed")
+		}
+		pairs = append(pairs, ioPair{in: stdout, stream: StreamStdout})
 	}
 	stderr, err := tf.StderrPipe()
 	if err != nil {
 		return errors.Wrap(err, "StderrPipe failed")
 	}
+	// Keep stderr so failures can be checked against the retry policy
+	var stderrBuf bytes.Buffer
+	pairs = append(pairs, ioPair{in: io.TeeReader(stderr, &stderrBuf), stream: StreamStderr})
+
+	if err := tf.Start(); err != nil {
+		return errors.Wrap(err, "Couldn't execute terraform")
+	}
+	trackProcess(tf)
+	defer untrackProcess(tf)
 
 	// Wait so we don't truncate output from the underlying terraform binary
 	ioWait := make(chan struct{})
-	defer func() {
-		// wait for the buffered readers/writers to finish
-		<-ioWait
-		<-ioWait
-	}()
-
-	for _, ioPair := range []struct {
-		in  io.ReadCloser
-		out *os.File
-	}{
-		{in: stdout, out: os.Stdout},
-		{in: stderr, out: os.Stderr},
-	} {
-		go func(name string, in io.ReadCloser, out *os.File, done chan<- struct{}) {
+	for _, p := range pairs {
+		go func(in io.Reader, stream string, done chan<- struct{}) {
 			r := bufio.NewReader(in)
 			defer func() { done <- struct{}{} }()
-			defer in.Close()
 			for {
 				s, err := r.ReadString('\n')
 				if err == nil || err == io.EOF {
 					if len(strings.TrimSpace(s)) != 0 {
-						fmt.Fprintf(out, "[%s] %s", name, s)
+						notify(ctx, t, Event{Type: EventOutput, Stream: stream, Message: t.redact(strings.TrimRight(s, "\r\n"))})
 					}
 					if err == io.EOF {
 						return
 					}
 				} else {
-					fmt.Fprintf(out, "[%s] Error: %s\n", name, err.Error())
+					notify(ctx, t, Event{Type: EventOutput, Stream: stream, Message: "Error: " + err.Error()})
 					return
 				}
 			}
-		}(t.Name, ioPair.in, ioPair.out, ioWait)
+		}(p.in, p.stream, ioWait)
 	}
-	if err := tf.Start(); err != nil {
-		return errors.Wrap(err, "Couldn't execute terraform")
+	exited := make(chan struct{})
+	defer close(exited)
+	go t.interruptOnCancel(ctx, tf, exited)
+
+	// wait for the buffered readers/writers to finish before Wait closes the pipes
+	for range pairs {
+		<-ioWait
 	}
 
-	return tf.Wait()
+	err = tf.Wait()
+	if err != nil && ctx.Err() != nil {
+		return errors.Wrapf(err, "terraform %s interrupted", args[0])
+	}
+	if err != nil {
+		return &terraformError{err: err, command: args[0], stderr: t.redact(stderrBuf.String())}
+	}
+	return nil
 }
 
-func (t *TerraformModule) filecopy(path string, fi os.FileInfo, err error) error {
+// interruptOnCancel interrupts terraform and the processes it started when ctx
+// is cancelled, giving them InterruptTimeout to exit gracefully before they're killed
+func (t *TerraformModule) interruptOnCancel(ctx context.Context, tf *exec.Cmd, exited <-chan struct{}) {
+	select {
+	case <-exited:
+		return
+	case <-ctx.Done():
+	}
+	timeout := t.InterruptTimeout
+	if timeout == 0 {
+		timeout = DefaultInterruptTimeout
+	}
+	logf(ctx, t, "Interrupting terraform, waiting up to %s for it to exit", timeout)
+	// terraform runs in its own process group, its provider plugins with it
+	if err := interruptProcessGroup(tf); err != nil {
+		killProcessGroup(tf)
+		return
+	}
+	select {
+	case <-exited:
+	case <-time.After(timeout):
+		logf(ctx, t, "terraform didn't exit in time, killing it. The state may still be locked")
+		killProcessGroup(tf)
+	}
+}
+
+func (t *TerraformModule) filecopy(ctx context.Context, path string, fi os.FileInfo, err error) error {
 	if strings.HasPrefix(path, "./") ||
 		strings.Contains(path, "tfstate") ||
 		strings.Contains(path, ".terraform") ||
@@ -207,7 +467,7 @@ func (t *TerraformModule) filecopy(path string, fi os.FileInfo, err error) error
 			return err
 		}
 	} else {
-		fmt.Fprintf(os.Stderr, "[%s] Encountered non regular file or directory: %s\n", t.Name, path)
+		logf(ctx, t, "Encountered non regular file or directory: %s", path)
 	}
 	return nil
 }
@@ -217,187 +477,55 @@ func (t *TerraformModule) cleanPath(in string) string {
 	return strings.TrimPrefix(in, prefix+string([]rune{filepath.Separator}))
 }
 
-func (t *TerraformModule) generateBackendConfig() error {
-	stateStore := viper.GetString("state-store")
-	if len(stateStore) == 0 {
-		stateStore = viper.GetString("cloud-provider")
-	}
-	switch stateStore {
-	case "aws":
-		return t.generateBackendConfigAWS()
-	case "azure":
-		return t.generateBackendConfigAzure()
-	default:
-		return errors.New(stateStore + " is not a supported remote state store")
+// writeVariables writes variables to a tfvars file, which terraform loads automatically
+func (t *TerraformModule) writeVariables(vars map[string]interface{}) error {
+	if vars == nil {
+		vars = map[string]interface{}{}
 	}
-}
-
-func (t *TerraformModule) generateBackendConfigAWS() error {
-	backend := template.Must(template.New(t.ID + "backend").Parse(tfS3BackendTemplate))
-	f, err := os.OpenFile(filepath.Join(t.Path, "backend-config-micro-platform.tf"), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	b, err := json.MarshalIndent(vars, "", "  ")
 	if err != nil {
 		return err
 	}
-	if err := backend.Execute(f, struct {
-		Key         string
-		Region      string
-		StateBucket string
-		LockTable   string
-	}{
-		Key: t.ID,
-		Region: func() string {
-			if r := os.Getenv("AWS_REGION"); len(r) != 0 {
-				return r
-			}
-			return "eu-west-2"
-		}(),
-		StateBucket: viper.GetString("aws-s3-bucket"),
-		LockTable:   viper.GetString("aws-dynamodb-table"),
-	}); err != nil {
-		f.Close()
-		return err
-	}
+	return ioutil.WriteFile(filepath.Join(t.Path, tfVarsFile), append(b, '\n'), 0o600)
+}
 
-	return f.Close()
+// stateBackend returns where the module's state is stored
+func (t *TerraformModule) stateBackend() (StateBackend, error) {
+	if t.Backend != nil {
+		return t.Backend, nil
+	}
+	return configuredStateBackend()
 }
 
-func (t *TerraformModule) generateBackendConfigAzure() error {
-	backend := template.Must(template.New(t.ID + "backend").Parse(tfAzureRMBackendTemplate))
-	f, err := os.OpenFile(filepath.Join(t.Path, "backend-config-micro-platform.tf"), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+func (t *TerraformModule) generateBackendConfig() error {
+	backend, err := t.stateBackend()
 	if err != nil {
 		return err
 	}
-	if err := backend.Execute(f, struct {
-		ResourceGroupName  string
-		StorageAccountName string
-		ContainerName      string
-		Key                string
-	}{
-		ResourceGroupName:  viper.GetString("azure-state-resource-group"),
-		StorageAccountName: viper.GetString("azure-storage-account"),
-		ContainerName:      viper.GetString("azure-storage-container"),
-		Key:                t.ID,
-	}); err != nil {
-		f.Close()
+	config, err := backend.Backend(t.ID)
+	if err != nil {
 		return err
 	}
-
-	return f.Close()
+	return ioutil.WriteFile(filepath.Join(t.Path, "backend-config-micro-platform.tf"), []byte(config), 0o600)
 }
 
 func (t *TerraformModule) generateRemoteStateDataSources() error {
-	stateStore := viper.GetString("state-store")
-	if len(stateStore) == 0 {
-		stateStore = viper.GetString("cloud-provider")
-	}
-	switch stateStore {
-	case "aws":
-		return t.generateRemoteStateAws()
-	case "azure":
-		return t.generateRemoteStateAzure()
-	default:
-		return errors.New(stateStore + " is not a supported remote state store")
-	}
-}
-
-func (t *TerraformModule) generateRemoteStateAws() error {
-	remote := template.Must(template.New(t.ID + "remote").Parse(tfS3RemoteStateTemplate))
-	f, err := os.OpenFile(filepath.Join(t.Path, "remote-state-data-sources-micro-platform.tf"), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	backend, err := t.stateBackend()
 	if err != nil {
 		return err
 	}
-	for k, v := range t.RemoteStates {
-		if err := remote.Execute(f, struct {
-			RemoteStateName string
-			StateBucket     string
-			LockTable       string
-			Key             string
-			Region          string
-		}{
-			RemoteStateName: k,
-			StateBucket:     viper.GetString("aws-s3-bucket"),
-			LockTable:       viper.GetString("aws-dynamodb-table"),
-			Key:             v,
-			Region: func() string {
-				if r := os.Getenv("AWS_REGION"); len(r) != 0 {
-					return r
-				}
-				return "eu-west-2"
-			}(),
-		}); err != nil {
-			return err
-		}
-	}
-	return f.Close()
-}
-
-func (t *TerraformModule) generateRemoteStateAzure() error {
-	remote := template.Must(template.New(t.ID + "remote").Parse(tfAzureRmStateTemplate))
-	f, err := os.OpenFile(filepath.Join(t.Path, "remote-state-data-sources-micro-platform.tf"), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
-	if err != nil {
-		return err
+	names := make([]string, 0, len(t.RemoteStates))
+	for k := range t.RemoteStates {
+		names = append(names, k)
 	}
-	for k, v := range t.RemoteStates {
-		if err := remote.Execute(f, struct {
-			RemoteStateName    string
-			ResourceGroupName  string
-			StorageAccountName string
-			ContainerName      string
-			Key                string
-		}{
-			RemoteStateName:    k,
-			ResourceGroupName:  viper.GetString("azure-state-resource-group"),
-			StorageAccountName: viper.GetString("azure-storage-account"),
-			ContainerName:      viper.GetString("azure-storage-container"),
-			Key:                v,
-		}); err != nil {
+	sort.Strings(names)
+	var buf bytes.Buffer
+	for _, name := range names {
+		data, err := backend.RemoteState(name, t.RemoteStates[name])
+		if err != nil {
 			return err
 		}
+		buf.WriteString(data)
 	}
-	return f.Close()
-}
-
-const tfS3BackendTemplate = `terraform {
-  backend "s3" {
-    bucket         = "{{.StateBucket}}"
-    dynamodb_table = "{{.LockTable}}"
-    key            = "{{.Key}}"
-    region         = "{{.Region}}"
-  }
+	return ioutil.WriteFile(filepath.Join(t.Path, "remote-state-data-sources-micro-platform.tf"), buf.Bytes(), 0o600)
 }
-`
-const tfS3RemoteStateTemplate = `data "terraform_remote_state" "{{.RemoteStateName}}" {
-  backend = "s3"
-
-  config = {
-    bucket         = "{{.StateBucket}}"
-    dynamodb_table = "{{.LockTable}}"
-    key            = "{{.Key}}"
-    region         = "{{.Region}}"
-  }
-}
-
-`
-
-const tfAzureRMBackendTemplate = `terraform {
-  backend "azurerm" {
-    resource_group_name  = "{{.ResourceGroupName}}"
-    storage_account_name = "{{.StorageAccountName}}"
-    container_name       = "{{.ContainerName}}"
-    key                  = "{{.Key}}"
-  }
-}
-`
-
-const tfAzureRmStateTemplate = `data "terraform_remote_state" "{{.RemoteStateName}}" {
-  backend = "azurerm"
-
-  config = {
-    resource_group_name  = "{{.ResourceGroupName}}"
-    storage_account_name = "{{.StorageAccountName}}"
-    container_name       = "{{.ContainerName}}"
-    key                  = "{{.Key}}"
-  }
-}
-
-`
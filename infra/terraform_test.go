@@ -1,9 +1,15 @@
 package infra
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
@@ -21,14 +27,105 @@ func TestTerraformModule(t *testing.T) {
 		Source: "./network",
 		DryRun: true,
 	}
-	defer testModule.Finalise()
-	if err := testModule.Validate(); err != nil {
+	defer testModule.Finalise(context.Background())
+	if err := testModule.Validate(context.Background()); err != nil {
 		t.Error(err)
 	}
-	if err := testModule.Plan(); err != nil {
+	if err := testModule.Plan(context.Background()); err != nil {
 		t.Error(err)
 	}
-	if err := testModule.Apply(); err != nil {
+	if err := testModule.Apply(context.Background()); err != nil {
 		t.Error(err)
 	}
 }
+
+func TestTerraformModuleTimeout(t *testing.T) {
+	m := &TerraformModule{Name: "test", Timeout: 10 * time.Millisecond}
+	err := m.withTimeout(context.Background(), PhaseApply, func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if err == nil || !strings.Contains(err.Error(), "timed out during apply") {
+		t.Errorf("Expected a timeout error, got %v", err)
+	}
+
+	// The caller cancelling isn't a timeout
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = m.withTimeout(ctx, PhaseApply, func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+}
+
+func TestPlatformTimeouts(t *testing.T) {
+	p := &Platform{
+		Name:     "micro",
+		Kv:       "cloudflare",
+		Timeout:  time.Hour,
+		Timeouts: map[string]time.Duration{"network": 45 * time.Minute},
+	}
+	p.Regions = append(p.Regions, Region{Provider: "do", Region: "lon1"})
+	steps, err := p.Steps()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range steps {
+		for _, task := range s {
+			m, ok := task.(*TerraformModule)
+			if !ok {
+				continue
+			}
+			want := time.Hour
+			if moduleKind(m.ID) == "network" {
+				want = 45 * time.Minute
+			}
+			if m.Timeout != want {
+				t.Errorf("%s: expected timeout %s, got %s", m.ID, want, m.Timeout)
+			}
+		}
+	}
+}
+
+func TestTerraformModuleVariables(t *testing.T) {
+	dir, err := ioutil.TempDir("", "micro-platform-vars-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	m := &TerraformModule{
+		Name: "test",
+		Path: dir,
+		Variables: map[string]interface{}{
+			"name":     "micro",
+			"in_aws":   true,
+			"replicas": 3,
+			"args":     []string{"micro-lon1-do-k8s", "eu-west-2"},
+			"labels":   map[string]string{"team": "platform"},
+		},
+	}
+	if err := m.writeVariables(m.Variables); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, tfVarsFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vars map[string]interface{}
+	if err := json.Unmarshal(b, &vars); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"name":     "micro",
+		"in_aws":   true,
+		"replicas": float64(3),
+		"args":     []interface{}{"micro-lon1-do-k8s", "eu-west-2"},
+		"labels":   map[string]interface{}{"team": "platform"},
+	}
+	if !reflect.DeepEqual(vars, expected) {
+		t.Errorf("Expected %v, got %v", expected, vars)
+	}
+}
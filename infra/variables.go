@@ -0,0 +1,132 @@
+package infra
+
+import (
+	"fmt"
+	"io/fs"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// variableDecl matches the declaration of a terraform variable
+var variableDecl = regexp.MustCompile(`(?m)^variable\s+"([^"]+)"`)
+
+// declaredVariables returns the variables an embedded module declares, nil
+// for modules from other sources
+func declaredVariables(source string) map[string]bool {
+	u, err := url.Parse(source)
+	if err != nil || u.Scheme != "embed" {
+		return nil
+	}
+	files, _ := fs.Glob(modules, path.Join(embeddedModule(u), "*.tf"))
+	declared := make(map[string]bool)
+	for _, f := range files {
+		b, err := fs.ReadFile(modules, f)
+		if err != nil {
+			continue
+		}
+		for _, m := range variableDecl.FindAllStringSubmatch(string(b), -1) {
+			declared[m[1]] = true
+		}
+	}
+	return declared
+}
+
+// mergeVariables merges maps of variables, values in later maps taking precedence
+func mergeVariables(maps ...map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{})
+	for _, m := range maps {
+		for k, v := range m {
+			merged[k] = v
+		}
+	}
+	return merged
+}
+
+// normaliseVariable deep copies a variable, converting maps decoded from YAML
+// to map[string]interface{} so they can be written to the tfvars file as JSON
+func normaliseVariable(v interface{}) interface{} {
+	switch val := v.(type) {
+	case []string:
+		return append([]string(nil), val...)
+	case map[string]string:
+		m := make(map[string]string, len(val))
+		for k, e := range val {
+			m[k] = e
+		}
+		return m
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(val))
+		for k, e := range val {
+			m[fmt.Sprint(k)] = normaliseVariable(e)
+		}
+		return m
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(val))
+		for k, e := range val {
+			m[k] = normaliseVariable(e)
+		}
+		return m
+	case []interface{}:
+		list := make([]interface{}, len(val))
+		for i, e := range val {
+			list[i] = normaliseVariable(e)
+		}
+		return list
+	default:
+		return v
+	}
+}
+
+// setVariables sets variables in every module of the steps that declares
+// them, returning the names of the variables that were set. Variables the
+// platform sets itself, e.g. domain_name, can't be overridden.
+func setVariables(vars map[string]interface{}, steps []Step) (map[string]bool, error) {
+	used := make(map[string]bool)
+	for _, s := range steps {
+		for _, t := range s {
+			m, ok := t.(*TerraformModule)
+			if !ok {
+				continue
+			}
+			declared := declaredVariables(m.Source)
+			for k, v := range vars {
+				if !declared[k] {
+					continue
+				}
+				if _, ok := m.Variables[k]; ok {
+					return nil, errors.Errorf("Variable %s is set by the platform for module %s, it can't be overridden", k, m.Name)
+				}
+				if m.Variables == nil {
+					m.Variables = make(map[string]interface{})
+				}
+				// Each module gets its own copy, as output references are
+				// resolved in place. Every module has its own Variables map.
+				m.Variables[k] = normaliseVariable(v)
+				used[k] = true
+			}
+		}
+	}
+	return used, nil
+}
+
+// unusedVariables returns the sorted names of the variables that weren't used
+func unusedVariables(vars map[string]interface{}, used map[string]bool) []string {
+	var unused []string
+	for k := range vars {
+		if !used[k] {
+			unused = append(unused, k)
+		}
+	}
+	sort.Strings(unused)
+	return unused
+}
+
+// variablesError reports variables no module declares, most likely typos
+func variablesError(where string, unused []string) error {
+	return errors.Errorf("%s: no module declares the variables %s", where, strings.Join(unused, ", "))
+}
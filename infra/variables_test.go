@@ -0,0 +1,108 @@
+package infra
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPlatformVariables(t *testing.T) {
+	p := &Platform{
+		Name: "micro",
+		Kv:   "cloudflare",
+		Gslb: "cloudflare",
+		Variables: map[string]interface{}{
+			"replicas":          1,
+			"micro_image":       "micro/micro:v2.3.0",
+			"health_check_path": "/health",
+		},
+		Regions: []Region{
+			{Provider: "do", Region: "lon1", Variables: map[string]interface{}{
+				"replicas":            3,
+				"cockroachdb_storage": "50Gi",
+				"node_count":          5,
+			}},
+			{Provider: "aws", Region: "eu-west-2"},
+		},
+	}
+	steps, err := p.Steps()
+	if err != nil {
+		t.Fatal(err)
+	}
+	modules := make(map[string]*TerraformModule)
+	for _, s := range steps {
+		for _, task := range s {
+			if m, ok := task.(*TerraformModule); ok {
+				modules[m.ID] = m
+			}
+		}
+	}
+	tests := []struct {
+		module, variable string
+		value            interface{}
+	}{
+		{"micro-lon1-do-control", "replicas", 3},
+		{"micro-eu-west-2-aws-control", "replicas", 1},
+		{"micro-lon1-do-control", "micro_image", "micro/micro:v2.3.0"},
+		{"micro-lon1-do-resource", "micro_image", "micro/micro:v2.3.0"},
+		{"micro-lon1-do-resource", "cockroachdb_storage", "50Gi"},
+		{"micro-eu-west-2-aws-resource", "cockroachdb_storage", nil},
+		{"micro-lon1-do-network", "replicas", nil},
+		{"micro-lon1-do-k8s", "node_count", 5},
+		{"micro-lon1-do-kubeconfig", "node_count", nil},
+		{"micro-global-gslb", "health_check_path", "/health"},
+		{"micro-global-kv", "replicas", nil},
+	}
+	// Modules never share variables, they're changed in place
+	seen := make(map[uintptr]string)
+	for id, m := range modules {
+		ptr := reflect.ValueOf(m.Variables).Pointer()
+		if other, ok := seen[ptr]; ok && ptr != 0 {
+			t.Errorf("%s and %s share their variables", id, other)
+		}
+		seen[ptr] = id
+	}
+	for _, test := range tests {
+		m, ok := modules[test.module]
+		if !ok {
+			t.Fatalf("Expected a module %s", test.module)
+		}
+		if v := m.Variables[test.variable]; !reflect.DeepEqual(v, test.value) {
+			t.Errorf("%s: expected %s to be %v, got %v", test.module, test.variable, test.value, v)
+		}
+	}
+}
+
+func TestPlatformVariablesErrors(t *testing.T) {
+	tests := []struct {
+		platform map[string]interface{}
+		region   map[string]interface{}
+		err      string
+	}{
+		{platform: map[string]interface{}{"replcias": 3}, err: "Platform micro: no module declares the variables replcias"},
+		{region: map[string]interface{}{"nats_imgae": "nats"}, err: "Region lon1-do: no module declares the variables nats_imgae"},
+		{region: map[string]interface{}{"domain_name": "micro.dev"}, err: "Variable domain_name is set by the platform"},
+	}
+	for _, test := range tests {
+		p := &Platform{Name: "micro", Kv: "cloudflare", Variables: test.platform, Regions: []Region{
+			{Provider: "do", Region: "lon1", Variables: test.region},
+		}}
+		if _, err := p.Steps(); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("Expected an error containing %q, got %v", test.err, err)
+		}
+	}
+}
+
+func TestNormaliseVariable(t *testing.T) {
+	v := normaliseVariable(map[interface{}]interface{}{
+		"labels": map[interface{}]interface{}{"team": "platform"},
+		"zones":  []interface{}{"a", map[interface{}]interface{}{"b": true}},
+	})
+	expected := map[string]interface{}{
+		"labels": map[string]interface{}{"team": "platform"},
+		"zones":  []interface{}{"a", map[string]interface{}{"b": true}},
+	}
+	if !reflect.DeepEqual(v, expected) {
+		t.Errorf("Expected %v, got %v", expected, v)
+	}
+}